@@ -0,0 +1,140 @@
+package cmap
+
+import (
+	"sync"
+	"time"
+)
+
+// accessBuckets is the number of one-second buckets kept per key, which bounds the window of AccessRate.
+const accessBuckets = 64
+
+// accessRing counts the accesses of a key in one-second buckets, reused as the seconds go by.
+type accessRing struct {
+	counts  [accessBuckets]uint32
+	seconds [accessBuckets]int64
+}
+
+// add counts an access at the given unix second.
+func (r *accessRing) add(sec int64) {
+	i := sec % accessBuckets
+	if r.seconds[i] != sec {
+		r.seconds[i], r.counts[i] = sec, 0
+	}
+	r.counts[i]++
+}
+
+// count returns the accesses in the n seconds up to and including the given unix second.
+func (r *accessRing) count(sec int64, n int64) uint64 {
+	var total uint64
+	for i := range r.counts {
+		if s := r.seconds[i]; s > sec-n && s <= sec {
+			total += uint64(r.counts[i])
+		}
+	}
+	return total
+}
+
+// accessPart is one of the independently locked parts of an accessTracker.
+type accessPart struct {
+	mu   sync.Mutex
+	keys map[string]*accessRing
+	max  int
+}
+
+// accessTracker keeps the recent accesses of up to a bounded number of keys. It is split in parts by key hash, independently of the shards, so that readers of different keys rarely meet on the same lock.
+type accessTracker struct {
+	parts []accessPart
+}
+
+func newAccessTracker(maxKeys int) *accessTracker {
+	t := &accessTracker{parts: make([]accessPart, SHARD_COUNT)}
+	perPart := (maxKeys + len(t.parts) - 1) / len(t.parts)
+	for i := range t.parts {
+		t.parts[i] = accessPart{keys: make(map[string]*accessRing), max: perPart}
+	}
+	return t
+}
+
+func (t *accessTracker) part(key string) *accessPart {
+	return &t.parts[fnv32(key)%uint32(len(t.parts))]
+}
+
+// add counts an access of the key. If its part tracks as many keys as it may, a key idle for the whole ring is dropped to make room, and if there is none the access isn't counted.
+func (t *accessTracker) add(key string, now int64) {
+	sec := now / int64(time.Second)
+
+	p := t.part(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.keys[key]
+	if !ok {
+		if len(p.keys) >= p.max && !p.dropIdle(sec) {
+			return
+		}
+		r = &accessRing{}
+		p.keys[key] = r
+	}
+	r.add(sec)
+}
+
+// dropIdle removes one key without accesses in the whole ring, returning false if there is none. The caller must hold the part's lock.
+func (p *accessPart) dropIdle(sec int64) bool {
+	for k, r := range p.keys {
+		if r.count(sec, accessBuckets) == 0 {
+			delete(p.keys, k)
+			return true
+		}
+	}
+	return false
+}
+
+// rate returns the accesses per second of the key over the trailing window of whole seconds, leaving out the second in progress.
+func (t *accessTracker) rate(key string, window time.Duration, now int64) float64 {
+	sec := now / int64(time.Second)
+	n := int64((window + time.Second - 1) / time.Second)
+	if n > accessBuckets-1 {
+		n = accessBuckets - 1
+	}
+	if n < 1 {
+		return 0
+	}
+
+	p := t.part(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.keys[key]
+	if !ok {
+		return 0
+	}
+	return float64(r.count(sec-1, n)) / float64(n)
+}
+
+// total returns the accesses of the key in the whole ring, the current second included.
+func (t *accessTracker) total(key string, now int64) uint64 {
+	p := t.part(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.keys[key]
+	if !ok {
+		return 0
+	}
+	return r.count(now/int64(time.Second), accessBuckets)
+}
+
+// AccessRate returns how many times per second the key was read by Get or MustGet, on average over the trailing window, which is rounded up to whole seconds and capped at 63 seconds. Only complete seconds are counted, so the reads of the current second show up once it ends. It needs WithAccessRate, otherwise, or for a key that isn't tracked, it returns 0.
+func (h HashTable) AccessRate(key string, window time.Duration) float64 {
+	if h.access == nil {
+		return 0
+	}
+	return h.access.rate(key, window, now())
+}
+
+// accessed counts a read of the key, if access rates are tracked.
+func (h HashTable) accessed(key string) {
+	if h.access != nil {
+		h.access.add(key, now())
+	}
+}
@@ -0,0 +1,90 @@
+package cmap
+
+import "sync"
+
+// applierQueue is the number of pairs each worker of StartApplier may have waiting before routing blocks.
+const applierQueue = 256
+
+// StartApplier applies the pairs received from in to the hashtable in the background, with the given number of workers: a pair with Deleted set deletes its key, any other puts its value. Pairs are routed to the workers by shard, every shard belonging to a single worker, so the workers never fight over a shard lock and the changes of each shard, hence of each key, are applied in the order they were received. The routing is fixed by the number of shards when it starts: after a Resize the order of each key is still kept, but workers may share shards. Values of workers below 1 are treated as 1.
+//
+// The returned function stops it: it applies what in has buffered and the pairs already received, stops receiving, and waits for the workers to finish. Applying also ends once in is closed or the hashtable is closed, and the stop function then just waits.
+func (h HashTable) StartApplier(in <-chan Pair, workers int) (stop func()) {
+	if workers < 1 {
+		workers = 1
+	}
+	if !h.startWorker() {
+		return func() {}
+	}
+
+	n := h.layout().primaries
+	queues := make([]chan Pair, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan Pair, applierQueue)
+		wg.Add(1)
+		go func(queue <-chan Pair) {
+			defer wg.Done()
+			for p := range queue {
+				h.applyPair(p)
+			}
+		}(queues[i])
+	}
+
+	halt := make(chan struct{})
+	done := make(chan struct{})
+	route := func(p Pair) {
+		queues[h.index(p.Key, n)%workers] <- p
+	}
+
+	go func() {
+		defer h.workers.Done()
+		defer close(done)
+		defer wg.Wait()
+		defer func() {
+			for _, queue := range queues {
+				close(queue)
+			}
+		}()
+
+		for {
+			select {
+			case p, ok := <-in:
+				if !ok {
+					return
+				}
+				route(p)
+			case <-h.closed:
+				return
+			case <-halt:
+				for {
+					select {
+					case p, ok := <-in:
+						if !ok {
+							return
+						}
+						route(p)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(halt)
+			<-done
+		})
+	}
+}
+
+// applyPair applies the write or deletion described by the pair to the hashtable.
+func (h HashTable) applyPair(p Pair) {
+	if p.Deleted {
+		h.Del(p.Key)
+		return
+	}
+	h.Put(p.Key, p.Value)
+}
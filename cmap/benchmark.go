@@ -0,0 +1,142 @@
+package cmap
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchSampleEvery is how often Benchmark samples the latency of an operation, to keep the memory used for the samples bounded.
+const benchSampleEvery = 8
+
+// BenchConfig configures a run of Benchmark.
+type BenchConfig struct {
+	// Options configure the hashtable under test.
+	Options []Option
+	// Goroutines is the number of concurrent workers. It defaults to 1.
+	Goroutines int
+	// Duration is how long the workers run. It defaults to one second.
+	Duration time.Duration
+	// Keys is the number of distinct keys the workers pick from. The hashtable is filled with all of them before the run. It defaults to 1024.
+	Keys int
+	// ValueSize is the length of the stored values in bytes.
+	ValueSize int
+	// Reads, Writes, and Deletes are the relative weights of Get, Put, and Del in the mix. If all of them are zero, only reads are done.
+	Reads   int
+	Writes  int
+	Deletes int
+	// Seed seeds the random choice of keys and operations.
+	Seed int64
+}
+
+// BenchResult is the outcome of a run of Benchmark.
+type BenchResult struct {
+	// Ops is the number of operations done by all the workers.
+	Ops int64
+	// Elapsed is the wall time of the run.
+	Elapsed time.Duration
+	// Throughput is the number of operations per second.
+	Throughput float64
+	// P50, P90, P99, and Max are percentiles of the latency of a single operation, sampled from every eighth operation.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Benchmark runs the mix of operations described by cfg against a new hashtable and reports its throughput and latency. It is meant to compare option combinations, like shard counts and lock policies, on a workload resembling the caller's.
+func Benchmark(cfg BenchConfig) BenchResult {
+	if cfg.Goroutines < 1 {
+		cfg.Goroutines = 1
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = time.Second
+	}
+	if cfg.Keys < 1 {
+		cfg.Keys = 1024
+	}
+	if cfg.Reads+cfg.Writes+cfg.Deletes <= 0 {
+		cfg.Reads = 1
+	}
+
+	keys := make([]string, cfg.Keys)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	value := string(make([]byte, cfg.ValueSize))
+
+	ht := New(cfg.Options...)
+	defer ht.Close()
+	for _, k := range keys {
+		ht.Put(k, value)
+	}
+
+	total := cfg.Reads + cfg.Writes + cfg.Deletes
+	latencies := make([][]time.Duration, cfg.Goroutines)
+	ops := make([]int64, cfg.Goroutines)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	for g := 0; g < cfg.Goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(cfg.Seed + int64(g)))
+			var lat []time.Duration
+			var n int64
+			for ; ; n++ {
+				t := time.Now()
+				if !t.Before(deadline) {
+					break
+				}
+
+				k := keys[r.Intn(len(keys))]
+				switch op := r.Intn(total); {
+				case op < cfg.Reads:
+					ht.Get(k)
+				case op < cfg.Reads+cfg.Writes:
+					ht.Put(k, value)
+				default:
+					ht.Del(k)
+				}
+				if n%benchSampleEvery == 0 {
+					lat = append(lat, time.Since(t))
+				}
+			}
+			latencies[g] = lat
+			ops[g] = n
+		}(g)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var all []time.Duration
+	var res BenchResult
+	for g, lat := range latencies {
+		all = append(all, lat...)
+		res.Ops += ops[g]
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	res.Elapsed = elapsed
+	if elapsed > 0 {
+		res.Throughput = float64(res.Ops) / elapsed.Seconds()
+	}
+	if len(all) > 0 {
+		res.P50 = percentile(all, 0.50)
+		res.P90 = percentile(all, 0.90)
+		res.P99 = percentile(all, 0.99)
+		res.Max = all[len(all)-1]
+	}
+	return res
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
@@ -0,0 +1,34 @@
+package cmap
+
+import "unsafe"
+
+// PutBytes stores a copy of the given bytes as the value of the key, so later changes to the slice don't affect the stored value. Values are kept as strings, so a value stored by PutBytes can be read by Get and vice versa.
+func (h HashTable) PutBytes(key string, value []byte) {
+	h.Put(key, string(value))
+}
+
+// GetBytes returns a fresh copy of the value associated with the key, which the caller is free to modify. If it doesn't exist, it will return nil and false.
+func (h HashTable) GetBytes(key string) ([]byte, bool) {
+	v, ok := h.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return []byte(v), true
+}
+
+// GetByBytes is Get for a key held in a byte slice, looking it up without converting it to a string, so that a hit doesn't allocate. The lookup uses a string sharing the memory of key, which keeps being used only while GetByBytes runs: a ShardStore given with WithShardStore must not keep the keys passed to its Get, which the default store doesn't. Whenever the key has to outlive the call, on a miss with WithLoader, with WithAccessRate, or for a record stored with PutWithTTI, it falls back to Get with a copy of the key.
+func (h HashTable) GetByBytes(key []byte) (string, bool) {
+	k := bytesToString(key)
+
+	v, ok, sliding := h.peek(k)
+
+	if (ok && !sliding && h.access == nil) || (!ok && h.opts.loader == nil) {
+		return v, ok
+	}
+	return h.Get(string(key))
+}
+
+// bytesToString returns a string sharing the memory of b, without copying it. b must not be modified while the string is in use, and the string must not be kept.
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
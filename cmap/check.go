@@ -0,0 +1,64 @@
+package cmap
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// SelfCheck verifies the internal consistency of the hashtable: that every record is held by the shard its key maps to, that the metadata of the records belongs to existing records, and that the size counter, and the byte total with WithByteAccounting, match the contents of the shards. It returns an error wrapping ErrCorrupted describing the first inconsistency found, or nil. All the shards are read-locked together, so it sees a single moment of the hashtable, at the cost of stalling writers while it runs.
+func (h HashTable) SelfCheck() error {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	l := h.layout()
+	for _, s := range shards {
+		s.Lock.RLock()
+		defer s.Lock.RUnlock()
+	}
+
+	var size, bytes int64
+	for i, s := range shards {
+		var err error
+		s.Data.Range(func(k, v string) bool {
+			if j := h.locate(l, k); j != i {
+				err = fmt.Errorf("%w: key %q is in shard %d but maps to shard %d", ErrCorrupted, k, i, j)
+				return false
+			}
+			if _, ok := s.versions[k]; !ok {
+				err = fmt.Errorf("%w: key %q in shard %d has no version", ErrCorrupted, k, i)
+				return false
+			}
+			size++
+			bytes += int64(len(k) + len(v))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, meta := range []map[string]int64{s.expires, s.modified} {
+			for k := range meta {
+				if _, ok := s.Data.Get(k); !ok {
+					return fmt.Errorf("%w: shard %d has metadata of missing key %q", ErrCorrupted, i, k)
+				}
+			}
+		}
+		for k := range s.inserted {
+			if _, ok := s.Data.Get(k); !ok {
+				return fmt.Errorf("%w: shard %d has metadata of missing key %q", ErrCorrupted, i, k)
+			}
+		}
+		if len(s.versions) != s.Data.Len() {
+			return fmt.Errorf("%w: shard %d has %d versions for %d records", ErrCorrupted, i, len(s.versions), s.Data.Len())
+		}
+	}
+
+	if n := atomic.LoadInt64(&h.size); n != size {
+		return fmt.Errorf("%w: size counter is %d but the shards hold %d records", ErrCorrupted, n, size)
+	}
+	if n := atomic.LoadInt64(&h.bytes); h.opts.byteAccounting && n != bytes {
+		return fmt.Errorf("%w: byte total is %d but the shards hold %d bytes", ErrCorrupted, n, bytes)
+	}
+	return nil
+}
@@ -1,125 +1,1412 @@
-// Package cmap implements a thread-safe concurrent string to string hashtable. It uses FNV32 hash function. The hashtable is divided into multiple shards and each shard gets locked while an operation is being done on it. Sharding helps to lower the performance loss due to the lock contention. Instead of locking the whole hashtable, we only lock the appropriate shards.
+// Package cmap implements a thread-safe concurrent string to string hashtable. It uses FNV32 hash function. The hashtable is divided into multiple shards and each shard gets locked while an operation is being done on it. Sharding helps to lower the performance loss due to the lock contention. Instead of locking the whole hashtable, we only lock the appropriate shards. Any string is a valid key, including the empty string, which is hashed and stored like any other key and is never mistaken for a missing one.
 package cmap
 
 import (
+	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
-// SHARD_COUNT is the number of the shards that the hashtable is divided into.
+// SHARD_COUNT is the default number of the shards that the hashtable is divided into.
 const SHARD_COUNT = 32
 
-type shard struct {
-	Lock sync.RWMutex
-	Data map[string]string
+// HashTable is a thread-safe concurrent hashtable made of shards. Each shard contains a normal map and a lock.
+type HashTable struct {
+	*table
 }
 
-// HashTable is a slice of shards. Each shard contains a normal map and a lock.
-type HashTable []*shard
+type table struct {
+	size  int64 // accessed atomically, kept first for 64-bit alignment.
+	bytes int64 // accessed atomically, only kept with WithByteAccounting.
 
-// New initializes and returns a hashtable.
-func New() *HashTable {
-	ht := make(HashTable, SHARD_COUNT)
-	for i := 0; i < SHARD_COUNT; i++ {
-		ht[i] = &shard{Data: make(map[string]string)}
+	evictions uint64 // accessed atomically, only counted with WithEvictionSampling.
+	inserts   uint64 // accessed atomically, hands out the insertion sequences of EntryMeta.
+
+	// id orders the locks of different hashtables when one operation needs shards of both, like Move does.
+	id uint64
+
+	// current holds the *layout in use. Operations on a single key only load it, while operations spanning several shards hold layoutMu for reading so that neither Resize nor a split of WithHotShardSplitting can replace it under them.
+	current  atomic.Value
+	layoutMu sync.RWMutex
+
+	subs     subscribers
+	waiters  waiters
+	loads    flights
+	computes flights
+	writes   writeBuffer
+	keyLocks keyLocks
+	ordered  orderedIndex
+	interned internPool
+	access   *accessTracker // only set with WithAccessRate.
+	opts     options
+
+	// closed is closed by Close to stop the background goroutines, which are tracked by workers. closeMu orders closing it with the additions to workers, see startWorker.
+	closed  chan struct{}
+	closeMu sync.Mutex
+	workers sync.WaitGroup
+}
+
+// layout is an arrangement of the shards. It is never modified, Resize replaces it with a new one.
+type layout struct {
+	shards []*shard
+
+	// primaries is the number of shards keys are spread over by their hash. The shards past it are the sub-shards added by WithHotShardSplitting.
+	primaries int
+
+	// split maps the index of every shard split by WithHotShardSplitting to the indexes of its sub-shards, the first of which is the split shard itself. It is nil until the first split.
+	split map[int][]int
+
+	// migration is set while records are still being moved out of the shards of the previous layout.
+	migration *migration
+}
+
+// New initializes and returns a hashtable configured by the given options.
+func New(opts ...Option) *HashTable {
+	o := options{shardCount: SHARD_COUNT}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return newHashTable(o)
+}
+
+// NewLike returns an empty hashtable configured exactly like this one, with the same options and current number of shards, so that keys land in the same shards.
+func (h HashTable) NewLike() *HashTable {
+	o := h.opts
+	o.shardCount = h.layout().primaries
+	return newHashTable(o)
+}
+
+// tableIDs hands out the ids of the hashtables.
+var tableIDs uint64
+
+func newHashTable(o options) *HashTable {
+	t := &table{id: atomic.AddUint64(&tableIDs, 1), opts: o, closed: make(chan struct{})}
+	if o.accessRateKeys > 0 {
+		t.access = newAccessTracker(o.accessRateKeys)
 	}
-	return &ht
+
+	shards := make([]*shard, t.opts.shardCount)
+	for i := range shards {
+		shards[i] = newShard(&t.opts)
+	}
+	t.current.Store(&layout{shards: shards, primaries: len(shards)})
+
+	h := &HashTable{t}
+	if o.writer != nil && o.flushInterval > 0 {
+		h.workers.Add(1)
+		go h.flushLoop(o.flushInterval)
+	}
+	return h
+}
+
+// Close shuts the hashtable down and makes it inert. Every background goroutine it started is stopped and waited for: the migration of a Resize is finished, batched event subscriptions flush their pending events, replications apply theirs, and the periodic flush of WithWriter stops. Then the channels of every subscription get closed and, with WithWriter, the writes still buffered are flushed. It returns the writer's error, if any, otherwise nil. Calling it more than once is harmless, and retries a failed flush.
+//
+// Once closed, the hashtable can still be read, but stays as it is: every write, deletion, and Resize is a no-op, and the error-returning variants, like TryPut, return ErrClosed.
+func (h *HashTable) Close() error {
+	h.closeMu.Lock()
+	if !h.isClosed() {
+		close(h.closed)
+	}
+	h.closeMu.Unlock()
+
+	h.workers.Wait()
+	h.subs.closeAll()
+	return h.Flush()
+}
+
+// isClosed returns true once Close has been called.
+func (h HashTable) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWorker counts a new background goroutine in workers and returns true, or returns false without counting it if the hashtable is closed. It checks and counts under closeMu, which Close holds to close h.closed, so a goroutine is either counted before Close waits for workers or not started at all.
+func (h HashTable) startWorker() bool {
+	h.closeMu.Lock()
+	defer h.closeMu.Unlock()
+
+	if h.isClosed() {
+		return false
+	}
+	h.workers.Add(1)
+	return true
+}
+
+// refused returns the error reporting that set refused to store a record of the key, because the hashtable is closed or at capacity.
+func (h HashTable) refused(key string) error {
+	if h.isClosed() {
+		return ErrClosed
+	}
+	return fmt.Errorf("%w: key %q", ErrCapacity, key)
 }
 
 // From gets a normal map, constructs, and returns a thread-safe concurrent hashtable out of its records.
 func From(data map[string]string) *HashTable {
 	ht := New()
 	for k, v := range data {
-		shard := ht.getShard(k)
+		shard := ht.lockShard(k)
+		ht.set(shard, k, v)
+		shard.unlock()
+	}
+	return ht
+}
 
-		shard.Lock.Lock()
-		shard.Data[k] = v
-		shard.Lock.Unlock()
+// FromConcurrent is like From, but splits the records of the map between the given number of goroutines, each storing its part grouped by shard, so that building a big hashtable uses several cores. Values of workers below 1 are treated as 1.
+func FromConcurrent(data map[string]string, workers int) *HashTable {
+	if workers < 1 {
+		workers = 1
 	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+
+	ht := New()
+	chunk := (len(keys) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(keys); start += chunk {
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			ht.putKeys(keys, data)
+		}(keys[start:end])
+	}
+	wg.Wait()
+
 	return ht
 }
 
-// Get returns true and the value associated with the key. If it doesn't exist, it will return empty string and false.
+// Get returns true and the value associated with the key. If it doesn't exist, it will return empty string and false. With WithLoader, a missing key is loaded and stored first, and a loader error counts as a miss.
 func (h HashTable) Get(key string) (string, bool) {
-	shard := h.getShard(key)
+	v, ok, sliding := h.peek(key)
 
-	shard.Lock.RLock()
-	defer shard.Lock.RUnlock()
+	if !ok && h.opts.loader != nil {
+		v, ok, _ = h.load(key)
+	}
+	if ok {
+		h.accessed(key)
+		if sliding {
+			h.slide(key)
+		}
+	}
+	return v, ok
+}
+
+// GetOrZero returns the value associated with the key, or the empty string if it doesn't exist, for callers treating a missing record like an empty one. It is Get without the boolean, so it can't tell the two apart.
+func (h HashTable) GetOrZero(key string) string {
+	v, _ := h.Get(key)
+	return v
+}
 
-	v, ok := shard.Data[key]
+// MustGet returns the value associated with the key. If it doesn't exist, it will return an error mentioning the key. With WithLoader, a missing key is loaded first and a loader error is returned as is.
+func (h HashTable) MustGet(key string) (string, error) {
+	v, ok, sliding := h.peek(key)
 
-	return v, ok
+	if !ok && h.opts.loader != nil {
+		var err error
+		if v, ok, err = h.load(key); err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+
+	h.accessed(key)
+	if sliding {
+		h.slide(key)
+	}
+	return v, nil
 }
 
-// Put adds a new key-value pair to the hashtable. If there is already a record with a key same as the given key, the value will be overridden.
+// Put adds a new key-value pair to the hashtable. If there is already a record with a key same as the given key, the value will be overridden. A pair exceeding the limits set by WithMaxKeyLen or WithMaxValueLen is ignored, use TryPut to get the error instead.
 func (h HashTable) Put(key string, value string) {
-	shard := h.getShard(key)
+	if h.checkLimits(key, value) != nil {
+		return
+	}
 
-	shard.Lock.Lock()
-	defer shard.Lock.Unlock()
+	shard := h.lockShard(key)
+	defer shard.unlock()
 
-	shard.Data[key] = value
+	h.set(shard, key, value)
 }
 
-// PutIfNotExist will add a new key-value pair only if no record with the same key exists. It returns true if the new record added successfully.
-func (h HashTable) PutIfNotExist(key string, value string) bool {
-	shard := h.getShard(key)
+// PutWithWeight is like Put, but gives the record a weight, which WithMaxSize uses to pick the records to evict: whenever room has to be made in a shard, the record with the lowest weight among a few records of the shard is evicted. It is an approximation, since the records compared are picked at random, so a heavy record can still be evicted before a lighter one outside the sample. Records stored without a weight weigh 0, and a later write of the key without a weight drops it.
+func (h HashTable) PutWithWeight(key string, value string, weight int) {
+	if h.checkLimits(key, value) != nil {
+		return
+	}
 
-	shard.Lock.Lock()
-	defer shard.Lock.Unlock()
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if h.set(shard, key, value) != 0 && weight != 0 {
+		shard.setWeight(key, weight)
+	}
+}
+
+// PutReturning is like Put, but also returns the value the key had before and whether it existed, read under the same lock as the write, like the Swap of sync.Map. It tells an insert from an overwrite without a separate Get. Like Put, it silently skips the write if the pair exceeds the configured limits, if WithMaxSize leaves no room for it, or once the hashtable is closed, and still returns the previous value, so callers that need to know should use TryPut.
+func (h HashTable) PutReturning(key string, value string) (previous string, existed bool) {
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	previous, existed = h.live(shard, key)
+	if h.checkLimits(key, value) == nil {
+		h.set(shard, key, value)
+	}
+	return previous, existed
+}
+
+// TryPut is like Put, but returns an error wrapping ErrKeyTooLong or ErrValueTooLong, and leaves the hashtable unchanged, if the pair exceeds the configured limits.
+func (h HashTable) TryPut(key string, value string) error {
+	if err := h.checkLimits(key, value); err != nil {
+		return err
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if h.set(shard, key, value) == 0 {
+		return h.refused(key)
+	}
+	return nil
+}
+
+// PutAll adds all the given key-value pairs to the hashtable, overriding existing values. Keys are grouped by shard and each shard's lock is taken once. If any pair exceeds the configured limits, it returns an error wrapping ErrKeyTooLong or ErrValueTooLong and adds none of them. If some new records are rejected by WithMaxSize, the others are still added and it returns an error wrapping ErrCapacity.
+func (h HashTable) PutAll(data map[string]string) error {
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if err := h.checkLimits(k, v); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+
+	if rejected := h.putKeys(keys, data); len(rejected) > 0 {
+		if h.isClosed() {
+			return ErrClosed
+		}
+		return fmt.Errorf("%w: %d of %d records rejected", ErrCapacity, len(rejected), len(keys))
+	}
+	return nil
+}
+
+// PutAllChecked is like PutAll, but stores every pair it can instead of none when some fail. It returns the error of each pair that couldn't be stored, wrapping ErrKeyTooLong, ErrValueTooLong, or ErrCapacity, keyed by its key. An empty map means every pair was stored.
+func (h HashTable) PutAllChecked(data map[string]string) map[string]error {
+	errs := make(map[string]error)
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if err := h.checkLimits(k, v); err != nil {
+			errs[k] = err
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	for _, k := range h.putKeys(keys, data) {
+		errs[k] = h.refused(k)
+	}
+	return errs
+}
+
+// Apply sets every key of desired to its value and reports what it changed: inserted holds the keys that didn't exist, updated the ones whose value differed, and unchanged the ones that already had their value. Unchanged keys are not written at all, so they get no new version and trigger no events or callbacks. Keys are grouped by shard and each shard's lock is taken once. Pairs exceeding the configured limits, or rejected by WithMaxSize, are left out of all three.
+func (h HashTable) Apply(desired map[string]string) (inserted []string, updated []string, unchanged []string) {
+	keys := make([]string, 0, len(desired))
+	for k := range desired {
+		keys = append(keys, k)
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		// The comparator of WithValueEquals runs under the lock, so it is released even if it panics.
+		hooks.add(shard.write(func() {
+			for _, k := range group {
+				v := desired[k]
+				old, ok := h.live(shard, k)
+				switch {
+				case ok && h.equal(old, v):
+					unchanged = append(unchanged, k)
+				case h.checkLimits(k, v) != nil || h.set(shard, k, v) == 0:
+					// Rejected, so it is left out.
+				case ok:
+					updated = append(updated, k)
+				default:
+					inserted = append(inserted, k)
+				}
+			}
+		}))
+	}
+	return inserted, updated, unchanged
+}
+
+// putKeys stores the records of the given keys, taken from data, grouped by shard so each shard's lock is taken once. It returns the keys of the new records WithMaxSize rejected.
+func (h HashTable) putKeys(keys []string, data map[string]string) (rejected []string) {
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
 
-	_, ok := shard.Data[key]
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		hooks.add(shard.write(func() {
+			for _, k := range group {
+				if h.set(shard, k, data[k]) == 0 {
+					rejected = append(rejected, k)
+				}
+			}
+		}))
+	}
+	return rejected
+}
+
+// GetVersioned returns the value associated with the key along with its version. Every successful write gives the key a new, greater version. If the key doesn't exist, ok will be false.
+func (h HashTable) GetVersioned(key string) (value string, version uint64, ok bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	value, ok = shard.get(key)
 	if !ok {
-		shard.Data[key] = value
+		return "", 0, false
+	}
+	return value, shard.versions[key], true
+}
+
+// PutVersioned writes the key-value pair only if the key's current version equals expectedVersion. An expectedVersion of 0 means the key must not exist. It returns the new version and true if the write happened, otherwise the current version and false.
+func (h HashTable) PutVersioned(key string, value string, expectedVersion uint64) (newVersion uint64, ok bool) {
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	h.live(shard, key)
+	current := shard.versions[key]
+	if current != expectedVersion || h.checkLimits(key, value) != nil {
+		return current, false
+	}
+
+	if version := h.set(shard, key, value); version != 0 {
+		return version, true
+	}
+	return current, false
+}
+
+// CompareAndSwap replaces the value of the key with newValue only if its current value equals oldValue, as compared by WithValueEquals. It returns true if the swap happened. If the key doesn't exist, it will return false.
+func (h HashTable) CompareAndSwap(key string, oldValue string, newValue string) bool {
+	_, swapped := h.CompareAndSwapReturning(key, oldValue, newValue)
+	return swapped
+}
+
+// CompareAndDelete deletes the record of the key only if its current value equals oldValue, as compared by WithValueEquals. It returns true if the deletion happened. Like Del, it leaves a tombstone with WithSoftDelete.
+func (h HashTable) CompareAndDelete(key string, oldValue string) bool {
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	v, ok := h.live(shard, key)
+	if !ok || !h.equal(v, oldValue) {
+		return false
 	}
 
-	return !ok
+	h.del(shard, key, EvictDeleted)
+	return true
 }
 
-// Del deletes the record associated with the given key. If the deletion was successful it will return true. If the record didn't exist, it will return false.
+// CompareAndSwapReturning replaces the value of the key with newValue only if its current value equals oldValue. It returns the value stored after the operation, newValue if the swap happened, otherwise the unchanged current value, and whether the swap happened. If the key doesn't exist, it will return empty string and false.
+func (h HashTable) CompareAndSwapReturning(key string, oldValue string, newValue string) (current string, swapped bool) {
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	v, ok := h.live(shard, key)
+	if !ok || !h.equal(v, oldValue) || h.checkLimits(key, newValue) != nil {
+		return v, false
+	}
+
+	h.set(shard, key, newValue)
+	return newValue, true
+}
+
+// CompareAndSwapMany replaces the values of several keys at once, only if every key currently exists with its Old value. It returns true if all the values were replaced, otherwise it leaves the hashtable unchanged and returns false. The involved shards are locked together, in ascending order, so the checks and the writes are atomic and concurrent calls can't deadlock.
+func (h HashTable) CompareAndSwapMany(updates map[string]struct{ Old, New string }) bool {
+	keys := make([]string, 0, len(updates))
+	for k, u := range updates {
+		if h.checkLimits(k, u.New) != nil {
+			return false
+		}
+		keys = append(keys, k)
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	h.lockGroups(groups)
+	defer h.unlockGroups(groups, &hooks)
+
+	for i, group := range groups {
+		for _, k := range group {
+			if v, ok := h.live(shards[i], k); !ok || !h.equal(v, updates[k].Old) {
+				return false
+			}
+		}
+	}
+
+	for i, group := range groups {
+		for _, k := range group {
+			h.set(shards[i], k, updates[k].New)
+		}
+	}
+	return true
+}
+
+// PutIfNotExist will add a new key-value pair only if no record with the same key exists. It returns true if the new record added successfully. Like Put, it may evict another record when WithMaxSize is set, and returns false if the record is rejected for lack of room, use TryPutIfNotExist to tell the two apart.
+func (h HashTable) PutIfNotExist(key string, value string) bool {
+	added, _ := h.TryPutIfNotExist(key, value)
+	return added
+}
+
+// TryPutIfNotExist is like PutIfNotExist, but returns an error if the record couldn't be added for a reason other than the key existing. The error wraps ErrKeyTooLong or ErrValueTooLong if the pair exceeds the configured limits, or ErrCapacity if WithMaxSize left no room for it.
+func (h HashTable) TryPutIfNotExist(key string, value string) (bool, error) {
+	if err := h.checkLimits(key, value); err != nil {
+		return false, err
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if _, ok := h.live(shard, key); ok {
+		return false, nil
+	}
+	if h.set(shard, key, value) == 0 {
+		return false, h.refused(key)
+	}
+	return true, nil
+}
+
+// Insert adds the key-value pair only if no record with the same key exists, like TryPutIfNotExist, but reports an existing key as an error wrapping ErrOverwriteDenied, for callers that treat it as a failure. The other errors are the ones of TryPutIfNotExist.
+func (h HashTable) Insert(key string, value string) error {
+	added, err := h.TryPutIfNotExist(key, value)
+	if err == nil && !added {
+		return fmt.Errorf("%w: key %q", ErrOverwriteDenied, key)
+	}
+	return err
+}
+
+// PutAllIfNoneExist adds all the given key-value pairs only if none of their keys exists. It returns true if the records were added, otherwise it leaves the hashtable unchanged and returns false. The involved shards are locked together, in ascending order, so the check and the writes are atomic. With WithMaxSize, records that find no room are left out, like PutAll does.
+func (h HashTable) PutAllIfNoneExist(data map[string]string) bool {
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if h.checkLimits(k, v) != nil {
+			return false
+		}
+		keys = append(keys, k)
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	h.lockGroups(groups)
+	defer h.unlockGroups(groups, &hooks)
+
+	for i, group := range groups {
+		for _, k := range group {
+			if _, ok := h.live(shards[i], k); ok {
+				return false
+			}
+		}
+	}
+
+	for i, group := range groups {
+		for _, k := range group {
+			h.set(shards[i], k, data[k])
+		}
+	}
+	return true
+}
+
+// Del deletes the record associated with the given key. If the deletion was successful it will return true. If the record didn't exist, it will return false. With WithSoftDelete, the record can be brought back by Undelete for a while.
 func (h HashTable) Del(key string) (string, bool) {
-	shard := h.getShard(key)
+	shard := h.lockShard(key)
+	defer shard.unlock()
 
-	shard.Lock.Lock()
-	defer shard.Lock.Unlock()
+	if _, ok := h.live(shard, key); !ok {
+		return "", false
+	}
+	return h.del(shard, key, EvictDeleted)
+}
 
-	v, ok := shard.Data[key]
-	delete(shard.Data, key)
+// DeleteIf deletes the record associated with the given key only if it exists and pred returns true for its value. It returns true if the deletion happened. pred is called under the shard's write lock, so it must not call back into the hashtable.
+func (h HashTable) DeleteIf(key string, pred func(value string) bool) bool {
+	shard := h.lockShard(key)
+	defer shard.unlock()
 
-	return v, ok
+	v, ok := h.live(shard, key)
+	if !ok || !pred(v) {
+		return false
+	}
+
+	h.del(shard, key, EvictDeleted)
+	return true
+}
+
+// DelMany deletes the records of the given keys and returns the removed values, keyed by key. Keys that don't exist are left out of the result. The keys are grouped by shard and each shard is write-locked once, so it costs one lock acquisition per involved shard however many keys there are. Each shard is done on its own, so other goroutines can see the deletions of some shards before the others. Like Del, it leaves tombstones with WithSoftDelete.
+func (h HashTable) DelMany(keys []string) map[string]string {
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	removed := make(map[string]string)
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		hooks.add(shard.write(func() {
+			for _, k := range group {
+				if _, ok := h.live(shard, k); !ok {
+					continue
+				}
+				if v, ok := h.del(shard, k, EvictDeleted); ok {
+					removed[k] = v
+				}
+			}
+		}))
+	}
+	return removed
+}
+
+// Undelete brings back the record of the key deleted with WithSoftDelete, along with its TTL, and returns true. It returns false if there is no tombstone of the key whose retention hasn't run out, or if the key has been written again since, in which case the tombstone is dropped. The record comes back as a new write, with a new version.
+func (h HashTable) Undelete(key string) bool {
+	if h.isClosed() {
+		return false
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	t, ok := shard.tombstones[key]
+	if !ok {
+		return false
+	}
+	delete(shard.tombstones, key)
+
+	if _, exists := h.live(shard, key); exists || t.purgeAt <= now() {
+		return false
+	}
+	if h.set(shard, key, t.value) == 0 {
+		return false
+	}
+	if t.hasExpiry {
+		shard.expires[key] = t.expires
+	}
+	return true
+}
+
+// HasValue returns true if the hashtable contains a record of the key whose value equals the given value, as compared by WithValueEquals, without copying the value out.
+func (h HashTable) HasValue(key string, value string) bool {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	v, ok := shard.get(key)
+	return ok && h.equal(v, value)
 }
 
 // Has returns true if the hashtable contains a record with a key same as the given key.
 func (h HashTable) Has(key string) bool {
-	shard := h.getShard(key)
-
-	shard.Lock.RLock()
+	shard := h.rlockShard(key)
 	defer shard.Lock.RUnlock()
 
-	_, ok := shard.Data[key]
+	_, ok := shard.get(key)
 	return ok
 }
 
-// Len returns the number of key-value pairs stored in the hashtable.
+// HasAll returns true if the hashtable contains every one of the given keys. Keys are grouped by shard and each shard's read lock is taken once. It stops at the first missing key.
+func (h HashTable) HasAll(keys []string) bool {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		var missing bool
+		shard.read(func() {
+			for _, k := range group {
+				if _, ok := shard.get(k); !ok {
+					missing = true
+					return
+				}
+			}
+		})
+		if missing {
+			return false
+		}
+	}
+	return true
+}
+
+// HasAny returns true if the hashtable contains at least one of the given keys. Keys are grouped by shard and each shard's read lock is taken once. It stops at the first present key.
+func (h HashTable) HasAny(keys []string) bool {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		var found bool
+		shard.read(func() {
+			for _, k := range group {
+				if _, ok := shard.get(k); ok {
+					found = true
+					return
+				}
+			}
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// PresenceMask returns a slice aligned with the given keys, holding true where the key exists in the hashtable. Unlike reading the values, nothing gets copied. Keys are grouped by shard and each shard's read lock is taken once.
+func (h HashTable) PresenceMask(keys []string) []bool {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	l := h.layout()
+	positions := make([][]int, len(shards))
+	for i, k := range keys {
+		j := h.locate(l, k)
+		positions[j] = append(positions[j], i)
+	}
+
+	mask := make([]bool, len(keys))
+	for i, group := range positions {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		shard.read(func() {
+			for _, pos := range group {
+				_, mask[pos] = shard.get(keys[pos])
+			}
+		})
+	}
+	return mask
+}
+
+// MGet returns the found records of the given keys. Keys are grouped by shard and each shard's read lock is taken once, releasing it before the next one, so writes spanning several shards may be seen half-applied.
+func (h HashTable) MGet(keys []string) map[string]string {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	result := make(map[string]string, len(keys))
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		shard.read(func() {
+			for _, k := range group {
+				if v, ok := shard.get(k); ok {
+					result[k] = v
+				}
+			}
+		})
+	}
+	return result
+}
+
+// MGetConsistent is like MGet, but read-locks all the involved shards together, in ascending order, before reading any key. Since multi-key writes like PutAllIfNoneExist and CompareAndSwapMany lock their shards the same way, the result never shows them half-applied. The price is latency: writers of every involved shard wait for the whole batch, and the batch waits for all their locks.
+func (h HashTable) MGetConsistent(keys []string) map[string]string {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) > 0 {
+			shards[i].Lock.RLock()
+			defer shards[i].Lock.RUnlock()
+		}
+	}
+
+	result := make(map[string]string, len(keys))
+	for i, group := range groups {
+		for _, k := range group {
+			if v, ok := shards[i].get(k); ok {
+				result[k] = v
+			}
+		}
+	}
+	return result
+}
+
+// MGetGrouped returns the found records of the given keys grouped by the index of the shard that holds them, consistent with ShardIndex. Shards without any found record are left out. Each shard's read lock is taken once.
+func (h HashTable) MGetGrouped(keys []string) map[int]map[string]string {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	result := make(map[int]map[string]string)
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		shard.read(func() {
+			for _, k := range group {
+				if v, ok := shard.get(k); ok {
+					if result[i] == nil {
+						result[i] = make(map[string]string)
+					}
+					result[i][k] = v
+				}
+			}
+		})
+	}
+	return result
+}
+
+// Len returns the number of key-value pairs stored in the hashtable. Expired records that have not been removed yet, by a write to their key or by DeleteExpired, are counted too.
 func (h HashTable) Len() int {
-	var count int
-	for i := 0; i < SHARD_COUNT; i++ {
-		shard := h[i]
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
 
-		shard.Lock.RLock()
-		count += len(shard.Data)
-		shard.Lock.RUnlock()
+	var count int
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			count += shard.Data.Len()
+		})
 	}
 	return count
 }
 
-// getShard finds the FNV32 hash of the given key. It calculates the modulo SHARD_COUNT to get the index of the shard.
-func (h HashTable) getShard(key string) *shard {
-	return h[uint(fnv32(key))%uint(SHARD_COUNT)]
+// ApproxLen returns the number of key-value pairs stored in the hashtable, read from the size counter that every write keeps up to date. It takes no lock, so it is cheap enough to be polled at a high rate, but it may be momentarily off from Len while writes are in flight.
+func (h HashTable) ApproxLen() int {
+	return int(atomic.LoadInt64(&h.size))
+}
+
+// Evictions returns the number of records removed from the hashtable, for whatever reason, since it was created. It is only counted with WithEvictionSampling, otherwise it returns 0.
+func (h HashTable) Evictions() uint64 {
+	return atomic.LoadUint64(&h.evictions)
+}
+
+// Bytes returns the total length of the keys and values stored in the hashtable, kept up to date by every write. It is only maintained with WithByteAccounting, otherwise it returns 0. Like Len, it counts expired records that have not been removed yet.
+func (h HashTable) Bytes() int64 {
+	return atomic.LoadInt64(&h.bytes)
+}
+
+// KeysWithValue returns every key whose value equals the given value. It scans all the shards, so it is intended for occasional use, not hot paths.
+func (h HashTable) KeysWithValue(value string) []string {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var keys []string
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				if h.equal(v, value) {
+					keys = append(keys, k)
+				}
+				return true
+			})
+		})
+	}
+	return keys
+}
+
+// RangeSorted calls f for every record of the hashtable in ascending order of keys, until f returns false. Only the keys are collected and sorted up front, each value is read when its turn comes, so records deleted in the meantime are skipped and overwritten ones show their newer value. f is called without holding any lock, so it may use the hashtable.
+func (h HashTable) RangeSorted(f func(key string, value string) bool) {
+	keys := h.keys()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if v, ok, _ := h.peek(k); ok && !f(k, v) {
+			return
+		}
+	}
+}
+
+// keys returns the keys of every record of the hashtable, in no particular order.
+func (h HashTable) keys() []string {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var keys []string
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(k, _ string) bool {
+				keys = append(keys, k)
+				return true
+			})
+		})
+	}
+	return keys
+}
+
+// Clear removes all the records from the hashtable. The shards get cleared one at a time.
+func (h HashTable) Clear() {
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	for _, shard := range h.shards() {
+		hooks.add(shard.write(func() {
+			data := h.reset(shard)
+			data.Range(func(k, v string) bool {
+				h.evicted(shard, k, v, EvictCleared)
+				return true
+			})
+		}))
+	}
+}
+
+// Shrink rebuilds the maps of every shard to reclaim the memory left behind by deleted records. The shards get compacted one at a time.
+func (h HashTable) Shrink() {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	for _, shard := range h.shards() {
+		shard.write(shard.compact)
+	}
+}
+
+// DrainShard empties the shard with the given index and returns its records. Only that shard gets locked, so the hashtable can be migrated one shard at a time while the other shards serve traffic. It returns nil if the index is out of range. Once the hashtable is closed, it leaves the shard as it is and returns an empty map.
+func (h HashTable) DrainShard(shardIndex int) map[string]string {
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	if shardIndex < 0 || shardIndex >= len(shards) {
+		return nil
+	}
+	if h.isClosed() {
+		return map[string]string{}
+	}
+
+	shard := shards[shardIndex]
+
+	shard.Lock.Lock()
+	defer func() { hooks.add(shard.release()) }()
+
+	expires := shard.expires
+	data := storeToMap(h.reset(shard))
+
+	now := now()
+	for k, exp := range expires {
+		if exp <= now {
+			h.evicted(shard, k, data[k], EvictExpired)
+			delete(data, k)
+		}
+	}
+	for k, v := range data {
+		h.emit(Event{Op: OpDel, Key: k, OldValue: v})
+	}
+	h.logf(shard, "cmap: drained shard %d (%d records)", shardIndex, len(data))
+
+	return data
+}
+
+// ShardData returns a copy of the records held by the shard with the given index, taken under its read lock, so it can be inspected without affecting the hashtable. Expired records are left out. It returns false if the index is out of range.
+func (h HashTable) ShardData(shardIndex int) (map[string]string, bool) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	if shardIndex < 0 || shardIndex >= len(shards) {
+		return nil, false
+	}
+
+	shard := shards[shardIndex]
+
+	shard.Lock.RLock()
+	defer shard.Lock.RUnlock()
+
+	data := make(map[string]string, shard.Data.Len())
+	shard.each(func(k, v string) bool {
+		data[k] = v
+		return true
+	})
+	return data, true
+}
+
+// ShardIndex returns the index of the shard that holds the given key. Keys with equal ShardIndex are guarded by the same shard lock, so a multi-key operation like PutAll, MGet, or CompareAndSwapMany takes that lock once for all of them. LockKey locks all the keys sharing the ShardIndex of its key, so they can be updated together under one LockKey. The index is stable until the hashtable is resized, or its shard split by WithHotShardSplitting, both of which wait for the locks of LockKey to be released. It doesn't lock anything.
+func (h HashTable) ShardIndex(key string) int {
+	return h.locate(h.layout(), key)
+}
+
+// layout returns the layout in use.
+func (h HashTable) layout() *layout {
+	return h.current.Load().(*layout)
+}
+
+// shards returns the shards of the current layout, finishing any migration still in progress first. The caller must hold layoutMu.
+func (h HashTable) shards() []*shard {
+	l := h.layout()
+	if l.migration != nil {
+		h.migrateAll(l)
+	}
+	return l.shards
+}
+
+// index finds the FNV32 hash of the given key, seeded by WithHashSeed, and maps it to one of n shards, by modulo or by consistent hashing if it is enabled.
+func (h HashTable) index(key string, n int) int {
+	hash := fnv32Seeded(key, h.opts.hashSeed)
+	if h.opts.consistentHashing {
+		return jumpHash(uint64(hash), n)
+	}
+	return modIndex(hash, n)
+}
+
+// subShardSeed is XORed into the hash seed to pick the sub-shard of a key, so it doesn't depend on the hash that picked its shard.
+const subShardSeed = 0x9e3779b9
+
+// locate returns the index of the shard of the layout that holds the key: the shard its hash maps to among the primary shards or, if that one was split by WithHotShardSplitting, the sub-shard picked by a second hash of the key, independent of the first one.
+func (h HashTable) locate(l *layout, key string) int {
+	i := h.index(key, l.primaries)
+	if sub, ok := l.split[i]; ok {
+		return sub[modIndex(mix32(fnv32Seeded(key, h.opts.hashSeed^subShardSeed)), len(sub))]
+	}
+	return i
+}
+
+// modIndex maps the hash to one of n shards by modulo. The arithmetic is done in uint32, whatever the size of int on the platform, so the result is the same everywhere and always in [0, n). n must be between 1 and MaxShardCount, which fits in a uint32. Nothing assumes n is a power of two.
+func modIndex(hash uint32, n int) int {
+	return int(hash % uint32(n))
+}
+
+// lockShard finds the shard holding the given key and returns it write-locked. If a resize replaced the layout while it was waiting for the lock, it retries with the new layout.
+func (h HashTable) lockShard(key string) *shard {
+	for {
+		l := h.layout()
+		s := h.route(l, key)
+
+		s.Lock.Lock()
+		if h.layout() == l {
+			return s
+		}
+		s.Lock.Unlock()
+	}
+}
+
+// peek returns the value of the key, treating an expired record as absent, along with true if the record has an idle timeout. Unlike Get, it doesn't load, count, or slide anything. The read lock is released even if the store panics.
+func (h HashTable) peek(key string) (value string, ok bool, sliding bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	value, ok = shard.get(key)
+	_, sliding = shard.idle[key]
+	return value, ok, sliding
+}
+
+// rlockShard finds the shard holding the given key and returns it read-locked. If a resize replaced the layout while it was waiting for the lock, it retries with the new layout.
+func (h HashTable) rlockShard(key string) *shard {
+	for {
+		l := h.layout()
+		s := h.route(l, key)
+
+		s.Lock.RLock()
+		if h.layout() == l {
+			return s
+		}
+		s.Lock.RUnlock()
+	}
+}
+
+// groupPool keeps the slices made by groupByShard for reuse, so the bulk operations don't allocate them on every call.
+var groupPool = sync.Pool{New: func() interface{} { return new([][]string) }}
+
+// maxPooledKeys is the most keys the slices of a grouping may hold to be put back into groupPool, so one huge call doesn't keep its memory around.
+const maxPooledKeys = 1 << 12
+
+// groupByShard splits the given keys by the shard that holds them. The result is indexed by shard index, so walking it visits the shards in ascending order. It is taken from groupPool and must be handed back to releaseGroups once done with, so it must not reach the caller. The caller must hold layoutMu.
+func (h HashTable) groupByShard(keys []string) [][]string {
+	n := len(h.shards())
+	l := h.layout()
+	groups := *groupPool.Get().(*[][]string)
+	if cap(groups) < n {
+		groups = make([][]string, n)
+	}
+	groups = groups[:n]
+	for _, k := range keys {
+		i := h.locate(l, k)
+		groups[i] = append(groups[i], k)
+	}
+	return groups
+}
+
+// releaseGroups clears the slices made by groupByShard, so they don't keep the keys alive, and puts them back into groupPool.
+func releaseGroups(groups [][]string) {
+	var total int
+	for i, group := range groups {
+		for j := range group {
+			group[j] = ""
+		}
+		groups[i] = group[:0]
+		total += cap(group)
+	}
+	if total <= maxPooledKeys {
+		groupPool.Put(&groups)
+	}
+}
+
+// live returns the value of the key like shard.get, but removes the record if it has expired. The caller must hold the shard's write lock.
+func (h HashTable) live(s *shard, key string) (string, bool) {
+	if len(s.expires) > 0 && s.expired(key, now()) {
+		h.del(s, key, EvictExpired)
+		return "", false
+	}
+	v, ok := s.Data.Get(key)
+	return v, ok
+}
+
+// equal compares two values with the function set by WithValueEquals, or with == by default.
+func (h HashTable) equal(a string, b string) bool {
+	if eq := h.opts.valueEquals; eq != nil {
+		return eq(a, b)
+	}
+	return a == b
+}
+
+// checkLimits returns an error if the key or the value is longer than the limits set by WithMaxKeyLen and WithMaxValueLen.
+func (h HashTable) checkLimits(key string, value string) error {
+	if n := h.opts.maxKeyLen; n > 0 && len(key) > n {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLong, len(key), n)
+	}
+	if n := h.opts.maxValueLen; n > 0 && len(value) > n {
+		return fmt.Errorf("%w: key %q has %d bytes, limit is %d", ErrValueTooLong, key, len(value), n)
+	}
+	return nil
+}
+
+// lockGroups write-locks the shards that hold any of the grouped keys, in ascending order of shard index. The caller must hold layoutMu.
+func (h HashTable) lockGroups(groups [][]string) {
+	shards := h.shards()
+	for i, group := range groups {
+		if len(group) > 0 {
+			shards[i].Lock.Lock()
+		}
+	}
+}
+
+// unlockGroups releases the locks taken by lockGroups and adds the hooks queued on the shards to hooks, for the caller to run once it releases layoutMu. The caller must hold layoutMu.
+func (h HashTable) unlockGroups(groups [][]string, hooks *hookQueue) {
+	shards := h.shards()
+	for i, group := range groups {
+		if len(group) > 0 {
+			hooks.add(shards[i].release())
+		}
+	}
+}
+
+// set stores the key-value pair in the given shard and keeps the size counter up to date. It returns the new version of the key, or 0 if the hashtable is closed or the record is new and WithMaxSize left no room for it. The caller must hold the shard's write lock.
+func (h HashTable) set(s *shard, key string, value string) uint64 {
+	if h.isClosed() {
+		return 0
+	}
+
+	old, existed := h.live(s, key)
+	if !existed && !h.admit(s) {
+		return 0
+	}
+	if h.opts.valueInterning {
+		value = h.interned.intern(value)
+	}
+	version := s.set(key, value)
+	h.queueWrite(Pair{Key: key, Value: value})
+	if !existed {
+		s.inserted[key] = atomic.AddUint64(&h.inserts, 1)
+		if h.opts.orderedIndex {
+			h.ordered.add(key)
+		}
+		h.resized(s, 1)
+		h.sized(int64(len(key) + len(value)))
+	} else {
+		h.sized(int64(len(value) - len(old)))
+	}
+	h.emit(Event{Op: OpPut, Key: key, OldValue: old, NewValue: value})
+	h.wake(key, value)
+	return version
+}
+
+// evictionSamples is the number of records of a shard admit compares to pick the one to evict, when some of them have weights.
+const evictionSamples = 8
+
+// admit makes room for a new record in the given shard when the hashtable is at the size set by WithMaxSize, by evicting another record of the shard. Once records of the shard have weights, the lightest of a few records is evicted. The records compared are the first ones Range visits with the default store, whose Go map starts iterating at a random record, and records at random positions with any other store, which may visit them in a fixed order like NewSliceStore does, at the cost of walking the shard. Among equal weights, the victim is picked at random. It returns false if there is none. The caller must hold the shard's write lock.
+func (h HashTable) admit(s *shard) bool {
+	n := h.opts.maxSize
+	if n <= 0 || atomic.LoadInt64(&h.size) < int64(n) {
+		return true
+	}
+
+	samples := 1
+	if s.weights != nil {
+		samples = evictionSamples
+	}
+	var positions []int
+	if _, ok := rawStore(s.Data).(mapStore); !ok && s.Data.Len() > samples {
+		positions = randomPositions(s.Data.Len(), samples)
+	}
+
+	var victim string
+	var found bool
+	var weight, ties, seen, i int
+	s.Data.Range(func(k, _ string) bool {
+		if positions != nil {
+			if i++; positions[0] != i-1 {
+				return true
+			}
+			positions = positions[1:]
+		}
+		switch w := s.weights[k]; {
+		case !found || w < weight:
+			victim, weight, found, ties = k, w, true, 1
+		case w == weight:
+			if ties++; rand.Intn(ties) == 0 {
+				victim = k
+			}
+		}
+		seen++
+		return seen < samples
+	})
+	if !found {
+		return false
+	}
+
+	h.del(s, victim, EvictCapacity)
+	return true
+}
+
+// randomPositions returns k distinct positions out of n, in ascending order, using the algorithm of Floyd. k must not be above n.
+func randomPositions(n int, k int) []int {
+	positions := make([]int, 0, k)
+	for j := n - k; j < n; j++ {
+		p := rand.Intn(j + 1)
+		for _, q := range positions {
+			if q == p {
+				p = j
+				break
+			}
+		}
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// del removes the record from the given shard, keeps the size counter up to date, and reports the eviction with the given reason. It does nothing once the hashtable is closed. The caller must hold the shard's write lock.
+func (h HashTable) del(s *shard, key string, reason EvictReason) (string, bool) {
+	if h.isClosed() {
+		return "", false
+	}
+
+	if retention := h.opts.softDelete; retention > 0 && reason == EvictDeleted {
+		if v, ok := s.Data.Get(key); ok {
+			r := record{key: key, value: v}
+			r.expires, r.hasExpiry = s.expires[key]
+			s.bury(r, now()+int64(retention))
+		}
+	}
+
+	v, ok := s.del(key)
+	if ok {
+		if h.opts.orderedIndex {
+			h.ordered.remove(key)
+		}
+		h.resized(s, -1)
+		h.sized(-int64(len(key) + len(v)))
+		h.evicted(s, key, v, reason)
+		if reason == EvictDeleted {
+			h.queueWrite(Pair{Key: key, Deleted: true})
+		}
+
+		if r := h.opts.shrinkRatio; r > 0 && float64(s.deleted) > r*float64(s.Data.Len()) {
+			s.compactDue = true
+		}
+	}
+	return v, ok
+}
+
+// reset empties the shard, keeps the counters up to date, and returns the removed records. Once the hashtable is closed, it leaves the shard as it is and returns an empty store. The caller must hold the shard's write lock.
+func (h HashTable) reset(s *shard) ShardStore {
+	if h.isClosed() {
+		return s.newStore()
+	}
+
+	data := s.reset()
+	h.resized(s, -data.Len())
+
+	if h.opts.byteAccounting {
+		var n int64
+		data.Range(func(k, v string) bool {
+			n += int64(len(k) + len(v))
+			return true
+		})
+		h.sized(-n)
+	}
+	if h.opts.orderedIndex {
+		h.ordered.removeAll(data)
+	}
+	return data
+}
+
+// sized adds delta to the byte total if byte accounting is enabled.
+func (h HashTable) sized(delta int64) {
+	if h.opts.byteAccounting && delta != 0 {
+		atomic.AddInt64(&h.bytes, delta)
+	}
+}
+
+// evicted reports the removed record to the subscribers and queues the eviction callback on the shard. The caller must hold the shard's write lock.
+func (h HashTable) evicted(s *shard, key string, value string, reason EvictReason) {
+	h.emit(Event{Op: OpDel, Key: key, OldValue: value})
+
+	if rate := h.opts.evictionSampling; rate > 0 {
+		if n := atomic.AddUint64(&h.evictions, 1); n%uint64(rate) == 0 {
+			h.logf(s, "cmap: evicted %q (%s), %d evictions so far", key, reason, n)
+		}
+	}
+
+	f := h.opts.onEvict
+	if f == nil {
+		return
+	}
+	s.hooks = append(s.hooks, func() { f(key, value, reason) })
+}
+
+// resized adds delta to the size counter. If the change crosses the size threshold, the threshold callback gets queued on the shard to run once its lock is released. The caller must hold the shard's write lock.
+func (h HashTable) resized(s *shard, delta int) {
+	if delta == 0 {
+		return
+	}
+
+	size := int(atomic.AddInt64(&h.size, int64(delta)))
+
+	f, n := h.opts.onThreshold, h.opts.sizeThreshold
+	if f != nil && (size-delta < n) != (size < n) {
+		s.hooks = append(s.hooks, func() { f(size) })
+		h.logf(s, "cmap: size crossed threshold %d (size %d)", n, size)
+	}
+	if h.opts.hotShardSplitting {
+		h.checkHot(s, size)
+	}
+}
+
+// logf queues a message for the logger on the shard, so it gets written once the shard's lock is released. The caller must hold the shard's write lock.
+func (h HashTable) logf(s *shard, format string, args ...interface{}) {
+	logger := h.opts.logger
+	if logger == nil {
+		return
+	}
+	s.hooks = append(s.hooks, func() { logger(format, args...) })
+}
+
+// Hash returns the hash the hashtable uses to pick the shard of the key: the 32-bit FNV-1 hash of its bytes. Hashtables created with WithHashSeed or WithRandomSeed use a seeded variant instead, which Hash doesn't report. It is part of the stable API, so shard placements, and the dumps relying on them, stay valid across versions. Changing it would be a breaking change.
+func Hash(key string) uint32 {
+	return fnv32(key)
 }
 
 // fnv32 returns the FNV32 hash of the given key.
 func fnv32(key string) uint32 {
-	hash := uint32(2166136261)
+	return fnv32Seeded(key, 0)
+}
+
+// fnv32Seeded returns the FNV32 hash of the given key, with the seed XORed into the offset basis and the result mixed by mix32. A seed of 0 gives the plain FNV32 hash.
+func fnv32Seeded(key string, seed uint32) uint32 {
+	hash := uint32(2166136261) ^ seed
 	const prime32 = uint32(16777619)
 
 	for i := 0; i < len(key); i++ {
@@ -127,5 +1414,18 @@ func fnv32(key string) uint32 {
 		hash ^= uint32(key[i])
 	}
 
+	if seed != 0 {
+		hash = mix32(hash)
+	}
 	return hash
 }
+
+// mix32 is the finalizer of MurmurHash3, which makes every bit of the result depend on every bit of h. The low bits of an FNV32 hash only depend on the low bits of the offset basis and of the key, so without it, keys of the same length sharing a shard would share one under every seed too.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
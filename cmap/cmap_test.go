@@ -0,0 +1,6109 @@
+package cmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testKeys returns n distinct keys.
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func TestShardIndexStable(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		i := h.ShardIndex(k)
+		if i < 0 || i >= SHARD_COUNT {
+			t.Fatalf("ShardIndex(%q) = %d, out of range", k, i)
+		}
+		if j := h.ShardIndex(k); j != i {
+			t.Fatalf("ShardIndex(%q) changed from %d to %d", k, i, j)
+		}
+		h.Put(k, "v")
+		if j := h.ShardIndex(k); j != i {
+			t.Fatalf("ShardIndex(%q) changed from %d to %d after Put", k, i, j)
+		}
+	}
+}
+
+func TestShardIndexMatchesGet(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		h.Put(k, "v"+k)
+	}
+
+	for _, k := range testKeys(100) {
+		data, ok := h.ShardData(h.ShardIndex(k))
+		if !ok {
+			t.Fatalf("ShardData(%d) returned false", h.ShardIndex(k))
+		}
+		if data[k] != "v"+k {
+			t.Fatalf("shard %d holds %q = %q, want %q", h.ShardIndex(k), k, data[k], "v"+k)
+		}
+		if v, _ := h.Get(k); v != data[k] {
+			t.Fatalf("Get(%q) = %q, shard holds %q", k, v, data[k])
+		}
+	}
+}
+
+// sameShardKeys returns two distinct keys sharing a shard of the hashtable, and a third one in another shard.
+func sameShardKeys(h *HashTable) (a string, b string, other string) {
+	keys := testKeys(1000)
+	a = keys[0]
+	for _, k := range keys[1:] {
+		switch {
+		case h.ShardIndex(k) == h.ShardIndex(a) && b == "":
+			b = k
+		case h.ShardIndex(k) != h.ShardIndex(a) && other == "":
+			other = k
+		}
+	}
+	return a, b, other
+}
+
+func TestLockKeySharedByShard(t *testing.T) {
+	h := New()
+	a, b, other := sameShardKeys(h)
+
+	unlock := h.LockKey(a)
+
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		h.LockKey(b)()
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("LockKey(%q) didn't wait for LockKey(%q) of the same shard", b, a)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.LockKey(other)()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("LockKey(%q) of another shard waited for LockKey(%q)", other, a)
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("LockKey(%q) still waiting after unlocking %q", b, a)
+	}
+}
+
+func TestLockKeyUpdatesShardTogether(t *testing.T) {
+	h := New()
+	a, b, _ := sameShardKeys(h)
+	h.Put(a, "0")
+	h.Put(b, "0")
+
+	// Each worker moves one unit from a to b, half of them under LockKey(a) and half under LockKey(b), relying on the two keys sharing a lock.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		locked := a
+		if i%2 == 1 {
+			locked = b
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				unlock := h.LockKey(locked)
+				va, _ := h.Get(a)
+				vb, _ := h.Get(b)
+				na, _ := strconv.Atoi(va)
+				nb, _ := strconv.Atoi(vb)
+				h.Put(a, strconv.Itoa(na-1))
+				h.Put(b, strconv.Itoa(nb+1))
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if va, vb := h.GetOrZero(a), h.GetOrZero(b); va != "-800" || vb != "800" {
+		t.Fatalf("a = %s, b = %s, want -800 and 800", va, vb)
+	}
+}
+
+func TestResizeWaitsForLockKey(t *testing.T) {
+	h := New(WithShardCount(4))
+	unlock := h.LockKey("k")
+	before := h.ShardIndex("k")
+
+	resized := make(chan struct{})
+	go func() {
+		defer close(resized)
+		h.Resize(64)
+	}()
+	select {
+	case <-resized:
+		t.Fatal("Resize didn't wait for LockKey to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if i := h.ShardIndex("k"); i != before {
+		t.Fatalf("ShardIndex changed from %d to %d while LockKey was held", before, i)
+	}
+
+	unlock()
+	select {
+	case <-resized:
+	case <-time.After(time.Second):
+		t.Fatal("Resize still waiting after LockKey was released")
+	}
+	if n := len(h.layout().shards); n != 64 {
+		t.Fatalf("%d shards after Resize(64)", n)
+	}
+}
+
+func TestMustGet(t *testing.T) {
+	h := New()
+	h.Put("present", "v")
+
+	v, err := h.MustGet("present")
+	if err != nil || v != "v" {
+		t.Fatalf("MustGet(present) = %q, %v, want v, nil", v, err)
+	}
+
+	_, err = h.MustGet("absent")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("MustGet(absent) error = %v, want ErrKeyNotFound", err)
+	}
+	if !strings.Contains(err.Error(), `"absent"`) {
+		t.Fatalf("MustGet(absent) error %q doesn't mention the key", err)
+	}
+}
+
+func TestKeysWithValue(t *testing.T) {
+	h := New()
+	h.Put("a", "shared")
+	h.Put("b", "shared")
+	h.Put("c", "other")
+
+	keys := h.KeysWithValue("shared")
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "a,b" {
+		t.Fatalf("KeysWithValue(shared) = %v, want [a b]", keys)
+	}
+
+	if keys := h.KeysWithValue("nowhere"); len(keys) != 0 {
+		t.Fatalf("KeysWithValue(nowhere) = %v, want none", keys)
+	}
+}
+
+func TestDrainShardAll(t *testing.T) {
+	h := New()
+	keys := testKeys(500)
+	for _, k := range keys {
+		h.Put(k, "v"+k)
+	}
+
+	drained := make(map[string]string)
+	for i := 0; i < SHARD_COUNT; i++ {
+		for k, v := range h.DrainShard(i) {
+			if _, dup := drained[k]; dup {
+				t.Fatalf("key %q drained twice", k)
+			}
+			drained[k] = v
+		}
+	}
+
+	if len(drained) != len(keys) {
+		t.Fatalf("drained %d records, want %d", len(drained), len(keys))
+	}
+	for _, k := range keys {
+		if drained[k] != "v"+k {
+			t.Fatalf("drained %q = %q, want %q", k, drained[k], "v"+k)
+		}
+	}
+	if n := h.Len(); n != 0 {
+		t.Fatalf("Len() = %d after draining every shard, want 0", n)
+	}
+}
+
+func TestDrainShardOutOfRange(t *testing.T) {
+	h := New()
+	if data := h.DrainShard(-1); data != nil {
+		t.Fatalf("DrainShard(-1) = %v, want nil", data)
+	}
+	if data := h.DrainShard(SHARD_COUNT); data != nil {
+		t.Fatalf("DrainShard(%d) = %v, want nil", SHARD_COUNT, data)
+	}
+}
+
+func TestPutVersioned(t *testing.T) {
+	h := New()
+
+	v1, ok := h.PutVersioned("k", "a", 0)
+	if !ok || v1 == 0 {
+		t.Fatalf("PutVersioned(k, a, 0) = %d, %v, want a new version", v1, ok)
+	}
+	if _, ok := h.PutVersioned("k", "b", 0); ok {
+		t.Fatal("PutVersioned with version 0 succeeded on an existing key")
+	}
+
+	v2, ok := h.PutVersioned("k", "b", v1)
+	if !ok || v2 <= v1 {
+		t.Fatalf("PutVersioned(k, b, %d) = %d, %v, want a greater version", v1, v2, ok)
+	}
+
+	current, ok := h.PutVersioned("k", "stale", v1)
+	if ok || current != v2 {
+		t.Fatalf("PutVersioned with stale version = %d, %v, want %d, false", current, ok, v2)
+	}
+
+	value, version, ok := h.GetVersioned("k")
+	if !ok || value != "b" || version != v2 {
+		t.Fatalf("GetVersioned(k) = %q, %d, %v, want b, %d, true", value, version, ok, v2)
+	}
+
+	h.Put("k", "c")
+	if _, version, _ := h.GetVersioned("k"); version <= v2 {
+		t.Fatalf("Put didn't increase the version: %d after %d", version, v2)
+	}
+	if _, _, ok := h.GetVersioned("absent"); ok {
+		t.Fatal("GetVersioned(absent) returned true")
+	}
+}
+
+func TestSizeThreshold(t *testing.T) {
+	var calls []int
+	h := New(WithSizeThreshold(3, func(size int) { calls = append(calls, size) }))
+
+	for _, k := range testKeys(5) {
+		h.Put(k, "v")
+	}
+	if len(calls) != 1 || calls[0] != 3 {
+		t.Fatalf("crossing up: callback calls = %v, want [3]", calls)
+	}
+
+	h.Put("key0", "overwrite")
+	if len(calls) != 1 {
+		t.Fatalf("overwrite fired the callback: %v", calls)
+	}
+
+	for _, k := range testKeys(4) {
+		h.Del(k)
+	}
+	if len(calls) != 2 || calls[1] != 2 {
+		t.Fatalf("crossing down: callback calls = %v, want [3 2]", calls)
+	}
+}
+
+// finishes fails the test if f doesn't return within a second.
+func finishes(t *testing.T, name string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s hung", name)
+	}
+}
+
+func TestSizeThresholdResizeDuringPutAll(t *testing.T) {
+	var h *HashTable
+	h = New(WithShardCount(4), WithSizeThreshold(10, func(int) { h.Resize(64) }))
+
+	data := make(map[string]string)
+	for _, k := range testKeys(100) {
+		data[k] = "v"
+	}
+	finishes(t, "PutAll with a threshold callback calling Resize", func() {
+		if err := h.PutAll(data); err != nil {
+			t.Errorf("PutAll = %v", err)
+		}
+	})
+
+	if n := len(h.layout().shards); n != 64 {
+		t.Fatalf("%d shards, want 64", n)
+	}
+	for k := range data {
+		if !h.Has(k) {
+			t.Fatalf("%q missing after the resize", k)
+		}
+	}
+}
+
+func TestBulkHooksRunOutsideLayoutLock(t *testing.T) {
+	ops := map[string]func(h *HashTable, keys []string){
+		"Clear":   func(h *HashTable, _ []string) { h.Clear() },
+		"DelMany": func(h *HashTable, keys []string) { h.DelMany(keys) },
+		"DrainShard": func(h *HashTable, keys []string) {
+			h.DrainShard(h.ShardIndex(keys[0]))
+		},
+		"PutAllIfNoneExist": func(h *HashTable, _ []string) {
+			h.PutAllIfNoneExist(map[string]string{"new": "v"})
+		},
+	}
+
+	for name, op := range ops {
+		var h *HashTable
+		var resized int32
+		callback := func() {
+			if atomic.CompareAndSwapInt32(&resized, 0, 1) {
+				h.Resize(64)
+			}
+		}
+		h = New(WithShardCount(4),
+			WithOnEvict(func(string, string, EvictReason) { callback() }),
+			WithLogger(func(string, ...interface{}) { callback() }),
+			WithSizeThreshold(5, func(int) { callback() }),
+			WithMaxSize(20),
+		)
+		keys := testKeys(20)
+		for _, k := range keys {
+			h.Put(k, "v")
+		}
+		atomic.StoreInt32(&resized, 0)
+
+		finishes(t, name+" with a callback calling Resize", func() { op(h, keys) })
+		if atomic.LoadInt32(&resized) != 1 {
+			t.Fatalf("%s triggered no callback", name)
+		}
+	}
+}
+
+func TestGetIntPutInt(t *testing.T) {
+	h := New()
+
+	h.PutInt("n", -42)
+	n, ok, err := h.GetInt("n")
+	if err != nil || !ok || n != -42 {
+		t.Fatalf("GetInt(n) = %d, %v, %v, want -42, true, nil", n, ok, err)
+	}
+
+	h.Put("text", "abc")
+	if _, ok, err := h.GetInt("text"); !ok || !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("GetInt(text) = %v, %v, want true, ErrNotInteger", ok, err)
+	}
+
+	if n, ok, err := h.GetInt("absent"); ok || err != nil || n != 0 {
+		t.Fatalf("GetInt(absent) = %d, %v, %v, want 0, false, nil", n, ok, err)
+	}
+	if n, err := h.GetOrDefaultInt("absent", 7); err != nil || n != 7 {
+		t.Fatalf("GetOrDefaultInt(absent, 7) = %d, %v, want 7, nil", n, err)
+	}
+}
+
+// countingStore is a ShardStore counting the lookups made in it.
+type countingStore struct {
+	ShardStore
+	gets int
+}
+
+func (s *countingStore) Get(key string) (string, bool) {
+	s.gets++
+	return s.ShardStore.Get(key)
+}
+
+// newCountingTable returns a hashtable whose shards count their lookups, along with their stores indexed by shard index.
+func newCountingTable() (*HashTable, *[]*countingStore) {
+	stores := new([]*countingStore)
+	h := New(WithShardStore(func() ShardStore {
+		s := &countingStore{ShardStore: newMapStore()}
+		*stores = append(*stores, s)
+		return s
+	}))
+	return h, stores
+}
+
+// keysInShards returns a key of the lowest and one of the highest shard of the hashtable.
+func keysInShards(h *HashTable) (low string, high string) {
+	for _, k := range testKeys(1000) {
+		switch h.ShardIndex(k) {
+		case 0:
+			low = k
+		case SHARD_COUNT - 1:
+			high = k
+		}
+	}
+	return low, high
+}
+
+func TestHasAllHasAny(t *testing.T) {
+	h := New()
+	h.PutAll(map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	tests := []struct {
+		keys   []string
+		all    bool
+		any    bool
+		reason string
+	}{
+		{[]string{"a", "b", "c"}, true, true, "all present"},
+		{[]string{"x", "y"}, false, false, "none present"},
+		{[]string{"a", "x"}, false, true, "mixed"},
+		{nil, true, false, "empty"},
+	}
+	for _, tt := range tests {
+		if got := h.HasAll(tt.keys); got != tt.all {
+			t.Errorf("%s: HasAll(%v) = %v, want %v", tt.reason, tt.keys, got, tt.all)
+		}
+		if got := h.HasAny(tt.keys); got != tt.any {
+			t.Errorf("%s: HasAny(%v) = %v, want %v", tt.reason, tt.keys, got, tt.any)
+		}
+	}
+}
+
+func TestHasAllHasAnyShortCircuit(t *testing.T) {
+	h, stores := newCountingTable()
+	low, high := keysInShards(h)
+	h.Put(high, "v")
+	(*stores)[SHARD_COUNT-1].gets = 0
+
+	if h.HasAll([]string{high, low}) {
+		t.Fatal("HasAll returned true with a missing key")
+	}
+	if n := (*stores)[SHARD_COUNT-1].gets; n != 0 {
+		t.Fatalf("HasAll looked up %d keys in shard %d after a miss in shard 0", n, SHARD_COUNT-1)
+	}
+
+	h.Put(low, "v")
+	(*stores)[SHARD_COUNT-1].gets = 0
+	if !h.HasAny([]string{high, low}) {
+		t.Fatal("HasAny returned false with present keys")
+	}
+	if n := (*stores)[SHARD_COUNT-1].gets; n != 0 {
+		t.Fatalf("HasAny looked up %d keys in shard %d after a hit in shard 0", n, SHARD_COUNT-1)
+	}
+}
+
+// testLogger collects the messages logged by a hashtable.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func TestLoggerResize(t *testing.T) {
+	var logger testLogger
+	h := New(WithLogger(logger.logf))
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+	if msgs := logger.messages(); len(msgs) != 0 {
+		t.Fatalf("writes were logged: %v", msgs)
+	}
+
+	h.Resize(64)
+	h.Close()
+
+	msgs := logger.messages()
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0], "cmap: resized from 32 to 64 shards") {
+		t.Fatalf("logged %q, want a single resize message", msgs)
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	h := New()
+	want := map[string]string{"": "empty key", "a": "", "ключ": "значение", "long": strings.Repeat("x", 300)}
+	h.PutAll(want)
+
+	b, err := h.MarshalProto()
+	if err != nil {
+		t.Fatalf("MarshalProto() error = %v", err)
+	}
+	got, err := UnmarshalProto(b)
+	if err != nil {
+		t.Fatalf("UnmarshalProto() error = %v", err)
+	}
+	if !reflect.DeepEqual(tableToMap(got), want) {
+		t.Fatalf("round trip = %v, want %v", tableToMap(got), want)
+	}
+
+	if _, err := UnmarshalProto(b[:len(b)-1]); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("UnmarshalProto(truncated) error = %v, want ErrInvalidEncoding", err)
+	}
+}
+
+// tableToMap returns the records of the hashtable as a map.
+func tableToMap(h *HashTable) map[string]string {
+	m := make(map[string]string)
+	h.Range(func(k, v string) bool {
+		m[k] = v
+		return true
+	})
+	return m
+}
+
+// protoTableDescriptor describes the message documented in proto.go: message HashTable { map<string, string> data = 1; }
+func protoTableDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("cmap.proto"),
+		Package: proto.String("cmap"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("HashTable"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name: proto.String("data"), JsonName: proto.String("data"), Number: proto.Int32(1),
+				Label: &repeated, Type: &msg, TypeName: proto.String(".cmap.HashTable.DataEntry"),
+			}},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("DataEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: &optional, Type: &str},
+					{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: &optional, Type: &str},
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatalf("building the descriptor: %v", err)
+	}
+	return fd.Messages().ByName("HashTable")
+}
+
+func TestProtoStandardLibrary(t *testing.T) {
+	desc := protoTableDescriptor(t)
+	want := map[string]string{"": "empty key", "a": "1", "b": "", "ключ": "значение"}
+
+	h := New()
+	h.PutAll(want)
+	b, err := h.MarshalProto()
+	if err != nil {
+		t.Fatalf("MarshalProto() error = %v", err)
+	}
+
+	decoded := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, decoded); err != nil {
+		t.Fatalf("protobuf can't decode MarshalProto output: %v", err)
+	}
+	got := make(map[string]string)
+	decoded.Get(desc.Fields().ByName("data")).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		got[k.String()] = v.String()
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("protobuf decoded %v, want %v", got, want)
+	}
+
+	encoded, err := proto.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("proto.Marshal() error = %v", err)
+	}
+	fromLibrary, err := UnmarshalProto(encoded)
+	if err != nil {
+		t.Fatalf("UnmarshalProto can't decode protobuf output: %v", err)
+	}
+	if !reflect.DeepEqual(tableToMap(fromLibrary), want) {
+		t.Fatalf("UnmarshalProto decoded %v, want %v", tableToMap(fromLibrary), want)
+	}
+}
+
+// eviction is a call of the eviction callback.
+type eviction struct {
+	key    string
+	value  string
+	reason EvictReason
+}
+
+func TestOnEvictReasons(t *testing.T) {
+	var evictions []eviction
+	var h *HashTable
+	h = New(WithShardCount(1), WithMaxSize(1), WithOnEvict(func(key, value string, reason EvictReason) {
+		h.Len() // deadlocks if called under the shard lock.
+		evictions = append(evictions, eviction{key, value, reason})
+	}))
+
+	h.Put("deleted", "1")
+	h.Del("deleted")
+
+	h.PutWithTTL("expired", "2", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	h.DeleteExpired()
+
+	h.Put("evicted", "3")
+	h.Put("new", "4")
+
+	h.Clear()
+
+	want := []eviction{
+		{"deleted", "1", EvictDeleted},
+		{"expired", "2", EvictExpired},
+		{"evicted", "3", EvictCapacity},
+	}
+	want = append(want, eviction{"new", "4", EvictCleared})
+	if !reflect.DeepEqual(evictions, want) {
+		t.Fatalf("evictions = %v, want %v", evictions, want)
+	}
+}
+
+// testConcurrentCounters has goroutines increment disjoint sets of counters, with concurrent readers, and checks that no increment is lost. Run with -race to check the locking of the options.
+func testConcurrentCounters(t *testing.T, opts ...Option) {
+	h := New(opts...)
+	const goroutines, keysEach, rounds = 8, 16, 50
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < keysEach; i++ {
+					k := fmt.Sprintf("g%d-%d", g, i)
+					n, _, _ := h.GetInt(k)
+					h.PutInt(k, n+1)
+				}
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				h.Len()
+				h.Range(func(string, string) bool { return true })
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := h.Len(); n != goroutines*keysEach {
+		t.Fatalf("Len() = %d, want %d", n, goroutines*keysEach)
+	}
+	h.Range(func(k, v string) bool {
+		if v != strconv.Itoa(rounds) {
+			t.Errorf("%s = %s, want %d", k, v, rounds)
+		}
+		return true
+	})
+}
+
+// benchmarkContended runs a mix of 90% reads and 10% writes of tiny values on a few keys from every goroutine.
+func benchmarkContended(b *testing.B, opts ...Option) {
+	h := New(opts...)
+	keys := testKeys(8)
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if i%10 == 0 {
+				h.Put(k, "v")
+			} else {
+				h.Get(k)
+			}
+			i++
+		}
+	})
+}
+
+func TestSpinLockConcurrent(t *testing.T) {
+	testConcurrentCounters(t, WithSpinLock())
+}
+
+func BenchmarkLockDefault(b *testing.B) {
+	benchmarkContended(b)
+}
+
+func BenchmarkLockSpin(b *testing.B) {
+	benchmarkContended(b, WithSpinLock())
+}
+
+func TestGetAndTouch(t *testing.T) {
+	h := New()
+	h.PutWithTTL("session", "data", 20*time.Millisecond)
+
+	v, ok := h.GetAndTouch("session", time.Hour)
+	if !ok || v != "data" {
+		t.Fatalf("GetAndTouch(session) = %q, %v, want data, true", v, ok)
+	}
+	if ttl, _ := h.TTL("session"); ttl < 59*time.Minute {
+		t.Fatalf("TTL after GetAndTouch = %v, want about an hour", ttl)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := h.Get("session"); !ok {
+		t.Fatal("record expired at its original TTL despite GetAndTouch")
+	}
+
+	if _, ok := h.GetAndTouch("absent", time.Hour); ok {
+		t.Fatal("GetAndTouch(absent) returned true")
+	}
+	h.PutWithTTL("expired", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := h.GetAndTouch("expired", time.Hour); ok {
+		t.Fatal("GetAndTouch revived an expired record")
+	}
+}
+
+// movedFraction returns the fraction of the keys whose shard changes when the number of shards goes from n to m.
+func movedFraction(h *HashTable, keys []string, n, m int) float64 {
+	var moved int
+	for _, k := range keys {
+		if h.index(k, n) != h.index(k, m) {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(keys))
+}
+
+func TestConsistentHashingMovesFewKeys(t *testing.T) {
+	keys := testKeys(10000)
+	consistent := New(WithConsistentHashing())
+	modulo := New()
+
+	if f := movedFraction(consistent, keys, 32, 33); f > 0.1 {
+		t.Errorf("consistent hashing moved %.0f%% of the keys from 32 to 33 shards, want about 3%%", 100*f)
+	}
+	if f := movedFraction(modulo, keys, 32, 33); f < 0.9 {
+		t.Errorf("modulo moved %.0f%% of the keys from 32 to 33 shards, want nearly all", 100*f)
+	}
+	// Doubling moves half of the keys whatever the scheme, since that is the minimum.
+	if f := movedFraction(consistent, keys, 32, 64); f < 0.45 || f > 0.55 {
+		t.Errorf("consistent hashing moved %.0f%% of the keys from 32 to 64 shards, want about 50%%", 100*f)
+	}
+}
+
+func TestConsistentHashingResize(t *testing.T) {
+	h := New(WithConsistentHashing())
+	keys := testKeys(10000)
+	before := make(map[string]int)
+	for _, k := range keys {
+		h.Put(k, k)
+		before[k] = h.ShardIndex(k)
+	}
+
+	h.Resize(2 * SHARD_COUNT)
+
+	var moved int
+	for _, k := range keys {
+		i := h.ShardIndex(k)
+		if i != before[k] {
+			moved++
+			if i < SHARD_COUNT {
+				t.Fatalf("key %q moved between old shards, from %d to %d", k, before[k], i)
+			}
+		}
+		if v, ok := h.Get(k); !ok || v != k {
+			t.Fatalf("Get(%q) = %q, %v after Resize", k, v, ok)
+		}
+	}
+	if f := float64(moved) / float64(len(keys)); f > 0.55 {
+		t.Fatalf("Resize moved %.0f%% of the keys, want about 50%%", 100*f)
+	}
+}
+
+func TestMGetGrouped(t *testing.T) {
+	h := New()
+	keys := testKeys(200)
+	for _, k := range keys[:100] {
+		h.Put(k, "v"+k)
+	}
+
+	grouped := h.MGetGrouped(keys)
+
+	var found int
+	for i, group := range grouped {
+		if len(group) == 0 {
+			t.Errorf("shard %d is present without any record", i)
+		}
+		for k, v := range group {
+			found++
+			if got := h.ShardIndex(k); got != i {
+				t.Errorf("key %q grouped under shard %d, ShardIndex says %d", k, i, got)
+			}
+			if v != "v"+k {
+				t.Errorf("key %q has value %q, want %q", k, v, "v"+k)
+			}
+		}
+	}
+	if found != 100 {
+		t.Fatalf("MGetGrouped found %d records, want 100", found)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	h := New()
+	want := map[string]string{
+		"plain":        "value",
+		"quote\"d":     "back\\slash",
+		"new\nline":    "<tag>&amp;",
+		"unicode é 世界": " ",
+		"":             "",
+	}
+	for k, v := range want {
+		h.Put(k, v)
+	}
+
+	var buf bytes.Buffer
+	if err := h.EncodeJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	if err := json.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatalf("EncodeJSON wrote invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %v, want %v", got, want)
+	}
+
+	// The same records marshaled as one map must decode to the same contents.
+	blob, err := json.Marshal(tableToMap(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromMarshal map[string]string
+	if err := json.Unmarshal(blob, &fromMarshal); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, fromMarshal) {
+		t.Fatalf("EncodeJSON decoded to %v, json.Marshal to %v", got, fromMarshal)
+	}
+}
+
+func TestEncodeJSONEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := New().EncodeJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "{}" {
+		t.Fatalf("EncodeJSON of an empty hashtable wrote %q, want {}", buf.String())
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestHashTableVStruct(t *testing.T) {
+	h := NewV[point]()
+
+	h.Put("a", point{1, 2})
+	if v, ok := h.Get("a"); !ok || v != (point{1, 2}) {
+		t.Fatalf("Get = %v, %v", v, ok)
+	}
+
+	h.Put("a", point{3, 4})
+	if v := h.GetOrZero("a"); v != (point{3, 4}) {
+		t.Fatalf("overwritten value is %v", v)
+	}
+	if h.PutIfNotExist("a", point{5, 6}) {
+		t.Fatal("PutIfNotExist replaced an existing record")
+	}
+	if h.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", h.Len())
+	}
+
+	if v, ok := h.Del("a"); !ok || v != (point{3, 4}) {
+		t.Fatalf("Del = %v, %v", v, ok)
+	}
+	if _, ok := h.Del("a"); ok {
+		t.Fatal("deleted a missing record")
+	}
+	if h.Has("a") {
+		t.Fatal("record still present after Del")
+	}
+	if v := h.GetOrZero("a"); v != (point{}) {
+		t.Fatalf("GetOrZero of a missing key = %v", v)
+	}
+	if _, err := h.MustGet("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("MustGet of a missing key returned %v", err)
+	}
+}
+
+func TestHashTableVSlice(t *testing.T) {
+	h := FromV(map[string][]int{"a": {1}, "b": {2, 3}})
+
+	if h.ShardIndex("a") != New().ShardIndex("a") {
+		t.Fatal("HashTableV shards keys differently from HashTable")
+	}
+
+	h.Put("a", []int{4, 5, 6})
+	if v, _ := h.Get("a"); !reflect.DeepEqual(v, []int{4, 5, 6}) {
+		t.Fatalf("overwritten value is %v", v)
+	}
+	if v, ok := h.Del("b"); !ok || !reflect.DeepEqual(v, []int{2, 3}) {
+		t.Fatalf("Del = %v, %v", v, ok)
+	}
+
+	h.Clear()
+	if h.Len() != 0 {
+		t.Fatalf("Len after Clear = %d", h.Len())
+	}
+}
+
+func TestPutAllIfNoneExist(t *testing.T) {
+	h := New()
+	data := map[string]string{"a": "1", "b": "2", "c": "3"}
+
+	if !h.PutAllIfNoneExist(data) {
+		t.Fatal("PutAllIfNoneExist refused absent keys")
+	}
+	if got := tableToMap(h); !reflect.DeepEqual(got, data) {
+		t.Fatalf("hashtable holds %v, want %v", got, data)
+	}
+
+	before := tableToMap(h)
+	if h.PutAllIfNoneExist(map[string]string{"c": "x", "d": "4", "e": "5"}) {
+		t.Fatal("PutAllIfNoneExist applied writes although a key existed")
+	}
+	if got := tableToMap(h); !reflect.DeepEqual(got, before) {
+		t.Fatalf("refused PutAllIfNoneExist changed the hashtable to %v", got)
+	}
+}
+
+func TestPutAllIfNoneExistConcurrent(t *testing.T) {
+	h := New()
+	low, high := keysInShards(h)
+
+	var wg sync.WaitGroup
+	var wins int32
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if h.PutAllIfNoneExist(map[string]string{low: "a", high: "a"}) {
+					atomic.AddInt32(&wins, 1)
+					h.DelMany([]string{high, low})
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if h.PutAllIfNoneExist(map[string]string{high: "b", low: "b"}) {
+					atomic.AddInt32(&wins, 1)
+					h.DelMany([]string{low, high})
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("PutAllIfNoneExist deadlocked with keys given in opposite orders")
+	}
+	if wins == 0 {
+		t.Fatal("no PutAllIfNoneExist ever succeeded")
+	}
+}
+
+func TestReadPreferringConcurrent(t *testing.T) {
+	testConcurrentCounters(t, WithLockPolicy(ReadPreferring))
+}
+
+func TestReadPreferringLetsReadersPastWaitingWriter(t *testing.T) {
+	l := newReadPreferringLock()
+	l.RLock()
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+		l.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	read := make(chan struct{})
+	go func() {
+		l.RLock()
+		close(read)
+		l.RUnlock()
+	}()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("a reader waited behind a waiting writer")
+	}
+
+	l.RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the writer never got the lock once the readers left")
+	}
+}
+
+// benchmarkLatency runs a skewed mix of 95% reads and 5% writes on a few keys and reports the 50th and 99th percentile latencies of each kind of operation.
+func benchmarkLatency(b *testing.B, opts ...Option) {
+	h := New(opts...)
+	keys := testKeys(4)
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+
+	var mu sync.Mutex
+	var reads, writes []time.Duration
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var r, w []time.Duration
+		var i int
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			start := time.Now()
+			if i%20 == 0 {
+				h.Put(k, "v")
+				w = append(w, time.Since(start))
+			} else {
+				h.Get(k)
+				r = append(r, time.Since(start))
+			}
+			i++
+		}
+		mu.Lock()
+		reads = append(reads, r...)
+		writes = append(writes, w...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	report := func(name string, d []time.Duration) {
+		if len(d) == 0 {
+			return
+		}
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		b.ReportMetric(float64(d[len(d)/2]), name+"-p50-ns")
+		b.ReportMetric(float64(d[len(d)*99/100]), name+"-p99-ns")
+	}
+	report("read", reads)
+	report("write", writes)
+}
+
+func BenchmarkLatencyWritePreferring(b *testing.B) {
+	benchmarkLatency(b, WithLockPolicy(WritePreferring))
+}
+
+func BenchmarkLatencyReadPreferring(b *testing.B) {
+	benchmarkLatency(b, WithLockPolicy(ReadPreferring))
+}
+
+func TestAutoShrink(t *testing.T) {
+	h := New(WithShardCount(1), WithAutoShrink(1))
+	keys := testKeys(100)
+	for _, k := range keys {
+		h.Put(k, "v"+k)
+	}
+
+	// The 51st deletion leaves more deleted records than live ones.
+	for _, k := range keys[:50] {
+		h.Del(k)
+	}
+	if d := h.shards()[0].deleted; d != 50 {
+		t.Fatalf("shard counts %d deletions before it is due, want 50", d)
+	}
+	h.Del(keys[50])
+	if d := h.shards()[0].deleted; d != 0 {
+		t.Fatalf("shard wasn't compacted, it counts %d deletions", d)
+	}
+
+	for i, k := range keys {
+		v, ok := h.Get(k)
+		if i <= 50 && ok {
+			t.Fatalf("deleted key %q came back after the compaction", k)
+		}
+		if i > 50 && (!ok || v != "v"+k) {
+			t.Fatalf("Get(%q) = %q, %v after the compaction", k, v, ok)
+		}
+	}
+	if h.Len() != 49 {
+		t.Fatalf("Len = %d, want 49", h.Len())
+	}
+}
+
+func TestAutoShrinkDisabled(t *testing.T) {
+	h := New(WithShardCount(1))
+	for _, k := range testKeys(10) {
+		h.Put(k, "v")
+		h.Del(k)
+	}
+	if d := h.shards()[0].deleted; d != 10 {
+		t.Fatalf("shard counts %d deletions, want 10 without WithAutoShrink", d)
+	}
+}
+
+func TestDumpRestoreSameShardCount(t *testing.T) {
+	h := New(WithShardCount(16))
+	for _, k := range testKeys(500) {
+		h.Put(k, "v"+k)
+	}
+
+	var buf bytes.Buffer
+	if err := h.DumpTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(restored.shards()); n != 16 {
+		t.Fatalf("restored hashtable has %d shards, want 16", n)
+	}
+	if got, want := tableToMap(restored), tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %d records, want %d", len(got), len(want))
+	}
+	for i, s := range h.shards() {
+		if got, want := restored.shards()[i].Data.Len(), s.Data.Len(); got != want {
+			t.Fatalf("restored shard %d holds %d records, want %d", i, got, want)
+		}
+	}
+}
+
+func TestDumpRestoreRehashes(t *testing.T) {
+	h := New(WithShardCount(16))
+	for _, k := range testKeys(500) {
+		h.Put(k, "v"+k)
+	}
+
+	var buf bytes.Buffer
+	if err := h.DumpTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreFrom(&buf, WithShardCount(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(restored.shards()); n != 4 {
+		t.Fatalf("restored hashtable has %d shards, want 4", n)
+	}
+	for k, v := range tableToMap(h) {
+		if got, ok := restored.Get(k); !ok || got != v {
+			t.Fatalf("Get(%q) = %q, %v after the rehashing restore", k, got, ok)
+		}
+		if i := restored.ShardIndex(k); restored.shards()[i].Data.Len() == 0 {
+			t.Fatalf("key %q isn't in shard %d", k, i)
+		}
+	}
+	if restored.Len() != h.Len() {
+		t.Fatalf("Len = %d, want %d", restored.Len(), h.Len())
+	}
+}
+
+func TestRestoreFromInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	New(WithShardCount(2)).DumpTo(&valid)
+
+	tests := map[string][]byte{
+		"empty":          {},
+		"no shards":      {0},
+		"too many":       {0xff, 0xff, 0xff, 0xff, 0x0f},
+		"huge block":     {1, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x40},
+		"oversized":      {1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"short block":    {1, 5, 1, 'a'},
+		"missing block":  valid.Bytes()[:len(valid.Bytes())-1],
+		"truncated pair": {1, 2, 1, 'a'},
+	}
+	for name, data := range tests {
+		if _, err := RestoreFrom(bytes.NewReader(data)); !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("%s: RestoreFrom returned %v, want ErrInvalidEncoding", name, err)
+		}
+	}
+}
+
+func TestApproxLen(t *testing.T) {
+	h := New()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprintf("%d-%d", g, i)
+				h.Put(k, "v")
+				h.Put(k, "overwritten")
+				if i%4 == 0 {
+					h.Del(k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got, want := h.ApproxLen(), h.Len(); got != want {
+		t.Fatalf("ApproxLen = %d once writes settled, Len = %d", got, want)
+	}
+
+	h.Clear()
+	if got := h.ApproxLen(); got != 0 {
+		t.Fatalf("ApproxLen = %d after Clear", got)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	check := func(name string, err, target error) {
+		t.Helper()
+		if !errors.Is(err, target) {
+			t.Errorf("%s returned %v, want an error wrapping %v", name, err, target)
+		}
+	}
+
+	h := New(WithMaxKeyLen(4), WithMaxValueLen(4))
+	h.Put("nan", "x")
+
+	_, err := h.MustGet("missing")
+	check("MustGet", err, ErrKeyNotFound)
+	_, err = NewV[int]().MustGet("missing")
+	check("HashTableV.MustGet", err, ErrKeyNotFound)
+	_, _, err = h.GetInt("nan")
+	check("GetInt", err, ErrNotInteger)
+	_, err = h.SumInt()
+	check("SumInt", err, ErrNotInteger)
+	check("TryPut with a long key", h.TryPut("longkey", "v"), ErrKeyTooLong)
+	check("TryPut with a long value", h.TryPut("k", "longvalue"), ErrValueTooLong)
+
+	_, err = UnmarshalProto([]byte{0x0a, 0x05})
+	check("UnmarshalProto", err, ErrInvalidEncoding)
+	_, err = RestoreFrom(bytes.NewReader(nil))
+	check("RestoreFrom", err, ErrInvalidEncoding)
+
+	full := New(WithMaxSize(1))
+	low, high := keysInShards(full)
+	full.Put(low, "v")
+	check("TryPut at capacity", full.TryPut(high, "v"), ErrCapacity)
+
+	closed := New()
+	closed.Close()
+	check("TryPut after Close", closed.TryPut("k", "v"), ErrClosed)
+
+	leaky := New(WithLockLeakDetection())
+	leaky.LockKey("k")
+	check("CheckNoLeaks", leaky.CheckNoLeaks(), ErrLockLeak)
+	_, err = leaky.LockKeyTimeout("k", time.Millisecond)
+	check("LockKeyTimeout", err, ErrLockTimeout)
+
+	check("Insert of an existing key", h.Insert("nan", "y"), ErrOverwriteDenied)
+
+	corrupted := New()
+	corrupted.Put("k", "v")
+	atomic.AddInt64(&corrupted.size, 1)
+	check("SelfCheck", corrupted.SelfCheck(), ErrCorrupted)
+}
+
+func TestLockKeyTimeout(t *testing.T) {
+	h := New(WithLockLeakDetection())
+
+	unlock, err := h.LockKeyTimeout("k", time.Second)
+	if err != nil {
+		t.Fatalf("LockKeyTimeout of a free key = %v", err)
+	}
+
+	start := time.Now()
+	again, err := h.LockKeyTimeout("k", 20*time.Millisecond)
+	if !errors.Is(err, ErrLockTimeout) || again != nil {
+		t.Fatalf("LockKeyTimeout of a held key = %v, want ErrLockTimeout and no unlock", err)
+	}
+	if !strings.Contains(err.Error(), `"k"`) {
+		t.Fatalf("error %q doesn't mention the key", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("gave up after %v, before the timeout", elapsed)
+	}
+
+	unlock()
+	if err := h.CheckNoLeaks(); err != nil {
+		t.Fatalf("timed out attempt left a lock behind: %v", err)
+	}
+	if n := len(h.keyLocks.locks); n != 0 {
+		t.Fatalf("%d key locks kept after every lock was released", n)
+	}
+
+	unlock, err = h.LockKeyTimeout("k", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("LockKeyTimeout after unlocking = %v", err)
+	}
+	unlock()
+	finishes(t, "Resize after a timed out LockKeyTimeout", func() { h.Resize(64) })
+}
+
+func TestInsert(t *testing.T) {
+	h := New(WithMaxValueLen(4))
+
+	if err := h.Insert("k", "v"); err != nil {
+		t.Fatalf("Insert of a new key = %v", err)
+	}
+	err := h.Insert("k", "w")
+	if !errors.Is(err, ErrOverwriteDenied) || !strings.Contains(err.Error(), `"k"`) {
+		t.Fatalf("Insert of an existing key = %v, want ErrOverwriteDenied naming the key", err)
+	}
+	if v, _ := h.Get("k"); v != "v" {
+		t.Fatalf("Insert overwrote the value with %q", v)
+	}
+	if err := h.Insert("other", "toolong"); !errors.Is(err, ErrValueTooLong) {
+		t.Fatalf("Insert of a long value = %v, want ErrValueTooLong", err)
+	}
+}
+
+func TestPresenceMask(t *testing.T) {
+	h := New()
+	h.Put("a", "1")
+	h.Put("c", "")
+
+	keys := []string{"a", "b", "c", "a", "b", "d", ""}
+	want := []bool{true, false, true, true, false, false, false}
+	if got := h.PresenceMask(keys); !reflect.DeepEqual(got, want) {
+		t.Fatalf("PresenceMask(%q) = %v, want %v", keys, got, want)
+	}
+	if got := h.PresenceMask(nil); len(got) != 0 {
+		t.Fatalf("PresenceMask(nil) = %v", got)
+	}
+}
+
+func TestSubscribeAll(t *testing.T) {
+	h := New()
+	events, cancel := h.SubscribeAll(16)
+	defer cancel()
+
+	h.Put("k", "v1")
+	h.Put("k", "v2")
+	h.Del("k")
+
+	want := []Event{
+		{Op: OpPut, Key: "k", NewValue: "v1"},
+		{Op: OpPut, Key: "k", OldValue: "v1", NewValue: "v2"},
+		{Op: OpDel, Key: "k", OldValue: "v2"},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Fatalf("received %+v, want %+v", e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event received, want %+v", w)
+		}
+	}
+}
+
+func TestSubscribeAllSlowSubscriber(t *testing.T) {
+	h := New()
+	_, cancel := h.SubscribeAll(1)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			h.Put("k", strconv.Itoa(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a subscriber that doesn't read blocked the writers")
+	}
+	if got := h.DroppedEvents(); got != 99 {
+		t.Fatalf("DroppedEvents = %d, want 99", got)
+	}
+}
+
+func TestSubscribeAllCancel(t *testing.T) {
+	h := New()
+	events, cancel := h.SubscribeAll(4)
+	cancel()
+	cancel()
+
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after cancel")
+	}
+	if n := atomic.LoadInt32(&h.subs.count); n != 0 {
+		t.Fatalf("%d subscribers left after cancel", n)
+	}
+	h.Put("k", "v")
+
+	closing := New()
+	events, _ = closing.SubscribeAll(4)
+	closing.Close()
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after Close")
+	}
+}
+
+// testMethodSuite exercises the methods of a hashtable created with the given options, so that it can be run against every ShardStore.
+func testMethodSuite(t *testing.T, opts ...Option) {
+	newTable := func() *HashTable { return New(opts...) }
+
+	t.Run("PutGetDel", func(t *testing.T) {
+		h := newTable()
+		h.Put("k", "v1")
+		h.Put("k", "v2")
+		if v, ok := h.Get("k"); !ok || v != "v2" {
+			t.Fatalf("Get = %q, %v", v, ok)
+		}
+		if !h.Has("k") || h.Len() != 1 {
+			t.Fatalf("Has = %v, Len = %d", h.Has("k"), h.Len())
+		}
+		if v, ok := h.Del("k"); !ok || v != "v2" {
+			t.Fatalf("Del = %q, %v", v, ok)
+		}
+		if _, ok := h.Del("k"); ok || h.Has("k") || h.Len() != 0 {
+			t.Fatal("record still present after Del")
+		}
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		h := newTable()
+		if !h.PutIfNotExist("k", "v") || h.PutIfNotExist("k", "w") {
+			t.Fatal("PutIfNotExist didn't add only the absent key")
+		}
+		if cur, ok := h.CompareAndSwapReturning("k", "x", "y"); ok || cur != "v" {
+			t.Fatalf("failed CompareAndSwapReturning = %q, %v", cur, ok)
+		}
+		if cur, ok := h.CompareAndSwapReturning("k", "v", "y"); !ok || cur != "y" {
+			t.Fatalf("CompareAndSwapReturning = %q, %v", cur, ok)
+		}
+		if h.DeleteIf("k", func(v string) bool { return v == "x" }) || !h.DeleteIf("k", func(v string) bool { return v == "y" }) {
+			t.Fatal("DeleteIf didn't follow its predicate")
+		}
+	})
+
+	t.Run("Bulk", func(t *testing.T) {
+		h := newTable()
+		data := make(map[string]string)
+		for _, k := range testKeys(300) {
+			data[k] = "v" + k
+		}
+		if err := h.PutAll(data); err != nil {
+			t.Fatal(err)
+		}
+		keys := testKeys(400)
+		if got := h.MGet(keys); !reflect.DeepEqual(got, data) {
+			t.Fatalf("MGet found %d records, want %d", len(got), len(data))
+		}
+		if !h.HasAll(keys[:300]) || h.HasAll(keys) || !h.HasAny(keys[250:]) {
+			t.Fatal("HasAll or HasAny is wrong")
+		}
+		if got := h.DelMany(keys[:100]); len(got) != 100 {
+			t.Fatalf("DelMany deleted %d records, want 100", len(got))
+		}
+		if h.Len() != 200 {
+			t.Fatalf("Len = %d, want 200", h.Len())
+		}
+	})
+
+	t.Run("Iteration", func(t *testing.T) {
+		h := newTable()
+		want := make(map[string]string)
+		for _, k := range testKeys(200) {
+			h.Put(k, "v"+k)
+			want[k] = "v" + k
+		}
+
+		if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Range visited %d records, want %d", len(got), len(want))
+		}
+
+		var sorted []string
+		h.RangeSorted(func(k, _ string) bool {
+			sorted = append(sorted, k)
+			return true
+		})
+		if len(sorted) != 200 || !sort.StringsAreSorted(sorted) {
+			t.Fatalf("RangeSorted visited %d keys, sorted: %v", len(sorted), sort.StringsAreSorted(sorted))
+		}
+
+		it := h.Iterator()
+		var n int
+		for it.Next() {
+			if want[it.Key()] != it.Value() {
+				t.Fatalf("Iterator returned %q=%q", it.Key(), it.Value())
+			}
+			n++
+		}
+		it.Close()
+		if n != 200 {
+			t.Fatalf("Iterator visited %d records, want 200", n)
+		}
+
+		// Deleting the visited record during Range must not skip any other.
+		var visited int
+		h.Range(func(k, _ string) bool {
+			visited++
+			h.Del(k)
+			return true
+		})
+		if visited != 200 || h.Len() != 0 {
+			t.Fatalf("deleting during Range visited %d records and left %d", visited, h.Len())
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		h := newTable()
+		h.PutWithTTL("short", "v", time.Nanosecond)
+		h.PutWithTTL("long", "v", time.Hour)
+		time.Sleep(time.Millisecond)
+		if _, ok := h.Get("short"); ok {
+			t.Fatal("expired record still readable")
+		}
+		if n := h.DeleteExpired(); n != 1 {
+			t.Fatalf("DeleteExpired removed %d records, want 1", n)
+		}
+		if ttl, ok := h.TTL("long"); !ok || ttl <= 0 {
+			t.Fatalf("TTL = %v, %v", ttl, ok)
+		}
+	})
+
+	t.Run("Maintenance", func(t *testing.T) {
+		h := newTable()
+		for _, k := range testKeys(500) {
+			h.Put(k, "v"+k)
+		}
+		for _, k := range testKeys(250) {
+			h.Del(k)
+		}
+		want := tableToMap(h)
+
+		h.Shrink()
+		h.Resize(2 * SHARD_COUNT)
+		if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+			t.Fatalf("hashtable holds %d records after Shrink and Resize, want %d", len(got), len(want))
+		}
+		if err := h.SelfCheck(); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := h.DumpTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreFrom(&buf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tableToMap(restored); !reflect.DeepEqual(got, want) {
+			t.Fatalf("restored %d records, want %d", len(got), len(want))
+		}
+
+		h.Clear()
+		if h.Len() != 0 || h.ApproxLen() != 0 {
+			t.Fatalf("Len = %d after Clear", h.Len())
+		}
+	})
+}
+
+func TestMapStore(t *testing.T) {
+	testMethodSuite(t)
+}
+
+func TestSliceStore(t *testing.T) {
+	testMethodSuite(t, WithShardStore(NewSliceStore))
+}
+
+func TestSliceStoreOrder(t *testing.T) {
+	s := NewSliceStore()
+	for _, k := range []string{"c", "a", "b", "a"} {
+		s.Set(k, "v"+k)
+	}
+	s.Delete("b")
+	s.Delete("missing")
+
+	var keys []string
+	s.Range(func(k, _ string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if want := []string{"c", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Range visited %q, want %q", keys, want)
+	}
+	if v, ok := s.Get("a"); !ok || v != "va" || s.Len() != 2 {
+		t.Fatalf("Get = %q, %v with Len %d", v, ok, s.Len())
+	}
+}
+
+func TestNumericAggregates(t *testing.T) {
+	h := New()
+	for k, v := range map[string]int64{"a": 3, "b": -7, "c": 42, "d": 0} {
+		h.PutInt(k, v)
+	}
+
+	if sum, err := h.SumInt(); err != nil || sum != 38 {
+		t.Fatalf("SumInt = %d, %v, want 38", sum, err)
+	}
+	if k, v, ok := h.MaxInt(); !ok || k != "c" || v != 42 {
+		t.Fatalf("MaxInt = %q, %d, %v", k, v, ok)
+	}
+	if n, err := h.GetOrDefaultInt("b", 5); err != nil || n != -7 {
+		t.Fatalf("GetOrDefaultInt of a present key = %d, %v", n, err)
+	}
+	if n, err := h.GetOrDefaultInt("missing", 5); err != nil || n != 5 {
+		t.Fatalf("GetOrDefaultInt of a missing key = %d, %v", n, err)
+	}
+
+	h.Put("e", "not a number")
+	if _, err := h.SumInt(); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("SumInt with a non-numeric value returned %v", err)
+	}
+	if k, v, ok := h.MaxInt(); !ok || k != "c" || v != 42 {
+		t.Fatalf("MaxInt didn't skip the non-numeric value: %q, %d, %v", k, v, ok)
+	}
+	if _, err := h.GetOrDefaultInt("e", 5); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("GetOrDefaultInt of a non-numeric value returned %v", err)
+	}
+}
+
+func TestNumericAggregatesEmpty(t *testing.T) {
+	h := New()
+	if sum, err := h.SumInt(); err != nil || sum != 0 {
+		t.Fatalf("SumInt of an empty hashtable = %d, %v", sum, err)
+	}
+	if _, _, ok := h.MaxInt(); ok {
+		t.Fatal("MaxInt of an empty hashtable reported a value")
+	}
+}
+
+func TestCompareAndSwapReturning(t *testing.T) {
+	h := New()
+	h.Put("k", "old")
+
+	if cur, swapped := h.CompareAndSwapReturning("k", "old", "new"); !swapped || cur != "new" {
+		t.Fatalf("successful swap returned %q, %v", cur, swapped)
+	}
+	if cur, swapped := h.CompareAndSwapReturning("k", "old", "other"); swapped || cur != "new" {
+		t.Fatalf("failed swap returned %q, %v", cur, swapped)
+	}
+	if v, _ := h.Get("k"); v != "new" {
+		t.Fatalf("failed swap changed the value to %q", v)
+	}
+	if cur, swapped := h.CompareAndSwapReturning("missing", "", "v"); swapped || cur != "" {
+		t.Fatalf("swap of an absent key returned %q, %v", cur, swapped)
+	}
+	if h.Has("missing") {
+		t.Fatal("swap of an absent key created it")
+	}
+}
+
+func TestResizeConcurrent(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(5000) {
+		h.Put(k, k)
+	}
+
+	const writers = 4
+	var written [writers]int64
+	stop := make(chan struct{})
+	errs := make(chan error, 2*writers)
+	var wg sync.WaitGroup
+
+	for g := 0; g < writers; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := fmt.Sprintf("w%d-%d", g, i)
+				h.Put(k, k)
+				if v, ok := h.Get(k); !ok || v != k {
+					errs <- fmt.Errorf("Get(%q) = %q, %v right after Put", k, v, ok)
+					return
+				}
+				atomic.StoreInt64(&written[g], int64(i+1))
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; ; r++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := fmt.Sprintf("key%d", r%5000)
+				if v, ok := h.Get(k); !ok || v != k {
+					errs <- fmt.Errorf("Get(%q) = %q, %v during a resize", k, v, ok)
+					return
+				}
+				if n := atomic.LoadInt64(&written[g]); n > 0 {
+					k := fmt.Sprintf("w%d-%d", g, r%int(n))
+					if !h.Has(k) {
+						errs <- fmt.Errorf("written key %q missing during a resize", k)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+
+	for _, n := range []int{64, 128, 256, 16, 32} {
+		h.Resize(n)
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for g := 0; g < writers; g++ {
+		for i := 0; i < int(written[g]); i++ {
+			if k := fmt.Sprintf("w%d-%d", g, i); !h.Has(k) {
+				t.Fatalf("written key %q lost by the resizes", k)
+			}
+		}
+	}
+	for _, k := range testKeys(5000) {
+		if !h.Has(k) {
+			t.Fatalf("key %q lost by the resizes", k)
+		}
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	h := New()
+	h.PutWithTTL("ttl", "v", time.Hour)
+	h.Put("forever", "v")
+	h.PutWithTTL("expired", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if d, ok := h.TTL("ttl"); !ok || d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("TTL of a record with a TTL = %v, %v", d, ok)
+	}
+	if d, ok := h.TTL("forever"); !ok || d != NoTTL {
+		t.Errorf("TTL of a record without a TTL = %v, %v, want NoTTL", d, ok)
+	}
+	if d, ok := h.TTL("expired"); ok || d != 0 {
+		t.Errorf("TTL of an expired record = %v, %v", d, ok)
+	}
+	if d, ok := h.TTL("missing"); ok || d != 0 {
+		t.Errorf("TTL of a missing record = %v, %v", d, ok)
+	}
+}
+
+func TestBatchedEventsSize(t *testing.T) {
+	h := New(WithBatchedEvents(3, time.Hour))
+	batches, cancel := h.SubscribeBatches(4)
+	defer cancel()
+
+	for i := 0; i < 7; i++ {
+		h.Put(strconv.Itoa(i), "v")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-batches:
+			if len(b) != 3 {
+				t.Fatalf("batch %d holds %d events, want 3", i, len(b))
+			}
+			for j, e := range b {
+				if want := strconv.Itoa(3*i + j); e.Key != want {
+					t.Fatalf("batch %d event %d is for key %q, want %q", i, j, e.Key, want)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("full batch %d not delivered", i)
+		}
+	}
+	select {
+	case b := <-batches:
+		t.Fatalf("partial batch %v delivered before its delay", b)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBatchedEventsDelay(t *testing.T) {
+	h := New(WithBatchedEvents(100, 10*time.Millisecond))
+	batches, cancel := h.SubscribeBatches(4)
+	defer cancel()
+
+	start := time.Now()
+	h.Put("a", "1")
+	h.Put("b", "2")
+	select {
+	case b := <-batches:
+		if len(b) != 2 {
+			t.Fatalf("batch holds %d events, want 2", len(b))
+		}
+		if d := time.Since(start); d < 10*time.Millisecond {
+			t.Fatalf("partial batch flushed after %v, before its delay", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial batch never flushed")
+	}
+}
+
+func TestBatchedEventsClose(t *testing.T) {
+	h := New(WithBatchedEvents(100, time.Hour))
+	batches, _ := h.SubscribeBatches(4)
+
+	h.Put("a", "1")
+	h.Put("b", "2")
+	h.Close()
+
+	var got []Event
+	for b := range batches {
+		got = append(got, b...)
+	}
+	if len(got) != 2 {
+		t.Fatalf("received %d events after Close, want the 2 pending ones", len(got))
+	}
+}
+
+func TestNewLike(t *testing.T) {
+	h := New(WithShardCount(8), WithHashSeed(42), WithConsistentHashing())
+	h.Put("k", "v")
+	like := h.NewLike()
+
+	if got, want := len(like.shards()), len(h.shards()); got != want {
+		t.Fatalf("NewLike has %d shards, want %d", got, want)
+	}
+	if like.Len() != 0 {
+		t.Fatalf("NewLike isn't empty, Len = %d", like.Len())
+	}
+	for _, k := range testKeys(1000) {
+		if got, want := like.ShardIndex(k), h.ShardIndex(k); got != want {
+			t.Fatalf("key %q lands in shard %d of NewLike, %d of the original", k, got, want)
+		}
+	}
+
+	resized := New()
+	resized.Resize(128)
+	if n := len(resized.NewLike().shards()); n != 128 {
+		t.Fatalf("NewLike of a resized hashtable has %d shards, want 128", n)
+	}
+}
+
+func TestPutGetBytes(t *testing.T) {
+	h := New()
+	in := []byte{0, 1, 2, 0xff}
+	h.PutBytes("k", in)
+	in[0] = 9
+
+	out, ok := h.GetBytes("k")
+	if !ok || !bytes.Equal(out, []byte{0, 1, 2, 0xff}) {
+		t.Fatalf("GetBytes = %v, %v after mutating the input", out, ok)
+	}
+	out[1] = 9
+
+	again, _ := h.GetBytes("k")
+	if !bytes.Equal(again, []byte{0, 1, 2, 0xff}) {
+		t.Fatalf("GetBytes = %v after mutating a previous result", again)
+	}
+	if v, _ := h.Get("k"); v != "\x00\x01\x02\xff" {
+		t.Fatalf("Get = %q, want the same bytes as a string", v)
+	}
+	if _, ok := h.GetBytes("missing"); ok {
+		t.Fatal("GetBytes found a missing key")
+	}
+}
+
+func TestWaitForPresent(t *testing.T) {
+	h := New()
+	h.Put("k", "v")
+	if v, err := h.WaitFor(context.Background(), "k"); err != nil || v != "v" {
+		t.Fatalf("WaitFor = %q, %v", v, err)
+	}
+}
+
+func TestWaitForAppearsLater(t *testing.T) {
+	h := New()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		h.Put("other", "x")
+		h.Put("k", "v")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if v, err := h.WaitFor(ctx, "k"); err != nil || v != "v" {
+		t.Fatalf("WaitFor = %q, %v", v, err)
+	}
+}
+
+func TestWaitForCancel(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err := h.WaitFor(ctx, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitFor returned %v, want context.Canceled", err)
+	}
+	if n := len(h.waiters.keys["k"]); n != 0 {
+		t.Fatalf("%d waiters left after the context was cancelled", n)
+	}
+}
+
+// mustPanic calls f and fails the test unless it panics.
+func mustPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		if recover() == nil {
+			t.Fatalf("%s didn't panic", name)
+		}
+	}()
+	f()
+}
+
+// checkUnlocked fails the test if writing to any shard of the hashtable blocks, i.e. if a lock was left held.
+func checkUnlocked(t *testing.T, h *HashTable) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		for _, k := range testKeys(20 * SHARD_COUNT) {
+			h.Put(k, "v")
+			h.Get(k)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a shard lock was left held")
+	}
+}
+
+func TestCallbackPanicReleasesLocks(t *testing.T) {
+	h := New()
+	h.Put("k", "v")
+
+	mustPanic(t, "Range", func() {
+		h.Range(func(string, string) bool { panic("boom") })
+	})
+	checkUnlocked(t, h)
+
+	mustPanic(t, "GetOrComputeUnlocked", func() {
+		h.GetOrComputeUnlocked("missing", func() string { panic("boom") })
+	})
+	checkUnlocked(t, h)
+
+	mustPanic(t, "GetOrComputeBytes", func() {
+		h.GetOrComputeBytes("missing", func() ([]byte, error) { panic("boom") })
+	})
+	checkUnlocked(t, h)
+
+	mustPanic(t, "DeleteIf", func() {
+		h.DeleteIf("k", func(string) bool { panic("boom") })
+	})
+	checkUnlocked(t, h)
+
+	if v, ok := h.Get("k"); !ok || v != "v" {
+		t.Fatalf("Get = %q, %v after the panics", v, ok)
+	}
+}
+
+func TestCallbackPanicHandler(t *testing.T) {
+	var recovered []interface{}
+	h := New(
+		WithCallbackPanicHandler(func(r interface{}) { recovered = append(recovered, r) }),
+		WithOnEvict(func(string, string, EvictReason) { panic("evict") }),
+	)
+
+	h.Put("k", "v")
+	h.Del("k")
+	checkUnlocked(t, h)
+
+	if len(recovered) == 0 || recovered[0] != "evict" {
+		t.Fatalf("handler recovered %v, want the panic of the eviction callback", recovered)
+	}
+
+	// Without a handler, the panic reaches the caller once the lock is released.
+	plain := New(WithOnEvict(func(string, string, EvictReason) { panic("evict") }))
+	plain.Put("k", "v")
+	mustPanic(t, "Del", func() { plain.Del("k") })
+	checkUnlocked(t, plain)
+}
+
+func TestByteAccountingConcurrent(t *testing.T) {
+	h := New(WithByteAccounting())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				k := strconv.Itoa(r.Intn(300))
+				switch r.Intn(4) {
+				case 0:
+					h.Del(k)
+				case 1:
+					h.PutAll(map[string]string{k: strings.Repeat("y", r.Intn(20)), k + "x": "z"})
+				default:
+					h.Put(k, strings.Repeat("x", r.Intn(50)))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var want int64
+	h.Range(func(k, v string) bool {
+		want += int64(len(k) + len(v))
+		return true
+	})
+	if got := h.Bytes(); got != want {
+		t.Fatalf("Bytes = %d, the records hold %d bytes", got, want)
+	}
+	if New().Bytes() != 0 {
+		t.Fatal("Bytes is maintained without WithByteAccounting")
+	}
+}
+
+func TestBenchmarkHarness(t *testing.T) {
+	cfg := BenchConfig{
+		Goroutines: 4,
+		Duration:   50 * time.Millisecond,
+		Keys:       256,
+		ValueSize:  16,
+		Reads:      8,
+		Writes:     1,
+		Deletes:    1,
+		Seed:       1,
+	}
+	short := Benchmark(cfg)
+
+	if short.Ops <= 0 || short.Throughput <= 0 {
+		t.Fatalf("Benchmark did nothing: %+v", short)
+	}
+	if short.Elapsed < cfg.Duration {
+		t.Fatalf("Benchmark ran for %v, less than %v", short.Elapsed, cfg.Duration)
+	}
+	if got := float64(short.Ops) / short.Elapsed.Seconds(); math.Abs(got-short.Throughput) > 0.01*got {
+		t.Fatalf("Throughput = %.0f, but %d ops in %v make %.0f", short.Throughput, short.Ops, short.Elapsed, got)
+	}
+	if !(0 < short.P50 && short.P50 <= short.P90 && short.P90 <= short.P99 && short.P99 <= short.Max) {
+		t.Fatalf("percentiles are out of order: %+v", short)
+	}
+
+	cfg.Duration = 4 * cfg.Duration
+	if long := Benchmark(cfg); long.Ops <= short.Ops {
+		t.Fatalf("a run 4 times longer did %d ops, not more than %d", long.Ops, short.Ops)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	h := New(WithMaxKeyLen(4), WithMaxValueLen(8))
+
+	if err := h.TryPut("toolong", "v"); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("TryPut with an oversized key returned %v", err)
+	}
+	if err := h.TryPut("k", "far too long"); !errors.Is(err, ErrValueTooLong) {
+		t.Fatalf("TryPut with an oversized value returned %v", err)
+	}
+	h.Put("toolong", "v")
+	if h.Len() != 0 {
+		t.Fatalf("oversized records were stored, Len = %d", h.Len())
+	}
+
+	if err := h.TryPut("four", "eight ch"); err != nil {
+		t.Fatalf("TryPut at the limits returned %v", err)
+	}
+
+	err := h.PutAll(map[string]string{"a": "1", "b": "2", "c": "far too long"})
+	if !errors.Is(err, ErrValueTooLong) {
+		t.Fatalf("PutAll with an oversized value returned %v", err)
+	}
+	if h.Has("a") || h.Has("b") || h.Len() != 1 {
+		t.Fatal("a rejected PutAll applied some of its records")
+	}
+
+	unlimited := New()
+	if err := unlimited.TryPut(strings.Repeat("k", 1<<16), strings.Repeat("v", 1<<20)); err != nil {
+		t.Fatalf("TryPut without limits returned %v", err)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	h := New()
+	h.Put("k", "v")
+
+	if h.DeleteIf("k", func(v string) bool { return v == "other" }) {
+		t.Fatal("DeleteIf deleted although the predicate was false")
+	}
+	if !h.Has("k") {
+		t.Fatal("a false predicate removed the record")
+	}
+	if !h.DeleteIf("k", func(v string) bool { return v == "v" }) {
+		t.Fatal("DeleteIf didn't delete although the predicate was true")
+	}
+	if h.Has("k") {
+		t.Fatal("record still present after DeleteIf")
+	}
+
+	called := false
+	if h.DeleteIf("missing", func(string) bool { called = true; return true }) {
+		t.Fatal("DeleteIf deleted a missing key")
+	}
+	if called {
+		t.Fatal("DeleteIf called the predicate for a missing key")
+	}
+}
+
+func TestMove(t *testing.T) {
+	src, dst := New(), New()
+	src.PutWithTTL("k", "v", time.Hour)
+	dst.Put("k", "old")
+
+	if !Move(src, dst, "k") {
+		t.Fatal("Move of a present key returned false")
+	}
+	if src.Has("k") {
+		t.Fatal("record still in src after Move")
+	}
+	if v, ok := dst.Get("k"); !ok || v != "v" {
+		t.Fatalf("dst holds %q, %v after Move, want the moved value", v, ok)
+	}
+	if ttl, ok := dst.TTL("k"); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("moved record has TTL %v, %v", ttl, ok)
+	}
+
+	if Move(src, dst, "missing") {
+		t.Fatal("Move of a missing key returned true")
+	}
+	if dst.Has("missing") {
+		t.Fatal("Move of a missing key created it in dst")
+	}
+}
+
+func TestMoveConcurrentReverse(t *testing.T) {
+	a, b := New(), New()
+	for _, k := range testKeys(64) {
+		a.Put(k, k)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				Move(a, b, "key"+strconv.Itoa(i%64))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				Move(b, a, "key"+strconv.Itoa(i%64))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Move deadlocked with moves in opposite directions")
+	}
+
+	for _, k := range testKeys(64) {
+		if a.Has(k) == b.Has(k) {
+			t.Fatalf("key %q is in %s hashtable after the moves", k, map[bool]string{true: "both", false: "neither"}[a.Has(k)])
+		}
+	}
+}
+
+func TestLoaderHit(t *testing.T) {
+	var calls int32
+	h := New(WithLoader(func(key string) (string, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		return "loaded", true, nil
+	}))
+	h.Put("k", "v")
+
+	if v, ok := h.Get("k"); !ok || v != "v" || calls != 0 {
+		t.Fatalf("Get = %q, %v with %d loader calls, want the stored value and none", v, ok, calls)
+	}
+}
+
+func TestLoaderMiss(t *testing.T) {
+	var calls int32
+	h := New(WithLoader(func(key string) (string, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		if key == "absent" {
+			return "", false, nil
+		}
+		return "loaded-" + key, true, nil
+	}))
+
+	if v, ok := h.Get("k"); !ok || v != "loaded-k" {
+		t.Fatalf("Get of a miss = %q, %v, want the loaded value", v, ok)
+	}
+	if v, ok := h.Get("k"); !ok || v != "loaded-k" || calls != 1 {
+		t.Fatalf("loaded value wasn't stored: Get = %q, %v after %d loader calls", v, ok, calls)
+	}
+
+	if _, ok := h.Get("absent"); ok {
+		t.Fatal("Get found a key the loader doesn't know")
+	}
+	if h.Len() != 1 {
+		t.Fatalf("a key the loader doesn't know was stored, Len = %d", h.Len())
+	}
+}
+
+func TestLoaderSingleFlight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	h := New(WithLoader(func(key string) (string, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "loaded", true, nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := h.Get("k"); !ok || v != "loaded" {
+				t.Errorf("concurrent Get = %q, %v", v, ok)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("concurrent misses called the loader %d times, want once", calls)
+	}
+}
+
+// recordingWriter collects the batches handed to a WithWriter writer, failing the first fail calls.
+type recordingWriter struct {
+	mu      sync.Mutex
+	batches [][]Pair
+	fail    int
+}
+
+func (w *recordingWriter) write(batch []Pair) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.fail > 0 {
+		w.fail--
+		return errors.New("backing store down")
+	}
+	w.batches = append(w.batches, append([]Pair(nil), batch...))
+	return nil
+}
+
+// pairs returns every pair written so far, keyed by key, the latest one winning.
+func (w *recordingWriter) pairs() map[string]Pair {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pairs := make(map[string]Pair)
+	for _, b := range w.batches {
+		for _, p := range b {
+			pairs[p.Key] = p
+		}
+	}
+	return pairs
+}
+
+func TestWriterBatches(t *testing.T) {
+	w := &recordingWriter{}
+	h := New(WithWriter(w.write, 10*time.Millisecond))
+	defer h.Close()
+
+	h.Put("a", "1")
+	h.Put("b", "2")
+	h.Put("a", "3")
+	h.Del("b")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.pairs()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want := map[string]Pair{"a": {Key: "a", Value: "3"}, "b": {Key: "b", Deleted: true}}
+	if got := w.pairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("writer received %v, want %v", got, want)
+	}
+	w.mu.Lock()
+	n := len(w.batches)
+	w.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("the changes reached the writer in %d batches, want 1", n)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	w := &recordingWriter{fail: 1}
+	h := New(WithWriter(w.write, time.Hour))
+	defer h.Close()
+
+	h.Put("a", "1")
+	if err := h.Flush(); err == nil {
+		t.Fatal("Flush didn't report the failure of the writer")
+	}
+	if len(w.pairs()) != 0 {
+		t.Fatal("a failed batch was recorded")
+	}
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.pairs(); !reflect.DeepEqual(got, map[string]Pair{"a": {Key: "a", Value: "1"}}) {
+		t.Fatalf("retried Flush wrote %v", got)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	w := &recordingWriter{}
+	h := New(WithWriter(w.write, time.Hour))
+	for _, k := range testKeys(100) {
+		h.Put(k, k)
+	}
+	h.Close()
+
+	if got := len(w.pairs()); got != 100 {
+		t.Fatalf("Close flushed %d changes, want 100", got)
+	}
+}
+
+func TestShardData(t *testing.T) {
+	h := New()
+	low, _ := keysInShards(h)
+	h.Put(low, "v")
+
+	data, ok := h.ShardData(0)
+	if !ok || data[low] != "v" {
+		t.Fatalf("ShardData(0) = %v, %v, want it to hold %q", data, ok, low)
+	}
+	data[low] = "changed"
+	data["added"] = "x"
+	if v, _ := h.Get(low); v != "v" || h.Has("added") {
+		t.Fatal("mutating the map returned by ShardData changed the hashtable")
+	}
+
+	for _, i := range []int{-1, SHARD_COUNT, 1 << 20} {
+		if data, ok := h.ShardData(i); ok || data != nil {
+			t.Fatalf("ShardData(%d) = %v, %v, want nil and false", i, data, ok)
+		}
+	}
+}
+
+func TestPutWithTTLJitter(t *testing.T) {
+	h := New()
+	const ttl, jitter = time.Hour, 10 * time.Minute
+
+	before := time.Now().UnixNano()
+	for _, k := range testKeys(100) {
+		h.PutWithTTLJitter(k, "v", ttl, jitter)
+	}
+	after := time.Now().UnixNano()
+
+	expiries := make(map[int64]bool)
+	for _, k := range testKeys(100) {
+		exp := h.shards()[h.ShardIndex(k)].expires[k]
+		if exp < before+int64(ttl-jitter) || exp > after+int64(ttl+jitter) {
+			t.Fatalf("key %q expires %v from now, outside %v ± %v", k, time.Duration(exp-after), ttl, jitter)
+		}
+		expiries[exp] = true
+	}
+	if len(expiries) < 90 {
+		t.Fatalf("100 records loaded together got only %d distinct expiries", len(expiries))
+	}
+}
+
+func TestRangeSorted(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(500) {
+		h.Put(k, "v"+k)
+	}
+
+	var keys []string
+	h.RangeSorted(func(k, v string) bool {
+		if v != "v"+k {
+			t.Fatalf("RangeSorted gave %q=%q", k, v)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if len(keys) != 500 {
+		t.Fatalf("RangeSorted visited %d records, want 500", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("RangeSorted gave %q before %q", keys[i-1], keys[i])
+		}
+	}
+
+	var visited []string
+	h.RangeSorted(func(k, _ string) bool {
+		visited = append(visited, k)
+		return len(visited) < 3
+	})
+	if !reflect.DeepEqual(visited, keys[:3]) {
+		t.Fatalf("RangeSorted stopped after %q, want %q", visited, keys[:3])
+	}
+}
+
+func TestPutIfNotExistAtCapacity(t *testing.T) {
+	newFull := func() (*HashTable, string, string) {
+		h := New(WithMaxSize(1))
+		low, high := keysInShards(h)
+		h.Put(low, "v")
+		return h, low, high
+	}
+
+	// A record of the same shard gets evicted, as with Put.
+	h, low, _ := newFull()
+	sameShard := "other"
+	for i := 0; h.ShardIndex(sameShard) != h.ShardIndex(low); i++ {
+		sameShard = "other" + strconv.Itoa(i)
+	}
+	if !h.PutIfNotExist(sameShard, "v") {
+		t.Fatal("PutIfNotExist at capacity didn't evict within the shard")
+	}
+	if h.Has(low) || h.Len() != 1 {
+		t.Fatalf("PutIfNotExist left Len = %d, want the old record evicted", h.Len())
+	}
+
+	// With nothing to evict in its shard, the record is rejected, as with Put.
+	h, _, high := newFull()
+	if h.PutIfNotExist(high, "v") {
+		t.Fatal("PutIfNotExist stored a record with no room for it")
+	}
+	if added, err := h.TryPutIfNotExist(high, "v"); added || !errors.Is(err, ErrCapacity) {
+		t.Fatalf("TryPutIfNotExist = %v, %v, want ErrCapacity", added, err)
+	}
+	h.Put(high, "v")
+	if h.Has(high) {
+		t.Fatal("Put stored a record that PutIfNotExist rejected")
+	}
+
+	h, _, high = newFull()
+	if v, _ := h.GetOrComputeUnlocked(high, func() string { return "computed" }); v != "computed" {
+		t.Fatalf("GetOrComputeUnlocked = %q", v)
+	}
+	if h.Has(high) || h.Len() != 1 {
+		t.Fatal("GetOrComputeUnlocked stored a record with no room for it")
+	}
+}
+
+func TestGroupPoolDoesNotLeak(t *testing.T) {
+	h := New()
+
+	groups := h.groupByShard(testKeys(100))
+	kept := groups
+	releaseGroups(groups)
+	for i, group := range kept {
+		for _, k := range group[:cap(group)] {
+			if k != "" {
+				t.Fatalf("released group %d still holds key %q", i, k)
+			}
+		}
+	}
+
+	keys := []string{"a", "b", "c"}
+	groups = h.groupByShard(keys)
+	defer releaseGroups(groups)
+	var got []string
+	for i, group := range groups {
+		for _, k := range group {
+			if h.ShardIndex(k) != i {
+				t.Fatalf("key %q grouped under shard %d", k, i)
+			}
+			got = append(got, k)
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, keys) {
+		t.Fatalf("reused groups hold %q, want %q", got, keys)
+	}
+}
+
+func TestBulkResultsAreFresh(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(50) {
+		h.Put(k, "v"+k)
+	}
+
+	first := h.MGet(testKeys(50))
+	second := h.MGet([]string{"key1"})
+	if len(first) != 50 || !reflect.DeepEqual(second, map[string]string{"key1": "vkey1"}) {
+		t.Fatalf("MGet results share state: %d and %v", len(first), second)
+	}
+	if len(h.DelMany([]string{"missing"})) != 0 {
+		t.Fatal("DelMany reported deleting a missing key")
+	}
+}
+
+func BenchmarkMGet(b *testing.B) {
+	h := New()
+	keys := testKeys(64)
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.MGet(keys)
+	}
+}
+
+func BenchmarkGroupByShardPooled(b *testing.B) {
+	h := New()
+	keys := testKeys(64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		releaseGroups(h.groupByShard(keys))
+	}
+}
+
+// BenchmarkGroupByShardUnpooled is the grouping done without groupPool, as a baseline for BenchmarkGroupByShardPooled.
+func BenchmarkGroupByShardUnpooled(b *testing.B) {
+	h := New()
+	keys := testKeys(64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		groups := make([][]string, len(h.shards()))
+		for _, k := range keys {
+			j := h.index(k, len(groups))
+			groups[j] = append(groups[j], k)
+		}
+	}
+}
+
+func TestLockLeakDetection(t *testing.T) {
+	h := New(WithLockLeakDetection())
+
+	unlock := h.LockKey("a")
+	unlock()
+	if err := h.CheckNoLeaks(); err != nil {
+		t.Fatalf("correct usage reported a leak: %v", err)
+	}
+
+	h.LockKey("forgotten")
+	err := h.CheckNoLeaks()
+	if !errors.Is(err, ErrLockLeak) || !strings.Contains(err.Error(), "forgotten") {
+		t.Fatalf("CheckNoLeaks = %v, want a leak naming the key", err)
+	}
+
+	if err := New().CheckNoLeaks(); err != nil {
+		t.Fatalf("CheckNoLeaks without WithLockLeakDetection = %v", err)
+	}
+}
+
+func TestGetWithMeta(t *testing.T) {
+	h := New()
+	before := time.Now()
+	h.Put("plain", "v")
+	h.Put("plain", "v2")
+	h.PutWithTTL("ttl", "v", time.Hour)
+
+	v, meta, ok := h.GetWithMeta("plain")
+	if !ok || v != "v2" {
+		t.Fatalf("GetWithMeta = %q, %v", v, ok)
+	}
+	if _, version, _ := h.GetVersioned("plain"); meta.Version != version || version == 0 {
+		t.Fatalf("Version = %d, GetVersioned says %d", meta.Version, version)
+	}
+	if meta.TTL != NoTTL {
+		t.Fatalf("TTL of a record without a TTL = %v, want NoTTL", meta.TTL)
+	}
+	if meta.Modified.Before(before) || meta.Modified.After(time.Now()) {
+		t.Fatalf("Modified = %v, not the time of the write", meta.Modified)
+	}
+
+	if _, meta, _ := h.GetWithMeta("ttl"); meta.TTL <= 59*time.Minute || meta.TTL > time.Hour {
+		t.Fatalf("TTL = %v, want about an hour", meta.TTL)
+	}
+
+	if v, meta, ok := h.GetWithMeta("missing"); ok || v != "" || meta != (EntryMeta{}) {
+		t.Fatalf("GetWithMeta of a missing key = %q, %+v, %v", v, meta, ok)
+	}
+}
+
+func TestGetWithMetaInsertSeq(t *testing.T) {
+	h := New(WithShardCount(4))
+	keys := testKeys(20)
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+
+	var last uint64
+	for _, k := range keys {
+		_, meta, _ := h.GetWithMeta(k)
+		if meta.InsertSeq <= last {
+			t.Fatalf("InsertSeq of %q = %d, not after %d of the key inserted before", k, meta.InsertSeq, last)
+		}
+		last = meta.InsertSeq
+	}
+
+	_, first, _ := h.GetWithMeta(keys[0])
+	h.Put(keys[0], "overwritten")
+	h.Resize(64)
+	if _, meta, _ := h.GetWithMeta(keys[0]); meta.InsertSeq != first.InsertSeq {
+		t.Fatalf("InsertSeq went from %d to %d after an overwrite and a Resize", first.InsertSeq, meta.InsertSeq)
+	}
+
+	h.Del(keys[0])
+	h.Put(keys[0], "again")
+	if _, meta, _ := h.GetWithMeta(keys[0]); meta.InsertSeq <= last {
+		t.Fatalf("InsertSeq of a reinserted key = %d, want more than %d", meta.InsertSeq, last)
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetWithMetaAccesses(t *testing.T) {
+	h := New(WithAccessRate(100))
+	h.Put("k", "v")
+	for i := 0; i < 3; i++ {
+		h.Get("k")
+	}
+	if _, meta, _ := h.GetWithMeta("k"); meta.Accesses != 3 {
+		t.Fatalf("Accesses = %d after 3 reads, want 3", meta.Accesses)
+	}
+
+	untracked := New()
+	untracked.Put("k", "v")
+	untracked.Get("k")
+	if _, meta, _ := untracked.GetWithMeta("k"); meta.Accesses != 0 {
+		t.Fatalf("Accesses = %d without WithAccessRate, want 0", meta.Accesses)
+	}
+}
+
+func TestRecommendShardCount(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	isPowerOfTwo := func(n int) bool { return n > 0 && n&(n-1) == 0 }
+
+	tiny := New()
+	tiny.Put("k", "v")
+	small := tiny.RecommendShardCount()
+
+	large := New()
+	for _, k := range testKeys(64 * recordsPerShard) {
+		large.Put(k, "v")
+	}
+	big := large.RecommendShardCount()
+
+	if !isPowerOfTwo(small) || !isPowerOfTwo(big) {
+		t.Fatalf("recommended %d and %d shards, want powers of two", small, big)
+	}
+	if big <= small {
+		t.Fatalf("recommended %d shards for a large hashtable, not more than %d for a tiny one", big, small)
+	}
+	if n := New().RecommendShardCount(); !isPowerOfTwo(n) {
+		t.Fatalf("recommended %d shards for an empty hashtable", n)
+	}
+}
+
+var (
+	_ Map = HashTable{}
+	_ Map = (*HashTable)(nil)
+	_ Map = wrappedMap{}
+	_ Map = Snapshot{}
+	_ Map = FrozenMap{}
+	_ Map = ReadOnlyView{}
+)
+
+// readAll is read code written against Map, for checking that every implementer behaves the same.
+func readAll(m Map) (map[string]string, bool) {
+	data := make(map[string]string)
+	m.Range(func(k, v string) bool {
+		data[k] = v
+		return true
+	})
+	v, ok := m.Get("a")
+	return data, ok && v == "1" && m.Has("b") && !m.Has("missing") && m.Len() == len(data)
+}
+
+func TestMapImplementers(t *testing.T) {
+	h := New()
+	h.Put("a", "1")
+	h.Put("b", "2")
+	want := map[string]string{"a": "1", "b": "2"}
+
+	for name, m := range map[string]Map{
+		"HashTable":    *h,
+		"*HashTable":   h,
+		"Middleware":   WithMiddleware(h, Middleware{}),
+		"Snapshot":     h.Snapshot(),
+		"FrozenMap":    NewFrozenMap(want),
+		"ReadOnlyView": h.ReadOnly(),
+	} {
+		data, ok := readAll(m)
+		if !ok || !reflect.DeepEqual(data, want) {
+			t.Errorf("%s: read %v, consistent: %v", name, data, ok)
+		}
+	}
+}
+
+func TestSnapshotDoesNotChange(t *testing.T) {
+	h := New()
+	h.Put("a", "1")
+	h.PutWithTTL("expired", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	snap := h.Snapshot()
+	h.Put("a", "changed")
+	h.Put("b", "2")
+
+	if v, ok := snap.Get("a"); !ok || v != "1" {
+		t.Fatalf("Snapshot.Get(a) = %q, %v after a write, want 1", v, ok)
+	}
+	if snap.Has("b") || snap.Has("expired") || snap.Len() != 1 {
+		t.Fatalf("snapshot holds %d records, want only a", snap.Len())
+	}
+
+	view := h.ReadOnly()
+	if v, _ := view.Get("a"); v != "changed" || !view.Has("b") {
+		t.Fatalf("ReadOnlyView doesn't show the current records: a = %q", v)
+	}
+}
+
+func TestFrozenMapOrder(t *testing.T) {
+	data := map[string]string{"b": "2", "a": "1", "c": "3", "": "empty"}
+	m := NewFrozenMap(data)
+	data["a"] = "changed"
+
+	var keys []string
+	m.Range(func(k, v string) bool {
+		keys = append(keys, k)
+		return k != "b"
+	})
+	if !reflect.DeepEqual(keys, []string{"", "a", "b"}) {
+		t.Fatalf("Range visited %q, want the keys in order up to b", keys)
+	}
+	if v, ok := m.Get("a"); !ok || v != "1" {
+		t.Fatalf("Get(a) = %q, %v, want the value copied at creation", v, ok)
+	}
+	if v, ok := m.Get(""); !ok || v != "empty" {
+		t.Fatalf("Get of the empty key = %q, %v", v, ok)
+	}
+	if m.Has("bb") || m.Has("d") || m.Len() != 4 {
+		t.Fatal("FrozenMap found a missing key or has the wrong length")
+	}
+
+	h := New()
+	h.PutAll(map[string]string{"x": "1", "y": "2"})
+	if frozen := h.Snapshot().Freeze(); frozen.Len() != 2 || frozen.keys[0] != "x" {
+		t.Fatalf("Freeze of a snapshot = %v", frozen.keys)
+	}
+}
+
+func TestPutWithExpireAt(t *testing.T) {
+	h := New()
+	h.PutWithExpireAt("future", "v", time.Now().Add(time.Hour))
+	h.PutWithExpireAt("past", "v", time.Now().Add(-time.Second))
+
+	if v, ok := h.Get("future"); !ok || v != "v" {
+		t.Fatalf("Get of a record expiring in the future = %q, %v", v, ok)
+	}
+	if d, ok := h.TTL("future"); !ok || d <= 59*time.Minute || d > time.Hour {
+		t.Fatalf("TTL = %v, %v, want about an hour", d, ok)
+	}
+	if _, ok := h.Get("past"); ok {
+		t.Fatal("a record expiring in the past is readable")
+	}
+	if h.Has("past") {
+		t.Fatal("Has found a record expiring in the past")
+	}
+	if _, ok := h.TTL("past"); ok {
+		t.Fatal("TTL reported a record expiring in the past")
+	}
+}
+
+func TestEvictionSampling(t *testing.T) {
+	for _, tc := range []struct{ rate, logged int }{{1, 100}, {10, 10}} {
+		logger := &testLogger{}
+		h := New(WithEvictionSampling(tc.rate), WithLogger(logger.logf))
+		for _, k := range testKeys(100) {
+			h.Put(k, "v")
+			h.Del(k)
+		}
+
+		msgs := logger.messages()
+		if len(msgs) != tc.logged {
+			t.Fatalf("rate %d logged %d of 100 evictions, want %d", tc.rate, len(msgs), tc.logged)
+		}
+		if !strings.Contains(msgs[0], "(deleted)") {
+			t.Fatalf("sampled eviction %q doesn't name its reason", msgs[0])
+		}
+		if h.Evictions() != 100 {
+			t.Fatalf("Evictions = %d, want 100", h.Evictions())
+		}
+	}
+
+	if n := New().Evictions(); n != 0 {
+		t.Fatalf("Evictions without WithEvictionSampling = %d", n)
+	}
+}
+
+func TestGetOrComputeUnlockedDoesNotBlockShard(t *testing.T) {
+	h := New(WithShardCount(1))
+	started, release := make(chan struct{}), make(chan struct{})
+	go h.GetOrComputeUnlocked("a", func() string {
+		close(started)
+		<-release
+		return "slow"
+	})
+	<-started
+	defer close(release)
+
+	done := make(chan struct{})
+	go func() {
+		h.Put("b", "v")
+		h.Get("b")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow compute of one key blocked writes to another key of its shard")
+	}
+}
+
+func TestGetOrComputeUnlockedSingleFlight(t *testing.T) {
+	h := New()
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 16)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = h.GetOrComputeUnlocked("a", func() string {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "computed"
+			})
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("concurrent computes called f %d times, want once", calls)
+	}
+	for i, v := range results {
+		if v != "computed" {
+			t.Fatalf("caller %d got %q", i, v)
+		}
+	}
+	if v, computed := h.GetOrComputeUnlocked("a", func() string { return "again" }); computed || v != "computed" {
+		t.Fatalf("GetOrComputeUnlocked of a stored key = %q, %v", v, computed)
+	}
+}
+
+func TestGetOrComputeUnlockedPanic(t *testing.T) {
+	h := New()
+	started, release := make(chan struct{}), make(chan struct{})
+
+	leader := make(chan interface{})
+	go func() {
+		defer func() { leader <- recover() }()
+		h.GetOrComputeUnlocked("a", func() string {
+			close(started)
+			<-release
+			panic("compute crashed")
+		})
+	}()
+	<-started
+
+	type result struct {
+		v        string
+		computed bool
+	}
+	waiter := make(chan result)
+	go func() {
+		v, computed := h.GetOrComputeUnlocked("a", func() string { return "retried" })
+		waiter <- result{v, computed}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if r := <-leader; r != "compute crashed" {
+		t.Fatalf("the leader recovered %v, want its own panic", r)
+	}
+	if r := <-waiter; r.v != "retried" || !r.computed {
+		t.Fatalf("the waiter got %q, %v, want its own computed value", r.v, r.computed)
+	}
+	if v, _ := h.Get("a"); v != "retried" {
+		t.Fatalf("stored %q, want the waiter's value", v)
+	}
+}
+
+func TestPutReturning(t *testing.T) {
+	h := New()
+	if prev, existed := h.PutReturning("k", "v1"); existed || prev != "" {
+		t.Fatalf("insert returned %q, %v", prev, existed)
+	}
+	if prev, existed := h.PutReturning("k", "v2"); !existed || prev != "v1" {
+		t.Fatalf("overwrite returned %q, %v, want v1 and true", prev, existed)
+	}
+	if v, _ := h.Get("k"); v != "v2" {
+		t.Fatalf("Get = %q after PutReturning, want v2", v)
+	}
+}
+
+// pageKeys returns the keys of the records of a page.
+func pageKeys(page []Pair) []string {
+	keys := make([]string, len(page))
+	for i, p := range page {
+		keys[i] = p.Key
+	}
+	return keys
+}
+
+func TestPageByKey(t *testing.T) {
+	h := New(WithOrderedIndex())
+	keys := []string{"", "a", "b", "c", "d", "e", "f", "g"}
+	for _, k := range keys {
+		h.Put(k, "v"+k)
+	}
+
+	var all []string
+	page := h.FirstPage(3)
+	for len(page) > 0 {
+		if len(page) > 3 {
+			t.Fatalf("page holds %d records, limit is 3", len(page))
+		}
+		for _, p := range page {
+			if p.Value != "v"+p.Key {
+				t.Fatalf("page has %q=%q", p.Key, p.Value)
+			}
+		}
+		all = append(all, pageKeys(page)...)
+		page = h.PageByKey(page[len(page)-1].Key, 3)
+	}
+	if !reflect.DeepEqual(all, keys) {
+		t.Fatalf("paginated through %q, want %q", all, keys)
+	}
+
+	if got := pageKeys(h.PageByKey("", 2)); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("PageByKey(\"\") = %q, want the keys after the empty one", got)
+	}
+	if New().FirstPage(3) != nil || New().PageByKey("", 3) != nil {
+		t.Fatal("pagination works without WithOrderedIndex")
+	}
+}
+
+func TestPageByKeyRest(t *testing.T) {
+	h := New(WithOrderedIndex())
+	for _, k := range []string{"a", "b", "c", "d"} {
+		h.Put(k, "v"+k)
+	}
+
+	if got := pageKeys(h.PageByKey("b", math.MaxInt)); !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Fatalf("PageByKey(b, MaxInt) = %q, want the rest of the keys", got)
+	}
+	if got := pageKeys(h.FirstPage(math.MaxInt)); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("FirstPage(MaxInt) = %q, want every key", got)
+	}
+	if page := h.PageByKey("a", math.MaxInt); cap(page) > 4 {
+		t.Fatalf("PageByKey(a, MaxInt) allocated room for %d records, the index has 4", cap(page))
+	}
+	if got := h.PageByKey("d", math.MaxInt); len(got) != 0 {
+		t.Fatalf("PageByKey past the last key = %v", got)
+	}
+}
+
+func TestPageByKeyChangesBetweenPages(t *testing.T) {
+	h := New(WithOrderedIndex())
+	for _, k := range []string{"a", "c", "e", "g", "i"} {
+		h.Put(k, "v")
+	}
+
+	first := h.FirstPage(2)
+	if got := pageKeys(first); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("FirstPage = %q", got)
+	}
+
+	h.Put("b", "v") // before the cursor, not returned.
+	h.Put("d", "v") // after the cursor, returned.
+	h.Del("e")
+	h.Del("g")
+
+	second := h.PageByKey("c", 2)
+	if got := pageKeys(second); !reflect.DeepEqual(got, []string{"d", "i"}) {
+		t.Fatalf("PageByKey after changes = %q, want [d i]", got)
+	}
+	if rest := h.PageByKey("i", 2); len(rest) != 0 {
+		t.Fatalf("PageByKey past the last key = %q", pageKeys(rest))
+	}
+}
+
+func TestMergeLWWCommutative(t *testing.T) {
+	build := func() (*HashTable, *HashTable) {
+		a, b := New(), New()
+		a.Put("old-in-a", "a1")
+		a.Put("only-a", "a")
+		b.Put("old-in-b", "b1")
+		time.Sleep(time.Millisecond)
+		b.Put("old-in-a", "b2")
+		a.Put("old-in-b", "a2")
+		b.Put("only-b", "b")
+		return a, b
+	}
+	want := map[string]string{"old-in-a": "b2", "old-in-b": "a2", "only-a": "a", "only-b": "b"}
+
+	a, b := build()
+	a.MergeLWW(b)
+	if got := tableToMap(a); !reflect.DeepEqual(got, want) {
+		t.Fatalf("merging b into a gave %v, want %v", got, want)
+	}
+
+	a, b = build()
+	b.MergeLWW(a)
+	if got := tableToMap(b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("merging a into b gave %v, want %v", got, want)
+	}
+}
+
+func TestMergeLWWEqualTimes(t *testing.T) {
+	a, b := New(), New()
+	a.Put("k", "x")
+	b.Put("k", "y")
+	// Force equal modification times, which the greater value wins.
+	sa, sb := a.shards()[a.ShardIndex("k")], b.shards()[b.ShardIndex("k")]
+	sb.modified["k"] = sa.modified["k"]
+
+	a.MergeLWW(b)
+	b.MergeLWW(a)
+	va, _ := a.Get("k")
+	vb, _ := b.Get("k")
+	if va != "y" || vb != "y" {
+		t.Fatalf("equal times resolved to %q and %q, want y on both sides", va, vb)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	for name, h := range map[string]*HashTable{"ordered": New(WithOrderedIndex()), "scan": New()} {
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			h.Put(k, "v"+k)
+		}
+
+		got := h.GetRange("b", "d")
+		if want := []Pair{{Key: "b", Value: "vb"}, {Key: "c", Value: "vc"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: GetRange(b, d) = %v, want %v", name, got, want)
+		}
+		if got := h.GetRange("c", "c"); len(got) != 0 {
+			t.Errorf("%s: empty range returned %v", name, got)
+		}
+		if got := h.GetRange("d", "b"); len(got) != 0 {
+			t.Errorf("%s: reversed range returned %v", name, got)
+		}
+		if got := pageKeys(h.GetRange("", "\xff")); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e"}) {
+			t.Errorf("%s: full range returned %q", name, got)
+		}
+	}
+}
+
+func TestCompareAndSwapMany(t *testing.T) {
+	h := New()
+	h.PutAll(map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	if !h.CompareAndSwapMany(map[string]struct{ Old, New string }{"a": {"1", "10"}, "b": {"2", "20"}}) {
+		t.Fatal("CompareAndSwapMany with matching values failed")
+	}
+	want := map[string]string{"a": "10", "b": "20", "c": "3"}
+	if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("hashtable holds %v, want %v", got, want)
+	}
+
+	if h.CompareAndSwapMany(map[string]struct{ Old, New string }{"a": {"10", "x"}, "c": {"wrong", "y"}}) {
+		t.Fatal("CompareAndSwapMany with a mismatch succeeded")
+	}
+	if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("aborted CompareAndSwapMany changed the hashtable to %v", got)
+	}
+	if h.CompareAndSwapMany(map[string]struct{ Old, New string }{"missing": {"", "x"}}) {
+		t.Fatal("CompareAndSwapMany of a missing key succeeded")
+	}
+}
+
+func TestCompareAndSwapManyConcurrent(t *testing.T) {
+	h := New()
+	low, high := keysInShards(h)
+	h.PutInt(low, 0)
+	h.PutInt(high, 0)
+
+	// Every batch increments both counters, so they must stay equal.
+	increment := func() {
+		for {
+			a, _, _ := h.GetInt(low)
+			b, _, _ := h.GetInt(high)
+			if h.CompareAndSwapMany(map[string]struct{ Old, New string }{
+				low:  {strconv.FormatInt(a, 10), strconv.FormatInt(a+1, 10)},
+				high: {strconv.FormatInt(b, 10), strconv.FormatInt(b+1, 10)},
+			}) {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				increment()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("concurrent CompareAndSwapMany deadlocked")
+	}
+
+	a, _, _ := h.GetInt(low)
+	b, _, _ := h.GetInt(high)
+	if a != 800 || b != 800 {
+		t.Fatalf("counters are %d and %d, want 800 each", a, b)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	h := New()
+	for i := 0; i < 1000; i++ {
+		h.PutInt("key"+strconv.Itoa(i), int64(i*7%1000))
+	}
+
+	var seqSum, seqMax int64
+	h.Range(func(_, v string) bool {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		seqSum += n
+		if n > seqMax {
+			seqMax = n
+		}
+		return true
+	})
+
+	parse := func(_, v string) int64 {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	if sum := Reduce(h, parse, func(a, b int64) int64 { return a + b }, 0); sum != seqSum {
+		t.Fatalf("Reduce sum = %d, sequential sum = %d", sum, seqSum)
+	}
+	max := func(a, b int64) int64 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	if got := Reduce(h, parse, max, math.MinInt64); got != seqMax {
+		t.Fatalf("Reduce max = %d, sequential max = %d", got, seqMax)
+	}
+	if got := Reduce(New(), parse, max, math.MinInt64); got != math.MinInt64 {
+		t.Fatalf("Reduce of an empty hashtable = %d, want the identity", got)
+	}
+}
+
+// heavyHash stands for a CPU-heavy per-record computation.
+func heavyHash(_, v string) uint32 {
+	h := uint32(0)
+	for i := 0; i < 200; i++ {
+		h = Hash(v + strconv.Itoa(int(h)))
+	}
+	return h
+}
+
+func benchmarkReduceTable() *HashTable {
+	h := New()
+	for _, k := range testKeys(2000) {
+		h.Put(k, k)
+	}
+	return h
+}
+
+func BenchmarkReduceParallel(b *testing.B) {
+	h := benchmarkReduceTable()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Reduce(h, heavyHash, func(a, b uint32) uint32 { return a ^ b }, 0)
+	}
+}
+
+func BenchmarkReduceSequential(b *testing.B) {
+	h := benchmarkReduceTable()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var acc uint32
+		h.Range(func(k, v string) bool {
+			acc ^= heavyHash(k, v)
+			return true
+		})
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	h := New()
+	if h.Has("") {
+		t.Fatal("empty key present in a new hashtable")
+	}
+	if _, ok := h.Get(""); ok {
+		t.Fatal("Get found the empty key before it was put")
+	}
+
+	h.Put("", "v")
+	if v, ok := h.Get(""); !ok || v != "v" {
+		t.Fatalf("Get(\"\") = %q, %v", v, ok)
+	}
+	if !h.Has("") || h.Len() != 1 {
+		t.Fatalf("Has(\"\") = %v, Len = %d", h.Has(""), h.Len())
+	}
+	if i, j := h.ShardIndex(""), New().ShardIndex(""); i != j {
+		t.Fatalf("empty key maps to shard %d and %d in two hashtables", i, j)
+	}
+
+	h.Put("", "")
+	if v, ok := h.Get(""); !ok || v != "" {
+		t.Fatalf("empty key with an empty value: Get = %q, %v", v, ok)
+	}
+	if v, ok := h.Del(""); !ok || v != "" {
+		t.Fatalf("Del(\"\") = %q, %v", v, ok)
+	}
+	if h.Has("") || h.Len() != 0 {
+		t.Fatal("empty key still present after Del")
+	}
+	if _, ok := h.Del(""); ok {
+		t.Fatal("Del of the missing empty key returned true")
+	}
+}
+
+func TestFromConcurrent(t *testing.T) {
+	data := make(map[string]string)
+	for _, k := range testKeys(10000) {
+		data[k] = "v" + k
+	}
+	want := tableToMap(From(data))
+
+	for _, workers := range []int{-1, 1, 3, 8, 20000} {
+		h := FromConcurrent(data, workers)
+		if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+			t.Fatalf("FromConcurrent with %d workers holds %d records, From holds %d", workers, len(got), len(want))
+		}
+		if err := h.SelfCheck(); err != nil {
+			t.Fatalf("FromConcurrent with %d workers: %v", workers, err)
+		}
+	}
+	if FromConcurrent(nil, 4).Len() != 0 {
+		t.Fatal("FromConcurrent of nil isn't empty")
+	}
+}
+
+func benchmarkFrom(b *testing.B, build func(map[string]string) *HashTable) {
+	data := make(map[string]string)
+	for _, k := range testKeys(100000) {
+		data[k] = k
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		build(data)
+	}
+}
+
+func BenchmarkFrom(b *testing.B) {
+	benchmarkFrom(b, From)
+}
+
+func BenchmarkFromConcurrent(b *testing.B) {
+	for _, workers := range []int{2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			benchmarkFrom(b, func(data map[string]string) *HashTable { return FromConcurrent(data, workers) })
+		})
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	h := New(WithByteAccounting())
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatalf("SelfCheck of a healthy hashtable: %v", err)
+	}
+
+	// Move a record to a shard its key doesn't map to.
+	low, _ := keysInShards(h)
+	s := h.shards()[0]
+	v, _ := s.Data.Get(low)
+	s.Data.Delete(low)
+	h.shards()[1].Data.Set(low, v)
+
+	err := h.SelfCheck()
+	if !errors.Is(err, ErrCorrupted) || !strings.Contains(err.Error(), strconv.Quote(low)) {
+		t.Fatalf("SelfCheck of a misplaced record = %v", err)
+	}
+
+	counted := New(WithByteAccounting())
+	counted.Put("k", "v")
+	atomic.AddInt64(&counted.bytes, 5)
+	if err := counted.SelfCheck(); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("SelfCheck of a wrong byte total = %v", err)
+	}
+}
+
+// stringData returns the address of the bytes of s, telling whether two strings share their memory.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestValueInterning(t *testing.T) {
+	h := New(WithValueInterning())
+	for i, k := range testKeys(100) {
+		// Build every value separately so that only interning can make them share memory.
+		h.Put(k, strings.Repeat("status-", 1)+strconv.Itoa(i%2))
+	}
+
+	first, _ := h.Get("key0")
+	for i, k := range testKeys(100) {
+		if i%2 != 0 {
+			continue
+		}
+		v, _ := h.Get(k)
+		if v != first || stringData(v) != stringData(first) {
+			t.Fatalf("value of %q doesn't share the backing of equal values", k)
+		}
+	}
+
+	plain := New()
+	plain.Put("a", strings.Repeat("x", 2))
+	plain.Put("b", strings.Repeat("x", 2))
+	a, _ := plain.Get("a")
+	b, _ := plain.Get("b")
+	if stringData(a) == stringData(b) {
+		t.Fatal("equal values share memory without WithValueInterning")
+	}
+}
+
+func TestDrainTo(t *testing.T) {
+	h := New()
+	want := make(map[string]string)
+	for _, k := range testKeys(500) {
+		h.Put(k, "v"+k)
+		want[k] = "v" + k
+	}
+
+	out := make(chan Pair, 16)
+	got := make(map[string]string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range out {
+			got[p.Key] = p.Value
+		}
+	}()
+
+	if err := h.DrainTo(context.Background(), out); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	<-done
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("drained %d records, want %d", len(got), len(want))
+	}
+	if h.Len() != 0 {
+		t.Fatalf("Len = %d after a full drain", h.Len())
+	}
+}
+
+func TestDrainToCancel(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(500) {
+		h.Put(k, "v"+k)
+	}
+	want := tableToMap(h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan Pair)
+	got := make(map[string]string)
+	go func() {
+		for p := range out {
+			got[p.Key] = p.Value
+			if len(got) == 100 {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	if err := h.DrainTo(ctx, out); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DrainTo returned %v, want context.Canceled", err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("received %d records, want 100", len(got))
+	}
+
+	rest := tableToMap(h)
+	for k := range got {
+		if _, ok := rest[k]; ok {
+			t.Fatalf("sent record %q is still in the hashtable", k)
+		}
+		rest[k] = got[k]
+	}
+	if !reflect.DeepEqual(rest, want) {
+		t.Fatalf("the sent and remaining records make %d records, want %d", len(rest), len(want))
+	}
+}
+
+func TestDrainToSlowConsumer(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(50) {
+		h.Put(k, "v")
+	}
+
+	out := make(chan Pair)
+	received := make(chan int)
+	go func() {
+		var n int
+		for range out {
+			time.Sleep(time.Millisecond)
+			n++
+		}
+		received <- n
+	}()
+
+	if err := h.DrainTo(context.Background(), out); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	if n := <-received; n != 50 || h.Len() != 0 {
+		t.Fatalf("slow consumer received %d records, %d left, want all 50 moved", n, h.Len())
+	}
+}
+
+func TestApply(t *testing.T) {
+	h := New()
+	h.Put("same", "v")
+	h.Put("changed", "old")
+
+	events, cancel := h.SubscribeAll(16)
+	defer cancel()
+
+	inserted, updated, unchanged := h.Apply(map[string]string{"same": "v", "changed": "new", "added": "x"})
+	if !reflect.DeepEqual(inserted, []string{"added"}) || !reflect.DeepEqual(updated, []string{"changed"}) || !reflect.DeepEqual(unchanged, []string{"same"}) {
+		t.Fatalf("Apply = %q, %q, %q", inserted, updated, unchanged)
+	}
+	want := map[string]string{"same": "v", "changed": "new", "added": "x"}
+	if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("hashtable holds %v, want %v", got, want)
+	}
+
+	cancel()
+	var changed []string
+	for e := range events {
+		changed = append(changed, e.Key)
+	}
+	sort.Strings(changed)
+	if !reflect.DeepEqual(changed, []string{"added", "changed"}) {
+		t.Fatalf("Apply emitted events for %q, want only the changed keys", changed)
+	}
+}
+
+func TestAccessRate(t *testing.T) {
+	tracker := newAccessTracker(1024)
+	start := int64(1000) * int64(time.Second)
+
+	// Five reads a second for ten seconds, then one idle second.
+	for sec := int64(0); sec < 10; sec++ {
+		for i := int64(0); i < 5; i++ {
+			tracker.add("busy", start+sec*int64(time.Second)+i*int64(200*time.Millisecond))
+		}
+	}
+	tracker.add("idle", start)
+	now := start + 10*int64(time.Second) + int64(time.Millisecond)
+
+	if r := tracker.rate("busy", 10*time.Second, now); math.Abs(r-5) > 0.01 {
+		t.Fatalf("rate of a key read 5 times a second = %v", r)
+	}
+	if r := tracker.rate("busy", 5*time.Second, now); math.Abs(r-5) > 0.01 {
+		t.Fatalf("rate over a shorter window = %v, want 5", r)
+	}
+	if r := tracker.rate("busy", 20*time.Second, now); math.Abs(r-2.5) > 0.01 {
+		t.Fatalf("rate over a window twice as long as the reads = %v, want 2.5", r)
+	}
+	if r := tracker.rate("idle", 5*time.Second, now); r != 0 {
+		t.Fatalf("rate of a key idle for the window = %v", r)
+	}
+	if r := tracker.rate("unknown", 5*time.Second, now); r != 0 {
+		t.Fatalf("rate of an untracked key = %v", r)
+	}
+}
+
+func TestAccessRateBounded(t *testing.T) {
+	tracker := newAccessTracker(SHARD_COUNT)
+	for _, k := range testKeys(100 * SHARD_COUNT) {
+		tracker.add(k, int64(time.Second))
+	}
+	var tracked int
+	for i := range tracker.parts {
+		tracked += len(tracker.parts[i].keys)
+	}
+	if tracked > SHARD_COUNT {
+		t.Fatalf("tracking %d keys, bound is %d", tracked, SHARD_COUNT)
+	}
+
+	h := New()
+	h.Put("k", "v")
+	h.Get("k")
+	if r := h.AccessRate("k", time.Second); r != 0 {
+		t.Fatalf("AccessRate without WithAccessRate = %v", r)
+	}
+}
+
+func TestUnsafeRange(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(300) {
+		h.Put(k, "v"+k)
+	}
+
+	got := make(map[string]string)
+	h.UnsafeRange(func(k, v string) bool {
+		got[k] = v
+		return true
+	})
+	if want := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UnsafeRange visited %d records, want %d", len(got), len(want))
+	}
+
+	var visited int
+	h.UnsafeRange(func(string, string) bool {
+		visited++
+		return visited < 5
+	})
+	if visited != 5 {
+		t.Fatalf("UnsafeRange visited %d records after f returned false at 5", visited)
+	}
+}
+
+func TestUnsafeRangePanic(t *testing.T) {
+	h := New()
+	h.Put("k", "v")
+	mustPanic(t, "UnsafeRange", func() {
+		h.UnsafeRange(func(string, string) bool { panic("boom") })
+	})
+	checkUnlocked(t, h)
+}
+
+func benchmarkRangeTable() *HashTable {
+	h := New()
+	for _, k := range testKeys(10000) {
+		h.Put(k, k)
+	}
+	return h
+}
+
+func BenchmarkRange(b *testing.B) {
+	h := benchmarkRangeTable()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		h.Range(func(k, v string) bool {
+			n += len(v)
+			return true
+		})
+	}
+}
+
+func BenchmarkUnsafeRange(b *testing.B) {
+	h := benchmarkRangeTable()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		h.UnsafeRange(func(k, v string) bool {
+			n += len(v)
+			return true
+		})
+	}
+}
+
+func TestNormalizeShardCount(t *testing.T) {
+	for n, want := range map[int]int{
+		-5:                1,
+		0:                 1,
+		1:                 1,
+		3:                 4,
+		32:                32,
+		1000:              1024,
+		MaxShardCount:     MaxShardCount,
+		MaxShardCount + 1: MaxShardCount,
+		math.MaxInt32:     MaxShardCount,
+	} {
+		if got := NormalizeShardCount(n); got != want {
+			t.Errorf("NormalizeShardCount(%d) = %d, want %d", n, got, want)
+		}
+	}
+
+	if n := len(New(WithShardCount(3)).shards()); n != 4 {
+		t.Fatalf("WithShardCount(3) made %d shards, want 4", n)
+	}
+	h := New()
+	h.Resize(1000)
+	if n := len(h.shards()); n != 1024 {
+		t.Fatalf("Resize(1000) made %d shards, want 1024", n)
+	}
+}
+
+func TestGetOrComputeBytesSingleFlight(t *testing.T) {
+	h := New()
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, err := h.GetOrComputeBytes("blob", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte{1, 2, 3}, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = b
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("concurrent misses computed the blob %d times, want once", calls)
+	}
+
+	// Every caller has its own copy.
+	results[0][0] = 9
+	for i, b := range results[1:] {
+		if !bytes.Equal(b, []byte{1, 2, 3}) {
+			t.Fatalf("caller %d got %v after another caller mutated its copy", i+1, b)
+		}
+	}
+	if b, _ := h.GetBytes("blob"); !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Fatalf("stored blob is %v after a caller mutated its copy", b)
+	}
+}
+
+func TestGetOrComputeBytesError(t *testing.T) {
+	h := New()
+	fail := errors.New("render failed")
+	if _, err := h.GetOrComputeBytes("blob", func() ([]byte, error) { return nil, fail }); !errors.Is(err, fail) {
+		t.Fatalf("GetOrComputeBytes returned %v, want the error of f", err)
+	}
+	if h.Has("blob") {
+		t.Fatal("a failed compute was cached")
+	}
+
+	b, err := h.GetOrComputeBytes("blob", func() ([]byte, error) { return []byte("ok"), nil })
+	if err != nil || string(b) != "ok" {
+		t.Fatalf("compute after a failure = %q, %v", b, err)
+	}
+}
+
+func TestGetOrComputeBytesPanic(t *testing.T) {
+	h := New()
+	started, release := make(chan struct{}), make(chan struct{})
+
+	leader := make(chan interface{})
+	go func() {
+		defer func() { leader <- recover() }()
+		h.GetOrComputeBytes("blob", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("render crashed")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error)
+	go func() {
+		b, err := h.GetOrComputeBytes("blob", func() ([]byte, error) {
+			t.Error("the waiter computed the blob itself")
+			return nil, nil
+		})
+		if b != nil {
+			t.Errorf("the waiter got %v", b)
+		}
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if r := <-leader; r != "render crashed" {
+		t.Fatalf("the leader recovered %v, want its own panic", r)
+	}
+	if err := <-waiter; !errors.Is(err, ErrComputePanicked) {
+		t.Fatalf("the waiter got %v, want ErrComputePanicked", err)
+	}
+	if h.Has("blob") {
+		t.Fatal("a panicked compute stored something")
+	}
+
+	if b, err := h.GetOrComputeBytes("blob", func() ([]byte, error) { return []byte("ok"), nil }); err != nil || string(b) != "ok" {
+		t.Fatalf("compute after a panic = %q, %v", b, err)
+	}
+}
+
+func TestMGetConsistent(t *testing.T) {
+	h := New()
+	low, high := keysInShards(h)
+	h.PutAll(map[string]string{low: "0", high: "0"})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			old, next := strconv.Itoa(i), strconv.Itoa(i+1)
+			h.CompareAndSwapMany(map[string]struct{ Old, New string }{low: {old, next}, high: {old, next}})
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		got := h.MGetConsistent([]string{low, high, "missing"})
+		if len(got) != 2 || got[low] != got[high] {
+			close(stop)
+			t.Fatalf("MGetConsistent saw a partial transaction: %v", got)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestIterator(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(300) {
+		h.Put(k, "v"+k)
+	}
+
+	got := make(map[string]string)
+	it := h.Iterator()
+	for it.Next() {
+		if _, dup := got[it.Key()]; dup {
+			t.Fatalf("Iterator visited %q twice", it.Key())
+		}
+		got[it.Key()] = it.Value()
+	}
+	if want := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Iterator visited %d records, want %d", len(got), len(want))
+	}
+	if it.Next() {
+		t.Fatal("Next returned true after the end")
+	}
+	it.Close()
+
+	empty := New().Iterator()
+	if empty.Next() {
+		t.Fatal("Iterator of an empty hashtable returned a record")
+	}
+}
+
+func TestIteratorClose(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+
+	it := h.Iterator()
+	for i := 0; i < 3; i++ {
+		if !it.Next() {
+			t.Fatal("Next returned false before the end")
+		}
+	}
+	it.Close()
+	it.Close()
+	if it.Next() {
+		t.Fatal("Next returned true after Close")
+	}
+}
+
+func TestIteratorMutation(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+
+	done := make(chan int)
+	go func() {
+		var n int
+		it := h.Iterator()
+		defer it.Close()
+		for it.Next() {
+			// Writes between the calls, including to the shard being iterated, must not block.
+			h.Put(it.Key(), "changed")
+			h.Del(it.Key())
+			h.Put("new"+it.Key(), "v")
+			n++
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n < 100 {
+			t.Fatalf("Iterator visited %d records, want at least the 100 present at the start", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing between Next calls deadlocked")
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	h := New(WithSoftDelete(20 * time.Millisecond))
+	h.Put("k", "v")
+	h.Put("other", "v")
+	h.Del("k")
+
+	if _, ok := h.Get("k"); ok || h.Has("k") || h.Len() != 1 {
+		t.Fatal("a soft-deleted record is visible to reads")
+	}
+	if _, ok := tableToMap(h)["k"]; ok {
+		t.Fatal("Range visited a soft-deleted record")
+	}
+
+	if !h.Undelete("k") {
+		t.Fatal("Undelete failed within the retention")
+	}
+	if v, ok := h.Get("k"); !ok || v != "v" {
+		t.Fatalf("undeleted record: Get = %q, %v", v, ok)
+	}
+	if h.Undelete("k") {
+		t.Fatal("Undelete of a live record returned true")
+	}
+
+	h.Del("k")
+	time.Sleep(40 * time.Millisecond)
+	h.DeleteExpired()
+	if h.Undelete("k") || h.Has("k") {
+		t.Fatal("record came back after the retention sweep")
+	}
+	if n := len(h.shards()[h.ShardIndex("k")].tombstones); n != 0 {
+		t.Fatalf("%d tombstones left after the sweep", n)
+	}
+}
+
+func TestSoftDeleteRewritten(t *testing.T) {
+	h := New(WithSoftDelete(time.Hour))
+	h.Put("k", "old")
+	h.Del("k")
+	h.Put("k", "new")
+	h.Del("k")
+	h.Put("k", "newer")
+	if h.Undelete("k") {
+		t.Fatal("Undelete brought back a tombstone of a key written again")
+	}
+	if v, _ := h.Get("k"); v != "newer" {
+		t.Fatalf("Get = %q, want the latest write", v)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(1001) {
+		h.Put(k, "v"+k)
+	}
+	want := tableToMap(h)
+
+	for _, n := range []int{-1, 1, 3, 7, 2000} {
+		chunks := h.Partition(n)
+		if n < 1 {
+			n = 1
+		}
+		if len(chunks) != n {
+			t.Fatalf("Partition(%d) made %d chunks", n, len(chunks))
+		}
+
+		union := make(map[string]string)
+		min, max := len(want), 0
+		for _, c := range chunks {
+			for k, v := range c {
+				if _, dup := union[k]; dup {
+					t.Fatalf("Partition(%d) put %q in two chunks", n, k)
+				}
+				union[k] = v
+			}
+			if len(c) < min {
+				min = len(c)
+			}
+			if len(c) > max {
+				max = len(c)
+			}
+		}
+		if !reflect.DeepEqual(union, want) {
+			t.Fatalf("the chunks of Partition(%d) hold %d records, want %d", n, len(union), len(want))
+		}
+		if max-min > 1 {
+			t.Fatalf("Partition(%d) chunk sizes range from %d to %d", n, min, max)
+		}
+	}
+
+	chunks := h.Partition(2)
+	chunks[0]["key0"] = "changed"
+	if v, _ := h.Get("key0"); v != "vkey0" {
+		t.Fatal("a chunk shares memory with the hashtable")
+	}
+}
+
+func TestPutAllChecked(t *testing.T) {
+	h := New(WithMaxKeyLen(8), WithMaxValueLen(4))
+	errs := h.PutAllChecked(map[string]string{
+		"ok1":           "v",
+		"ok2":           "v",
+		"very long key": "v",
+		"bigvalue":      "too long",
+	})
+
+	if len(errs) != 2 {
+		t.Fatalf("PutAllChecked reported %d errors, want 2: %v", len(errs), errs)
+	}
+	if !errors.Is(errs["very long key"], ErrKeyTooLong) || !errors.Is(errs["bigvalue"], ErrValueTooLong) {
+		t.Fatalf("PutAllChecked reported %v", errs)
+	}
+	if !h.Has("ok1") || !h.Has("ok2") || h.Len() != 2 {
+		t.Fatalf("valid records weren't all stored, Len = %d", h.Len())
+	}
+
+	if errs := h.PutAllChecked(map[string]string{"a": "1"}); len(errs) != 0 {
+		t.Fatalf("fully successful PutAllChecked reported %v", errs)
+	}
+}
+
+// waitEqual waits until the replica holds the same records as the source, failing the test if it doesn't happen soon.
+func waitEqual(t *testing.T, source, replica *HashTable) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(tableToMap(source), tableToMap(replica)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica holds %d records, source %d", replica.Len(), source.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	source, replica := New(), New()
+	source.Put("before", "v")
+	stop := source.Replicate(replica)
+
+	for i := 0; i < 1000; i++ {
+		k := "key" + strconv.Itoa(i%100)
+		source.Put(k, strconv.Itoa(i))
+		if i%7 == 0 {
+			source.Del(k)
+		}
+	}
+	waitEqual(t, source, replica)
+
+	stop()
+	stop()
+	source.Put("after", "v")
+	time.Sleep(20 * time.Millisecond)
+	if replica.Has("after") {
+		t.Fatal("a write after stop reached the replica")
+	}
+}
+
+func TestReplicateResync(t *testing.T) {
+	source, replica := New(), New(WithShardCount(1))
+	stop := source.Replicate(replica)
+	defer stop()
+
+	// Stall the replica so that its subscription overflows, then keep writing the same keys so the events dropped are the newest ones.
+	lock := replica.shards()[0].Lock
+	lock.Lock()
+	for i := 0; i < 3*replicaBuffer; i++ {
+		k := "key" + strconv.Itoa(i%50)
+		source.Put(k, strconv.Itoa(i))
+		if i%11 == 0 {
+			source.Del(k)
+		}
+	}
+	lock.Unlock()
+
+	waitEqual(t, source, replica)
+}
+
+func TestDroppedEventsPerSubscription(t *testing.T) {
+	h := New()
+	_, cancelSlow, slow := h.subscribe(0)
+	defer cancelSlow()
+	fastCh, cancelFast, fast := h.subscribe(64)
+	defer cancelFast()
+
+	for i := 0; i < 10; i++ {
+		h.Put("k", strconv.Itoa(i))
+	}
+	if len(fastCh) != 10 {
+		t.Fatalf("fast subscriber received %d events, want 10", len(fastCh))
+	}
+	if d := atomic.LoadUint64(&slow.dropped); d != 10 {
+		t.Fatalf("slow subscription dropped %d events, want 10", d)
+	}
+	if d := atomic.LoadUint64(&fast.dropped); d != 0 {
+		t.Fatalf("fast subscription counts %d drops of the slow one", d)
+	}
+	if h.DroppedEvents() != 10 {
+		t.Fatalf("DroppedEvents = %d, want the total of 10", h.DroppedEvents())
+	}
+}
+
+func TestTopNByIntValue(t *testing.T) {
+	h := New()
+	for i, v := range []int64{5, -3, 42, 17, 0, 99, 8} {
+		h.PutInt("k"+strconv.Itoa(i), v)
+	}
+
+	top, err := h.TopNByIntValue(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Pair{{Key: "k5", Value: "99"}, {Key: "k2", Value: "42"}, {Key: "k3", Value: "17"}}
+	if !reflect.DeepEqual(top, want) {
+		t.Fatalf("TopNByIntValue(3) = %v, want %v", top, want)
+	}
+
+	if all, _ := h.TopNByIntValue(100); len(all) != 7 {
+		t.Fatalf("TopNByIntValue(100) returned %d records, want all 7", len(all))
+	}
+	if none, _ := h.TopNByIntValue(0); len(none) != 0 {
+		t.Fatalf("TopNByIntValue(0) = %v", none)
+	}
+	if all, err := h.TopNByIntValue(math.MaxInt); err != nil || len(all) != 7 || all[0].Value != "99" {
+		t.Fatalf("TopNByIntValue(MaxInt) = %v, %v, want all 7 records", all, err)
+	}
+
+	h.Put("bad", "x")
+	if _, err := h.TopNByIntValue(3); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("TopNByIntValue with a non-numeric value returned %v", err)
+	}
+}
+
+func TestDrainShardClosed(t *testing.T) {
+	var evicted []string
+	h := New(WithOnEvict(func(k, _ string, _ EvictReason) { evicted = append(evicted, k) }))
+	low, _ := keysInShards(h)
+	h.Put(low, "v")
+	h.PutWithTTL(low+"x", "v", time.Nanosecond)
+	events, _ := h.SubscribeAll(16)
+	h.Close()
+	time.Sleep(time.Millisecond)
+
+	i := h.ShardIndex(low)
+	if data := h.DrainShard(i); data == nil || len(data) != 0 {
+		t.Fatalf("DrainShard after Close = %v, want an empty map", data)
+	}
+	if !h.Has(low) {
+		t.Fatal("DrainShard after Close removed a record")
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("DrainShard after Close reported evictions of %q", evicted)
+	}
+	for e := range events {
+		t.Fatalf("DrainShard after Close emitted %+v", e)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	w := &recordingWriter{}
+	h := New(
+		WithWriter(w.write, time.Millisecond),
+		WithBatchedEvents(10, time.Millisecond),
+		WithSoftDelete(time.Minute),
+		WithOrderedIndex(),
+	)
+	replica := New()
+	h.Replicate(replica)
+	batches, _ := h.SubscribeBatches(4)
+	events, _ := h.SubscribeAll(4)
+	go func() {
+		for range batches {
+		}
+	}()
+	for _, k := range testKeys(1000) {
+		h.Put(k, "v")
+	}
+	h.Resize(256)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		for range events {
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines running after Close, %d before New", n, before)
+	}
+
+	h.Put("after", "v")
+	if h.Has("after") {
+		t.Fatal("Put after Close stored a record")
+	}
+	if err := h.TryPut("after", "v"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("TryPut after Close returned %v", err)
+	}
+	if got := len(w.pairs()); got != 1000 {
+		t.Fatalf("the writer received %d records, want all 1000", got)
+	}
+}
+
+func TestClosedLeavesExpiriesAndTombstones(t *testing.T) {
+	h := New(WithSoftDelete(time.Nanosecond))
+	h.PutWithTTL("ttl", "v", time.Hour)
+	h.PutWithTTL("expired", "v", time.Nanosecond)
+	h.PutWithTTI("idle", "v", time.Hour)
+	h.Put("deleted", "v")
+	h.Del("deleted")
+	h.Put("moved", "v")
+	time.Sleep(time.Millisecond)
+	h.Close()
+
+	before, _ := h.TTL("ttl")
+	if h.Touch("ttl", time.Minute) {
+		t.Fatal("Touch after Close returned true")
+	}
+	if v, ok := h.GetAndTouch("ttl", time.Minute); !ok || v != "v" {
+		t.Fatalf("GetAndTouch after Close = %q, %v, want a plain read", v, ok)
+	}
+	if after, _ := h.TTL("ttl"); after > before || after < 59*time.Minute {
+		t.Fatalf("TTL went from %v to %v after Close", before, after)
+	}
+
+	_, idle, _ := h.GetWithMeta("idle")
+	time.Sleep(time.Millisecond)
+	h.Get("idle")
+	if _, meta, _ := h.GetWithMeta("idle"); meta.TTL > idle.TTL {
+		t.Fatal("a Get after Close pushed back the expiry of a PutWithTTI record")
+	}
+
+	if n := h.DeleteExpired(); n != 0 {
+		t.Fatalf("DeleteExpired after Close removed %d records", n)
+	}
+	if len(h.shards()[h.ShardIndex("expired")].expires) == 0 || len(h.shards()[h.ShardIndex("deleted")].tombstones) == 0 {
+		t.Fatal("DeleteExpired after Close swept the expired record or purged the tombstones")
+	}
+	if h.Undelete("deleted") || h.Has("deleted") {
+		t.Fatal("Undelete after Close brought a record back")
+	}
+	if len(h.shards()[h.ShardIndex("deleted")].tombstones) == 0 {
+		t.Fatal("Undelete after Close dropped the tombstone")
+	}
+
+	dst := New()
+	if Move(h, dst, "moved") || dst.Has("moved") || !h.Has("moved") {
+		t.Fatal("Move from a closed hashtable moved the record")
+	}
+}
+
+func TestCloseRacesBackgroundWork(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		h := New(WithBatchedEvents(10, time.Millisecond))
+		for _, k := range testKeys(100) {
+			h.Put(k, "v")
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for _, f := range []func(){
+			func() { h.Resize(64) },
+			func() {
+				batches, _ := h.SubscribeBatches(4)
+				for range batches {
+				}
+			},
+			func() { h.Replicate(New()) },
+			func() { h.StartApplier(make(chan Pair), 2) },
+		} {
+			wg.Add(1)
+			go func(f func()) {
+				defer wg.Done()
+				<-start
+				f()
+			}(f)
+		}
+		close(start)
+		h.Close()
+		wg.Wait()
+
+		// Whatever started before Close was waited for, and nothing can start afterwards.
+		h.Resize(128)
+		if n := len(h.layout().shards); n == 128 {
+			t.Fatal("Resize after Close changed the layout")
+		}
+		if batches, _ := h.SubscribeBatches(4); batches != nil {
+			if _, ok := <-batches; ok {
+				t.Fatal("SubscribeBatches after Close delivered a batch")
+			}
+		}
+		h.StartApplier(make(chan Pair), 1)()
+		replica := New()
+		h.Replicate(replica)()
+		if replica.Len() != 100 {
+			t.Fatalf("Replicate after Close copied %d records, want 100", replica.Len())
+		}
+	}
+}
+
+func TestHashGolden(t *testing.T) {
+	// The values are fixed: if this test fails, shard placements and the dumps relying on them have changed, which is a breaking change.
+	golden := []struct {
+		key  string
+		hash uint32
+	}{
+		{"", 0x811c9dc5},
+		{"a", 0x050c5d7e},
+		{"b", 0x050c5d7d},
+		{"ab", 0x70772d38},
+		{"foo", 0x408f5e13},
+		{"bar", 0x1e99b620},
+		{"hello", 0xb6fa7167},
+		{"Hello", 0x3726bd47},
+		{"hello world", 0x548da96f},
+		{"key-1", 0x7864dce0},
+		{"key-2", 0x7864dce3},
+		{"0", 0x050c5d2f},
+		{"1234567890", 0xe2523a92},
+		{"é", 0xce77c1fd},
+		{"世界", 0x147b30f3},
+		{"日本語のキー", 0x1029f73d},
+		{"🙂", 0xff02decf},
+		{"\x00", 0x050c5d1f},
+		{"a\x00b", 0x659c64cc},
+	}
+	h := New()
+	for _, g := range golden {
+		if got := Hash(g.key); got != g.hash {
+			t.Errorf("Hash(%q) = %#08x, want %#08x", g.key, got, g.hash)
+		}
+
+		ref := fnv.New32()
+		ref.Write([]byte(g.key))
+		if got := ref.Sum32(); got != g.hash {
+			t.Errorf("hash/fnv gives %#08x for %q, the golden value is %#08x", got, g.key, g.hash)
+		}
+
+		if got, want := h.ShardIndex(g.key), int(g.hash%SHARD_COUNT); got != want {
+			t.Errorf("ShardIndex(%q) = %d, want %d", g.key, got, want)
+		}
+	}
+}
+
+func TestValueEquals(t *testing.T) {
+	h := New(WithValueEquals(func(a, b string) bool {
+		return strings.Join(strings.Fields(a), "") == strings.Join(strings.Fields(b), "")
+	}))
+	h.Put("k", `{"a": 1}`)
+
+	if _, swapped := h.CompareAndSwapReturning("k", `{ "a":1 }`, `{"a": 2}`); !swapped {
+		t.Fatal("CompareAndSwapReturning failed with a value equal up to whitespace")
+	}
+	if v, _ := h.Get("k"); v != `{"a": 2}` {
+		t.Fatalf("the value is %q after CompareAndSwapReturning", v)
+	}
+	if _, swapped := h.CompareAndSwapReturning("k", `{"a": 1}`, `{"a": 3}`); swapped {
+		t.Fatal("CompareAndSwapReturning succeeded with a different value")
+	}
+
+	if !h.CompareAndSwapMany(map[string]struct{ Old, New string }{"k": {`{"a":  2}`, `{"a": 4}`}}) {
+		t.Fatal("CompareAndSwapMany failed with a value equal up to whitespace")
+	}
+	if !h.CompareAndSwap("k", `{"a":4}`, `{"a": 4}`) {
+		t.Fatal("CompareAndSwap failed with a value equal up to whitespace")
+	}
+	if h.CompareAndSwap("k", `{"a": 5}`, "x") || h.CompareAndSwap("missing", "", "x") {
+		t.Fatal("CompareAndSwap succeeded with a different value or a missing key")
+	}
+	if !h.HasValue("k", ` { "a" :4} `) || h.HasValue("k", `{"a": 5}`) || h.HasValue("missing", "") {
+		t.Fatal("HasValue didn't compare with the comparator")
+	}
+
+	if keys := h.KeysWithValue(`{"a":4}`); len(keys) != 1 || keys[0] != "k" {
+		t.Fatalf("KeysWithValue = %q", keys)
+	}
+	_, _, unchanged := h.Apply(map[string]string{"k": `{ "a" : 4 }`})
+	if len(unchanged) != 1 {
+		t.Fatal("Apply didn't treat a value equal up to whitespace as unchanged")
+	}
+	if v, _ := h.Get("k"); v != `{"a": 4}` {
+		t.Fatalf("Apply rewrote an unchanged value to %q", v)
+	}
+
+	if h.CompareAndDelete("k", `{"a": 5}`) || !h.Has("k") {
+		t.Fatal("CompareAndDelete deleted a record with a different value")
+	}
+	if !h.CompareAndDelete("k", `{"a":4}`) || h.Has("k") {
+		t.Fatal("CompareAndDelete didn't delete a record with a value equal up to whitespace")
+	}
+	if h.CompareAndDelete("k", `{"a":4}`) {
+		t.Fatal("CompareAndDelete of a missing key returned true")
+	}
+}
+
+func TestValueEqualsDefaultStrict(t *testing.T) {
+	h := New()
+	h.Put("k", `{"a": 1}`)
+
+	if _, swapped := h.CompareAndSwapReturning("k", `{"a":1}`, "x"); swapped {
+		t.Fatal("CompareAndSwapReturning succeeded with a value differing by whitespace")
+	}
+	if h.CompareAndSwap("k", `{"a":1}`, "x") || h.CompareAndDelete("k", `{"a":1}`) || h.HasValue("k", `{"a":1}`) {
+		t.Fatal("CompareAndSwap, CompareAndDelete, or HasValue matched a value differing by whitespace")
+	}
+	if !h.HasValue("k", `{"a": 1}`) {
+		t.Fatal("HasValue didn't match an identical value")
+	}
+	if h.CompareAndSwapMany(map[string]struct{ Old, New string }{"k": {`{"a":1}`, "x"}}) {
+		t.Fatal("CompareAndSwapMany succeeded with a value differing by whitespace")
+	}
+	if keys := h.KeysWithValue(`{"a":1}`); len(keys) != 0 {
+		t.Fatalf("KeysWithValue = %q with a value differing by whitespace", keys)
+	}
+	if _, updated, _ := h.Apply(map[string]string{"k": `{"a":1}`}); len(updated) != 1 {
+		t.Fatal("Apply treated a value differing by whitespace as unchanged")
+	}
+	if _, swapped := h.CompareAndSwapReturning("k", `{"a":1}`, "x"); !swapped {
+		t.Fatal("CompareAndSwapReturning failed with an identical value")
+	}
+}
+
+func TestValueEqualsPanicReleasesLocks(t *testing.T) {
+	calls := 0
+	h := New(
+		WithValueEquals(func(a, b string) bool { calls++; panic("eq") }),
+		WithCallbackPanicHandler(func(interface{}) {}),
+	)
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+
+	mustPanic(t, "KeysWithValue", func() { h.KeysWithValue("v") })
+	checkUnlocked(t, h)
+	mustPanic(t, "Apply", func() { h.Apply(map[string]string{"key0": "v"}) })
+	checkUnlocked(t, h)
+	mustPanic(t, "CompareAndSwapReturning", func() { h.CompareAndSwapReturning("key0", "v", "w") })
+	checkUnlocked(t, h)
+	mustPanic(t, "CompareAndSwapMany", func() {
+		h.CompareAndSwapMany(map[string]struct{ Old, New string }{"key0": {"v", "w"}})
+	})
+	checkUnlocked(t, h)
+	mustPanic(t, "CompareAndSwap", func() { h.CompareAndSwap("key0", "v", "w") })
+	checkUnlocked(t, h)
+	mustPanic(t, "CompareAndDelete", func() { h.CompareAndDelete("key0", "v") })
+	checkUnlocked(t, h)
+	mustPanic(t, "HasValue", func() { h.HasValue("key0", "v") })
+	checkUnlocked(t, h)
+
+	if calls != 7 {
+		t.Fatalf("eq was called %d times, want once per operation", calls)
+	}
+}
+
+func TestStableRange(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(500) {
+		h.Put(k, "v")
+	}
+
+	var keys []string
+	h.StableRange(func(k, _ string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if len(keys) != 500 {
+		t.Fatalf("StableRange visited %d records, want 500", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		a, b := h.ShardIndex(keys[i-1]), h.ShardIndex(keys[i])
+		if a > b || a == b && keys[i-1] >= keys[i] {
+			t.Fatalf("StableRange visited %q (shard %d) before %q (shard %d)", keys[i-1], a, keys[i], b)
+		}
+	}
+
+	var n int
+	h.StableRange(func(string, string) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("StableRange went on for %d records after f returned false", n-10)
+	}
+}
+
+func TestDumpsReproducible(t *testing.T) {
+	keys := testKeys(1000)
+
+	a := New()
+	for _, k := range keys {
+		a.Put(k, "v"+k)
+	}
+
+	// b gets the same contents by another path: reversed insertion order, overwrites, and deletions.
+	b := New()
+	for i := len(keys) - 1; i >= 0; i-- {
+		b.Put(keys[i], "old")
+		b.Put("gone"+keys[i], "v")
+	}
+	for _, k := range keys {
+		b.Put(k, "v"+k)
+		b.Del("gone" + k)
+	}
+
+	dump := func(h *HashTable) ([]byte, []byte) {
+		var d, j bytes.Buffer
+		if err := h.DumpTo(&d); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.EncodeJSON(&j); err != nil {
+			t.Fatal(err)
+		}
+		return d.Bytes(), j.Bytes()
+	}
+
+	dumpA, jsonA := dump(a)
+	dumpB, jsonB := dump(b)
+	if !bytes.Equal(dumpA, dumpB) {
+		t.Fatal("DumpTo wrote different bytes for the same contents")
+	}
+	if !bytes.Equal(jsonA, jsonB) {
+		t.Fatal("EncodeJSON wrote different bytes for the same contents")
+	}
+
+	again, _ := dump(a)
+	if !bytes.Equal(dumpA, again) {
+		t.Fatal("DumpTo wrote different bytes for the same hashtable twice")
+	}
+}
+
+func TestModIndex(t *testing.T) {
+	hashes := []uint32{0, 1, 2, 1 << 31, math.MaxUint32 - 2, math.MaxUint32 - 1, math.MaxUint32}
+	for _, n := range []int{1, 2, 3, 5, 7, 32, 1000, MaxShardCount - 1, MaxShardCount} {
+		for _, hash := range hashes {
+			// The reference is computed in uint64, so it can't overflow or go negative.
+			want := int(uint64(hash) % uint64(n))
+			if got := modIndex(hash, n); got != want {
+				t.Errorf("modIndex(%#x, %d) = %d, want %d", hash, n, got, want)
+			}
+		}
+	}
+
+	// For n not a power of two, masking would give a different index than modulo.
+	if modIndex(math.MaxUint32, 3) != 0 || modIndex(math.MaxUint32, 1000) != 295 {
+		t.Fatal("modIndex doesn't reduce by modulo")
+	}
+}
+
+func TestShardIndexHighHashes(t *testing.T) {
+	// Look for keys whose hashes are within 2^20 of the uint32 maximum, about one key in 4096.
+	var keys []string
+	for i := 0; len(keys) < 10; i++ {
+		k := "k" + strconv.Itoa(i)
+		if Hash(k) >= math.MaxUint32-1<<20 {
+			keys = append(keys, k)
+		}
+	}
+
+	// Shard counts get rounded up to powers of two, the odd ones are covered by TestModIndex.
+	for _, count := range []int{1, 32, 1024, MaxShardCount} {
+		h := New(WithShardCount(count))
+		n := len(h.shards())
+		for _, k := range keys {
+			i := h.ShardIndex(k)
+			if i < 0 || i >= n || i != int(uint64(Hash(k))%uint64(n)) {
+				t.Fatalf("ShardIndex(%q) = %d with %d shards, hash %#x", k, i, n, Hash(k))
+			}
+			h.Put(k, "v")
+			if v, ok := h.Get(k); !ok || v != "v" {
+				t.Fatalf("Get(%q) = %q, %v with %d shards", k, v, ok, n)
+			}
+		}
+	}
+}
+
+func TestMiddlewareCounting(t *testing.T) {
+	var gets, puts, dels int
+	counting := Middleware{
+		Get: func(key string, next func(string) (string, bool)) (string, bool) {
+			gets++
+			return next(key)
+		},
+		Put: func(key, value string, next func(string, string)) {
+			puts++
+			next(key, value)
+		},
+		Del: func(key string, next func(string) (string, bool)) (string, bool) {
+			dels++
+			return next(key)
+		},
+	}
+
+	h := New()
+	m := WithMiddleware(h, counting)
+	for _, k := range testKeys(10) {
+		m.Put(k, "v")
+	}
+	for _, k := range testKeys(20) {
+		m.Get(k)
+	}
+	if v, ok := m.Del("key3"); !ok || v != "v" {
+		t.Fatalf("Del through the middleware returned %q, %v", v, ok)
+	}
+	m.Del("missing")
+
+	if gets != 20 || puts != 10 || dels != 2 {
+		t.Fatalf("the middleware saw %d gets, %d puts, %d dels, want 20, 10, 2", gets, puts, dels)
+	}
+	if h.Len() != 9 {
+		t.Fatalf("the wrapped hashtable holds %d records, want 9", h.Len())
+	}
+	if m.Len() != 9 {
+		t.Fatal("the other operations aren't passed through")
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var trace []string
+	tracing := func(name string) Middleware {
+		return Middleware{
+			Get: func(key string, next func(string) (string, bool)) (string, bool) {
+				trace = append(trace, name+" before")
+				defer func() { trace = append(trace, name+" after") }()
+				return next(key)
+			},
+		}
+	}
+
+	h := New()
+	h.Put("k", "v")
+	m := WithMiddleware(h, tracing("outer"), Middleware{}, tracing("inner"))
+	if v, ok := m.Get("k"); !ok || v != "v" {
+		t.Fatalf("Get through the middlewares returned %q, %v", v, ok)
+	}
+
+	want := []string{"outer before", "inner before", "inner after", "outer after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("the middlewares ran as %q, want %q", trace, want)
+	}
+
+	// An empty Middleware passes Put and Del through.
+	m.Put("p", "1")
+	if _, ok := m.Del("p"); !ok || len(trace) != 4 {
+		t.Fatal("Put and Del didn't pass through middlewares without them")
+	}
+}
+
+func TestGetIfModifiedSince(t *testing.T) {
+	h := New()
+	before := time.Now().Add(-time.Second)
+	h.Put("k", "v1")
+
+	v, modified, ok := h.GetIfModifiedSince("k", before)
+	if !ok || !modified || v != "v1" {
+		t.Fatalf("GetIfModifiedSince before the write = %q, %v, %v", v, modified, ok)
+	}
+
+	after := time.Now().Add(time.Second)
+	v, modified, ok = h.GetIfModifiedSince("k", after)
+	if !ok || modified || v != "" {
+		t.Fatalf("GetIfModifiedSince after the write = %q, %v, %v", v, modified, ok)
+	}
+
+	_, meta, _ := h.GetWithMeta("k")
+	if _, modified, _ := h.GetIfModifiedSince("k", meta.Modified); modified {
+		t.Fatal("GetIfModifiedSince at the exact write time reported a change")
+	}
+	time.Sleep(time.Millisecond)
+	h.Put("k", "v2")
+	if v, modified, _ := h.GetIfModifiedSince("k", meta.Modified); !modified || v != "v2" {
+		t.Fatalf("GetIfModifiedSince after a rewrite = %q, %v", v, modified)
+	}
+
+	v, modified, ok = h.GetIfModifiedSince("missing", before)
+	if ok || modified || v != "" {
+		t.Fatalf("GetIfModifiedSince of an absent key = %q, %v, %v", v, modified, ok)
+	}
+}
+
+func TestReservoirSampleSize(t *testing.T) {
+	h := New()
+	r := rand.New(rand.NewSource(1))
+	if got := h.ReservoirSampleRand(5, r); len(got) != 0 {
+		t.Fatalf("ReservoirSampleRand of an empty hashtable returned %d records", len(got))
+	}
+	for _, k := range testKeys(100) {
+		h.Put(k, "v"+k)
+	}
+
+	for _, k := range []int{-1, 0, 1, 10, 100, 1000, math.MaxInt} {
+		sample := h.ReservoirSampleRand(k, r)
+		if cap(sample) > 100 {
+			t.Fatalf("ReservoirSampleRand(%d) allocated room for %d records, the hashtable has 100", k, cap(sample))
+		}
+		want := k
+		if want < 0 {
+			want = 0
+		}
+		if want > 100 {
+			want = 100
+		}
+		if len(sample) != want {
+			t.Fatalf("ReservoirSampleRand(%d) returned %d records, want %d", k, len(sample), want)
+		}
+
+		seen := make(map[string]bool)
+		for _, p := range sample {
+			if seen[p.Key] || p.Value != "v"+p.Key {
+				t.Fatalf("ReservoirSampleRand(%d) returned %+v, a duplicate or a wrong value", k, p)
+			}
+			seen[p.Key] = true
+		}
+	}
+}
+
+func TestReservoirSampleSeeded(t *testing.T) {
+	h := New(WithShardStore(NewSliceStore))
+	for _, k := range testKeys(500) {
+		h.Put(k, "v")
+	}
+
+	a := h.ReservoirSampleRand(20, rand.New(rand.NewSource(42)))
+	b := h.ReservoirSampleRand(20, rand.New(rand.NewSource(42)))
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("ReservoirSampleRand picked different records with the same seed and an ordered store")
+	}
+	if c := h.ReservoirSampleRand(20, rand.New(rand.NewSource(43))); reflect.DeepEqual(a, c) {
+		t.Fatal("ReservoirSampleRand picked the same records with different seeds")
+	}
+}
+
+func TestReservoirSampleUniform(t *testing.T) {
+	const n, k, runs = 50, 5, 20000
+
+	h := New()
+	for _, key := range testKeys(n) {
+		h.Put(key, "v")
+	}
+
+	r := rand.New(rand.NewSource(7))
+	counts := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		for _, p := range h.ReservoirSampleRand(k, r) {
+			counts[p.Key]++
+		}
+	}
+
+	// Each record is expected runs*k/n = 2000 times, with a standard deviation of about 42, so 10% leaves a wide margin.
+	want := runs * k / n
+	for _, key := range testKeys(n) {
+		if c := counts[key]; c < want*9/10 || c > want*11/10 {
+			t.Fatalf("%s was picked %d times in %d runs, want about %d", key, c, runs, want)
+		}
+	}
+}
+
+// contend makes writers goroutines wait for the lock of the shard holding key, then lets them through.
+func contend(t *testing.T, h *HashTable, key string, writers int) {
+	t.Helper()
+	before := h.ContentionStats()[h.ShardIndex(key)].Contended
+
+	s := h.lockShard(key)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Put(key, "v")
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for h.ContentionStats()[h.ShardIndex(key)].Contended-before < uint64(writers) {
+		if time.Now().After(deadline) {
+			t.Fatal("the writers never waited for the lock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.unlock()
+	wg.Wait()
+}
+
+func TestContentionStats(t *testing.T) {
+	if New().ContentionStats() != nil {
+		t.Fatal("ContentionStats without WithContentionMetrics isn't nil")
+	}
+
+	h := New(WithContentionMetrics())
+	low, high := keysInShards(h)
+	for i := 0; i < 100; i++ {
+		h.Put(high, "v")
+		h.Get(high)
+	}
+	contend(t, h, low, 50)
+
+	stats := h.ContentionStats()
+	if len(stats) != SHARD_COUNT {
+		t.Fatalf("ContentionStats returned %d shards, want %d", len(stats), SHARD_COUNT)
+	}
+	hot, cold := stats[h.ShardIndex(low)], stats[h.ShardIndex(high)]
+	if hot.Contended < 50 || cold.Contended != 0 {
+		t.Fatalf("the contended shard counts %+v, the other one %+v", hot, cold)
+	}
+	if cold.Acquisitions < 200 {
+		t.Fatalf("the uncontended shard counts %d acquisitions, want at least 200", cold.Acquisitions)
+	}
+	for i, s := range stats {
+		if i != h.ShardIndex(low) && s.Contended != 0 {
+			t.Fatalf("shard %d counts %d contended acquisitions", i, s.Contended)
+		}
+	}
+}
+
+func TestRecommendShardCountContention(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	plain := New()
+	h := New(WithContentionMetrics())
+	want := plain.RecommendShardCount()
+	if n := h.RecommendShardCount(); n != want {
+		t.Fatalf("recommended %d shards with WithContentionMetrics before any contention, want %d", n, want)
+	}
+
+	// A few contended acquisitions out of less than minAcquisitions are not enough.
+	low, _ := keysInShards(h)
+	contend(t, h, low, 20)
+	if n := h.RecommendShardCount(); n != want {
+		t.Fatalf("recommended %d shards after a little contention, want %d", n, want)
+	}
+
+	// 100 contended acquisitions out of about 1100 are.
+	for i := 0; i < minAcquisitions; i++ {
+		h.Get(low)
+	}
+	contend(t, h, low, 80)
+	if n := h.RecommendShardCount(); n != 2*SHARD_COUNT {
+		t.Fatalf("recommended %d shards under contention, want %d", n, 2*SHARD_COUNT)
+	}
+
+	// Len finishes the migration, whose acquisitions are counted but not contended.
+	h.Resize(h.RecommendShardCount())
+	h.Len()
+	if n := h.RecommendShardCount(); n != want {
+		t.Fatalf("recommended %d shards after the Resize, want %d since the counts restart", n, want)
+	}
+	var contended uint64
+	for _, s := range h.ContentionStats() {
+		contended += s.Contended
+	}
+	if contended >= 100 {
+		t.Fatalf("the shards count %d contended acquisitions after the Resize, the counts didn't restart", contended)
+	}
+}
+
+func TestIncrementAll(t *testing.T) {
+	h := New()
+	h.PutInt("a", 10)
+	h.PutInt("b", -3)
+
+	got, err := h.IncrementAll(map[string]int64{"a": 5, "b": 3, "new": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"a": 15, "b": 0, "new": 7}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("IncrementAll returned %v, want %v", got, want)
+	}
+	for k, n := range want {
+		if v, _, _ := h.GetInt(k); v != n {
+			t.Fatalf("%s holds %d after IncrementAll, want %d", k, v, n)
+		}
+	}
+
+	if got, err := h.IncrementAll(nil); err != nil || len(got) != 0 {
+		t.Fatalf("IncrementAll(nil) = %v, %v", got, err)
+	}
+}
+
+func TestIncrementAllNotInteger(t *testing.T) {
+	h := New()
+	low, high := keysInShards(h)
+	h.Put(low, "text")
+	h.PutInt(high, 1)
+
+	_, err := h.IncrementAll(map[string]int64{low: 1})
+	if !errors.Is(err, ErrNotInteger) || !strings.Contains(err.Error(), strconv.Quote(low)) {
+		t.Fatalf("IncrementAll of a non-numeric value returned %v, want ErrNotInteger naming %q", err, low)
+	}
+	if v, _ := h.Get(low); v != "text" {
+		t.Fatalf("the failed IncrementAll changed the value to %q", v)
+	}
+
+	// The counters sharing the shard of the bad one are not changed either.
+	var sibling string
+	for i := 0; sibling == ""; i++ {
+		if k := "other" + strconv.Itoa(i); h.ShardIndex(k) == h.ShardIndex(low) {
+			sibling = k
+		}
+	}
+	h.PutInt(sibling, 1)
+	if _, err := h.IncrementAll(map[string]int64{low: 1, sibling: 1}); err == nil {
+		t.Fatal("IncrementAll with a non-numeric value returned no error")
+	}
+	if v, _, _ := h.GetInt(sibling); v != 1 {
+		t.Fatalf("a counter of the failed shard holds %d, want 1", v)
+	}
+}
+
+func TestIncrementAllRefused(t *testing.T) {
+	h := New(WithMaxSize(1))
+	low, high := keysInShards(h)
+	h.PutInt(low, 1)
+
+	if _, err := h.IncrementAll(map[string]int64{high: 1}); !errors.Is(err, ErrCapacity) || !strings.Contains(err.Error(), strconv.Quote(high)) {
+		t.Fatalf("IncrementAll of a rejected counter returned %v, want ErrCapacity naming %q", err, high)
+	}
+	if h.Has(high) {
+		t.Fatal("IncrementAll stored a rejected counter")
+	}
+
+	closed := New()
+	closed.PutInt("k", 1)
+	closed.Close()
+	if _, err := closed.IncrementAll(map[string]int64{"k": 1}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("IncrementAll after Close returned %v, want ErrClosed", err)
+	}
+	if v, _, _ := closed.GetInt("k"); v != 1 {
+		t.Fatalf("IncrementAll after Close changed the counter to %d", v)
+	}
+}
+
+func BenchmarkIncrementAll(b *testing.B) {
+	deltas := make(map[string]int64)
+	for _, k := range testKeys(500) {
+		deltas[k] = 1
+	}
+
+	b.Run("batch", func(b *testing.B) {
+		h := New()
+		for i := 0; i < b.N; i++ {
+			if _, err := h.IncrementAll(deltas); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("loop", func(b *testing.B) {
+		h := New()
+		single := make(map[string]int64, 1)
+		for i := 0; i < b.N; i++ {
+			for k, d := range deltas {
+				single[k] = d
+				if _, err := h.IncrementAll(single); err != nil {
+					b.Fatal(err)
+				}
+				delete(single, k)
+			}
+		}
+	})
+}
+
+func TestHashSeed(t *testing.T) {
+	placement := func(h *HashTable, keys []string) []int {
+		p := make([]int, len(keys))
+		for i, k := range keys {
+			p[i] = h.ShardIndex(k)
+		}
+		return p
+	}
+	keys := testKeys(200)
+
+	a, b := New(WithHashSeed(1)), New(WithHashSeed(1))
+	if !reflect.DeepEqual(placement(a, keys), placement(b, keys)) {
+		t.Fatal("two hashtables with the same seed place the keys differently")
+	}
+	if reflect.DeepEqual(placement(a, keys), placement(New(WithHashSeed(2)), keys)) {
+		t.Fatal("two hashtables with different seeds place the keys the same way")
+	}
+	if !reflect.DeepEqual(placement(New(WithHashSeed(0)), keys), placement(New(), keys)) {
+		t.Fatal("a seed of 0 changes the placement")
+	}
+	if reflect.DeepEqual(placement(New(WithRandomSeed()), keys), placement(New(WithRandomSeed()), keys)) {
+		t.Fatal("two hashtables with random seeds place the keys the same way")
+	}
+
+	for _, k := range keys {
+		a.Put(k, "v"+k)
+	}
+	for _, k := range keys {
+		if v, ok := a.Get(k); !ok || v != "v"+k {
+			t.Fatalf("Get(%q) = %q, %v with a seed", k, v, ok)
+		}
+	}
+}
+
+func TestHashSeedSpreadsCollisions(t *testing.T) {
+	// Keys of the same length crafted to share shard 0 of an unseeded hashtable.
+	plain := New()
+	var crafted []string
+	for i := 10000; len(crafted) < 200; i++ {
+		if k := "k" + strconv.Itoa(i); plain.ShardIndex(k) == 0 {
+			crafted = append(crafted, k)
+		}
+	}
+
+	h := New(WithHashSeed(12345))
+	used := make(map[int]bool)
+	for _, k := range crafted {
+		used[h.ShardIndex(k)] = true
+	}
+	if len(used) < SHARD_COUNT/2 {
+		t.Fatalf("the seeded hashtable puts the crafted keys in %d shards, want them spread", len(used))
+	}
+}
+
+func TestRandomSeedDumpRestore(t *testing.T) {
+	h := New(WithRandomSeed())
+	for _, k := range testKeys(300) {
+		h.Put(k, "v"+k)
+	}
+	var buf bytes.Buffer
+	if err := h.DumpTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored hashtable gets its own seed, so the records get rehashed.
+	restored, err := RestoreFrom(&buf, WithRandomSeed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tableToMap(restored), tableToMap(h)) {
+		t.Fatal("the restored hashtable holds different records")
+	}
+	for _, k := range testKeys(300) {
+		if v, ok := restored.Get(k); !ok || v != "v"+k {
+			t.Fatalf("Get(%q) = %q, %v after the restore", k, v, ok)
+		}
+	}
+}
+
+func TestMGetOrLoadAllHit(t *testing.T) {
+	h := New()
+	h.PutAll(map[string]string{"a": "1", "b": "2"})
+
+	got, err := h.MGetOrLoad([]string{"a", "b", "a"}, func([]string) (map[string]string, error) {
+		t.Fatal("the loader was called without missing keys")
+		return nil, nil
+	})
+	if err != nil || !reflect.DeepEqual(got, map[string]string{"a": "1", "b": "2"}) {
+		t.Fatalf("MGetOrLoad = %v, %v", got, err)
+	}
+}
+
+func TestMGetOrLoadPartialMiss(t *testing.T) {
+	h := New()
+	h.Put("hit", "cached")
+
+	var asked []string
+	got, err := h.MGetOrLoad([]string{"hit", "x", "y", "x", "absent"}, func(missing []string) (map[string]string, error) {
+		asked = missing
+		return map[string]string{"x": "lx", "y": "ly", "hit": "ignored", "other": "ignored"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"hit": "cached", "x": "lx", "y": "ly"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MGetOrLoad = %v, want %v", got, want)
+	}
+	// The loader kept its argument, which must still hold the missing keys.
+	if !reflect.DeepEqual(asked, []string{"x", "y", "absent"}) {
+		t.Fatalf("the loader got %q, want only the missing keys, once each", asked)
+	}
+	for k, v := range want {
+		if stored, _ := h.Get(k); stored != v {
+			t.Fatalf("%s holds %q after MGetOrLoad, want %q", k, stored, v)
+		}
+	}
+	if h.Has("absent") || h.Has("other") {
+		t.Fatal("MGetOrLoad stored a record the loader didn't return for a missing key")
+	}
+}
+
+func TestMGetOrLoadError(t *testing.T) {
+	h := New()
+	h.Put("hit", "v")
+	boom := errors.New("backend down")
+
+	got, err := h.MGetOrLoad([]string{"hit", "miss"}, func([]string) (map[string]string, error) {
+		return map[string]string{"miss": "v"}, boom
+	})
+	if !errors.Is(err, boom) || got != nil {
+		t.Fatalf("MGetOrLoad = %v, %v, want the loader's error", got, err)
+	}
+	if h.Has("miss") {
+		t.Fatal("MGetOrLoad stored a record from a failed load")
+	}
+}
+
+// sealCodec returns a codec encrypting values with AES-GCM, each under a fresh nonce prefixed to the ciphertext.
+func sealCodec(t *testing.T) (encode func(string) string, decode func(string) string) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var counter uint64
+	encode = func(v string) string {
+		nonce := make([]byte, aead.NonceSize())
+		binary.LittleEndian.PutUint64(nonce, atomic.AddUint64(&counter, 1))
+		return string(aead.Seal(nonce, nonce, []byte(v), nil))
+	}
+	decode = func(v string) string {
+		n := aead.NonceSize()
+		plain, err := aead.Open(nil, []byte(v[:n]), []byte(v[n:]), nil)
+		if err != nil {
+			panic(err)
+		}
+		return string(plain)
+	}
+	return encode, decode
+}
+
+func TestValueCodec(t *testing.T) {
+	h := New(WithValueCodec(sealCodec(t)))
+	want := make(map[string]string)
+	for i, k := range testKeys(200) {
+		want[k] = "secret " + strconv.Itoa(i)
+	}
+	h.PutAll(want)
+	h.Put("", "")
+
+	want[""] = ""
+	if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatal("Range doesn't give back the plaintext")
+	}
+	for k, v := range want {
+		if got, ok := h.Get(k); !ok || got != v {
+			t.Fatalf("Get(%q) = %q, %v, want %q", k, got, ok, v)
+		}
+		raw, ok := h.GetRaw(k)
+		if !ok || raw == v || strings.Contains(raw, v) && v != "" {
+			t.Fatalf("GetRaw(%q) = %q, the value isn't encrypted", k, raw)
+		}
+	}
+	if got := h.MGet([]string{"key1", "key2"}); got["key1"] != want["key1"] || got["key2"] != want["key2"] {
+		t.Fatalf("MGet = %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := h.EncodeJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &fromJSON); err != nil || !reflect.DeepEqual(fromJSON, want) {
+		t.Fatal("EncodeJSON doesn't write the plaintext")
+	}
+
+	// A Resize moves the records without decoding them, and they still decode afterwards.
+	raw, _ := h.GetRaw("key7")
+	h.Resize(128)
+	if got, _ := h.GetRaw("key7"); got != raw {
+		t.Fatal("the Resize re-encoded a value")
+	}
+	if got := tableToMap(h); !reflect.DeepEqual(got, want) {
+		t.Fatal("the records don't decode after a Resize")
+	}
+}
+
+func TestValueCodecPanicReleasesLocks(t *testing.T) {
+	var failDecode, failEncode bool
+	h := New(
+		WithValueCodec(
+			func(v string) string {
+				if failEncode {
+					panic("encode")
+				}
+				return "~" + v
+			},
+			func(v string) string {
+				if failDecode {
+					panic("decode")
+				}
+				return v[1:]
+			},
+		),
+		WithOrderedIndex(),
+		WithCallbackPanicHandler(func(interface{}) {}),
+	)
+	keys := testKeys(20 * SHARD_COUNT)
+	refill := func() {
+		for i, k := range keys {
+			h.PutInt(k, int64(i))
+		}
+	}
+
+	reads := map[string]func(){
+		"Get":              func() { h.Get("key1") },
+		"MustGet":          func() { h.MustGet("key1") },
+		"GetByBytes":       func() { h.GetByBytes([]byte("key1")) },
+		"GetVersioned":     func() { h.GetVersioned("key1") },
+		"Has":              func() { h.Has("key1") },
+		"HasAll":           func() { h.HasAll(keys) },
+		"HasAny":           func() { h.HasAny(keys) },
+		"PresenceMask":     func() { h.PresenceMask(keys) },
+		"MGet":             func() { h.MGet(keys) },
+		"MGetConsistent":   func() { h.MGetConsistent(keys) },
+		"MGetGrouped":      func() { h.MGetGrouped(keys) },
+		"KeysWithValue":    func() { h.KeysWithValue("1") },
+		"Range":            func() { h.Range(func(string, string) bool { return true }) },
+		"StableRange":      func() { h.StableRange(func(string, string) bool { return true }) },
+		"RangeSorted":      func() { h.RangeSorted(func(string, string) bool { return true }) },
+		"UnsafeRange":      func() { h.UnsafeRange(func(string, string) bool { return true }) },
+		"Partition":        func() { h.Partition(3) },
+		"ReservoirSample":  func() { h.ReservoirSample(3) },
+		"ShardData":        func() { h.ShardData(0) },
+		"SumInt":           func() { h.SumInt() },
+		"MaxInt":           func() { h.MaxInt() },
+		"TopNByIntValue":   func() { h.TopNByIntValue(3) },
+		"Digest":           func() { h.Digest() },
+		"DumpTo":           func() { h.DumpTo(io.Discard) },
+		"EncodeJSON":       func() { h.EncodeJSON(io.Discard) },
+		"MarshalProto":     func() { h.MarshalProto() },
+		"FirstPage":        func() { h.FirstPage(10) },
+		"GetRange":         func() { h.GetRange("key1", "key5") },
+		"GetOrCompute":     func() { h.GetOrComputeBytes("key1", func() ([]byte, error) { return nil, nil }) },
+		"MGetOrLoad":       func() { h.MGetOrLoad(keys, func([]string) (map[string]string, error) { return nil, nil }) },
+		"DelMany":          func() { h.DelMany(keys[:5]) },
+		"IncrementAll":     func() { h.IncrementAll(map[string]int64{"key1": 1, "key2": 1}) },
+		"Apply":            func() { h.Apply(map[string]string{"key1": "x"}) },
+		"CompareAndSwap":   func() { h.CompareAndSwapReturning("key1", "1", "x") },
+		"DeleteIf":         func() { h.DeleteIf("key1", func(string) bool { return true }) },
+		"Del":              func() { h.Del("key1") },
+		"DrainTo":          func() { h.DrainTo(context.Background(), make(chan Pair, len(keys))) },
+		"Clear":            func() { h.Clear() },
+		"DrainShard":       func() { h.DrainShard(0) },
+		"SelfCheck":        func() { h.SelfCheck() },
+		"GetWithMeta":      func() { h.GetWithMeta("key1") },
+		"GetIfModified":    func() { h.GetIfModifiedSince("key1", time.Time{}) },
+		"CompareAndSwapMn": func() { h.CompareAndSwapMany(map[string]struct{ Old, New string }{"key1": {"1", "x"}}) },
+	}
+	writes := map[string]func(){
+		"Put":               func() { h.Put("key1", "x") },
+		"TryPut":            func() { h.TryPut("key1", "x") },
+		"PutAll":            func() { h.PutAll(map[string]string{"key1": "x", "key2": "x"}) },
+		"PutAllChecked":     func() { h.PutAllChecked(map[string]string{"key1": "x", "key2": "x"}) },
+		"PutIfNotExist":     func() { h.PutIfNotExist("fresh", "x") },
+		"PutAllIfNoneExist": func() { h.PutAllIfNoneExist(map[string]string{"fresh1": "x", "fresh2": "x"}) },
+		"PutWithTTL":        func() { h.PutWithTTL("key1", "x", time.Hour) },
+		"IncrementAll":      func() { h.IncrementAll(map[string]int64{"key1": 1, "key2": 1}) },
+		"Apply":             func() { h.Apply(map[string]string{"key1": "x"}) },
+		"MGetOrLoad": func() {
+			h.MGetOrLoad([]string{"fresh"}, func([]string) (map[string]string, error) { return map[string]string{"fresh": "x"}, nil })
+		},
+	}
+
+	run := func(name string, fail *bool, f func()) {
+		t.Helper()
+		refill()
+		panicked := func() (panicked bool) {
+			defer func() { panicked = recover() != nil }()
+			*fail = true
+			defer func() { *fail = false }()
+			f()
+			return false
+		}()
+		if !panicked {
+			t.Fatalf("%s didn't run the codec", name)
+		}
+		checkUnlocked(t, h)
+		if err := h.SelfCheck(); err != nil {
+			t.Fatalf("after %s: %v", name, err)
+		}
+	}
+	for name, f := range reads {
+		run(name, &failDecode, f)
+	}
+	for name, f := range writes {
+		run(name, &failEncode, f)
+	}
+
+	// Resizing and compacting don't decode anything, so they work even while decode fails.
+	refill()
+	failDecode = true
+	h.Resize(4 * SHARD_COUNT)
+	h.Len()
+	h.Shrink()
+	failDecode = false
+	if got, _, _ := h.GetInt("key1"); got != 1 {
+		t.Fatalf("key1 holds %d after the Resize, want 1", got)
+	}
+}
+
+func TestDelMany(t *testing.T) {
+	var evicted []string
+	h := New(WithOnEvict(func(k, _ string, reason EvictReason) {
+		if reason == EvictDeleted {
+			evicted = append(evicted, k)
+		}
+	}))
+	for _, k := range testKeys(100) {
+		h.Put(k, "v"+k)
+	}
+	h.PutWithTTL("expired", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	keys := append(testKeys(10), "missing", "expired", "key3")
+	removed := h.DelMany(keys)
+
+	want := make(map[string]string)
+	for _, k := range testKeys(10) {
+		want[k] = "v" + k
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Fatalf("DelMany returned %v, want only the existing keys %v", removed, want)
+	}
+	for _, k := range keys {
+		if h.Has(k) {
+			t.Fatalf("%s is still there after DelMany", k)
+		}
+	}
+	if h.Len() != 90 {
+		t.Fatalf("DelMany left %d records, want 90", h.Len())
+	}
+	if len(evicted) != 10 {
+		t.Fatalf("DelMany reported %d deletions, want 10", len(evicted))
+	}
+	if got := h.DelMany(nil); len(got) != 0 {
+		t.Fatalf("DelMany(nil) = %v", got)
+	}
+}
+
+func TestStartApplier(t *testing.T) {
+	h := New()
+	h.Put("doomed", "v")
+
+	in := make(chan Pair)
+	stop := h.StartApplier(in, 4)
+	for i, k := range testKeys(2000) {
+		in <- Pair{Key: k, Value: strconv.Itoa(i)}
+	}
+	in <- Pair{Key: "doomed", Deleted: true}
+	stop()
+	stop()
+
+	for i, k := range testKeys(2000) {
+		if v, ok := h.Get(k); !ok || v != strconv.Itoa(i) {
+			t.Fatalf("%s holds %q, %v after stop, want %d", k, v, ok, i)
+		}
+	}
+	if h.Has("doomed") {
+		t.Fatal("the applier didn't apply a deletion")
+	}
+}
+
+func TestStartApplierBuffered(t *testing.T) {
+	h := New()
+	in := make(chan Pair, 500)
+	for i, k := range testKeys(500) {
+		in <- Pair{Key: k, Value: strconv.Itoa(i)}
+	}
+
+	h.StartApplier(in, 3)()
+	if h.Len() != 500 {
+		t.Fatalf("stop left %d of the 500 buffered pairs unapplied", 500-h.Len())
+	}
+}
+
+func TestStartApplierKeyOrder(t *testing.T) {
+	const keys, writes = 20, 200
+
+	h := New()
+	events, cancel := h.SubscribeAll(keys * writes)
+	defer cancel()
+
+	in := make(chan Pair, 64)
+	stop := h.StartApplier(in, 8)
+	for i := 0; i < writes; i++ {
+		for _, k := range testKeys(keys) {
+			in <- Pair{Key: k, Value: strconv.Itoa(i)}
+		}
+	}
+	stop()
+
+	last := make(map[string]int)
+	for n := 0; n < keys*writes; n++ {
+		e := <-events
+		i, _ := strconv.Atoi(e.NewValue)
+		if prev, ok := last[e.Key]; ok && i != prev+1 {
+			t.Fatalf("%s got value %d after %d", e.Key, i, prev)
+		}
+		last[e.Key] = i
+	}
+	for _, k := range testKeys(keys) {
+		if v, _ := h.Get(k); v != strconv.Itoa(writes-1) {
+			t.Fatalf("%s ends with %q, want the last write", k, v)
+		}
+	}
+}
+
+func TestGetOrZero(t *testing.T) {
+	h := New(WithLoader(func(key string) (string, bool, error) {
+		if key == "loaded" {
+			return "from loader", true, nil
+		}
+		return "", false, nil
+	}))
+	h.Put("k", "v")
+	h.Put("empty", "")
+
+	for key, want := range map[string]string{"k": "v", "empty": "", "missing": "", "loaded": "from loader"} {
+		if got := h.GetOrZero(key); got != want {
+			t.Fatalf("GetOrZero(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if New().GetOrZero("missing") != "" {
+		t.Fatal("GetOrZero of a missing key isn't empty")
+	}
+}
+
+// skewedKeys returns n keys that all belong to the shard with the given index of a default hashtable.
+func skewedKeys(h *HashTable, shard int, n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; len(keys) < n; i++ {
+		if k := "skew" + strconv.Itoa(i); h.ShardIndex(k) == shard {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// countMessages returns how many of the messages of the logger contain sub.
+func countMessages(logger *testLogger, sub string) int {
+	var n int
+	for _, m := range logger.messages() {
+		if strings.Contains(m, sub) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHotShardSplitting(t *testing.T) {
+	var logger testLogger
+	h := New(WithHotShardSplitting(), WithLogger(logger.logf))
+	keys := skewedKeys(h, 5, 4*hotShardMin)
+
+	for _, k := range keys {
+		h.Put(k, "v"+k)
+	}
+	if n := countMessages(&logger, "shard 5 is hot"); n != 1 {
+		t.Fatalf("the hot shard was reported %d times, want once", n)
+	}
+	if n := countMessages(&logger, "split hot shard 5 into 8 sub-shards"); n != 1 {
+		t.Fatalf("the hot shard was split %d times, want once", n)
+	}
+	if got := h.HotShards(); len(got) != 0 {
+		t.Fatalf("HotShards = %v after the split", got)
+	}
+
+	// The keys spread over the hot shard and the 7 sub-shards appended after the 32 shards.
+	used := make(map[int]int)
+	for _, k := range keys {
+		i := h.ShardIndex(k)
+		if i != 5 && (i < SHARD_COUNT || i >= SHARD_COUNT+hotShardFanout-1) {
+			t.Fatalf("ShardIndex(%q) = %d, not a sub-shard of shard 5", k, i)
+		}
+		used[i]++
+	}
+	if len(used) != hotShardFanout {
+		t.Fatalf("the keys use %d sub-shards, want %d", len(used), hotShardFanout)
+	}
+	if got := len(h.layout().shards); got != SHARD_COUNT+hotShardFanout-1 {
+		t.Fatalf("%d shards after the split, want %d", got, SHARD_COUNT+hotShardFanout-1)
+	}
+
+	// Reads and writes keep working on every key.
+	for _, k := range keys {
+		if v, ok := h.Get(k); !ok || v != "v"+k {
+			t.Fatalf("Get(%q) = %q, %v after the split", k, v, ok)
+		}
+	}
+	for _, k := range keys[:hotShardMin] {
+		h.Put(k, "new")
+	}
+	h.DelMany(keys[hotShardMin : 2*hotShardMin])
+	if h.Len() != 3*hotShardMin {
+		t.Fatalf("Len = %d, want %d", h.Len(), 3*hotShardMin)
+	}
+	want := make(map[string]string)
+	for i, k := range keys {
+		switch {
+		case i < hotShardMin:
+			want[k] = "new"
+		case i >= 2*hotShardMin:
+			want[k] = "v" + k
+		}
+	}
+	got := make(map[string]string)
+	h.Range(func(k, v string) bool {
+		got[k] = v
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range visited %d records, want %d", len(got), len(want))
+	}
+	mget := h.MGet(keys)
+	for _, k := range keys {
+		if v, ok := want[k]; mget[k] != v || (!ok && mget[k] != "") {
+			t.Fatalf("MGet(%q) = %q, want %q", k, mget[k], v)
+		}
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dump keeps the layout before the split.
+	var buf bytes.Buffer
+	if err := h.DumpTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Snapshot().data; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the restored hashtable holds %d records, want %d", len(got), len(want))
+	}
+
+	// Resize merges the sub-shards back.
+	h.Resize(64)
+	if got := len(h.layout().shards); got != 64 {
+		t.Fatalf("%d shards after Resize(64), want 64", got)
+	}
+	for k, v := range want {
+		if got, ok := h.Get(k); !ok || got != v {
+			t.Fatalf("Get(%q) = %q, %v after Resize, want %q", k, got, ok, v)
+		}
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotShardSplittingWaitsForLockKey(t *testing.T) {
+	h := New(WithHotShardSplitting())
+	keys := skewedKeys(h, 5, 2*hotShardMin+1)
+	last := keys[len(keys)-1]
+	keys = keys[:len(keys)-1]
+
+	unlock := h.LockKey("other")
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+	if got := h.HotShards(); !reflect.DeepEqual(got, []int{5}) {
+		t.Fatalf("HotShards = %v while a key is locked, want [5]", got)
+	}
+	for _, k := range keys {
+		if i := h.ShardIndex(k); i != 5 {
+			t.Fatalf("ShardIndex(%q) = %d while a key is locked, want 5", k, i)
+		}
+	}
+
+	// The next write adding a key to the hot shard once the lock is released splits it.
+	unlock()
+	h.Put(last, "v")
+	if got := h.HotShards(); len(got) != 0 {
+		t.Fatalf("HotShards = %v after the lock was released", got)
+	}
+	for _, k := range keys {
+		if !h.Has(k) {
+			t.Fatalf("%q is missing after the split", k)
+		}
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotShardSplittingConcurrent(t *testing.T) {
+	h := New(WithHotShardSplitting())
+	keys := skewedKeys(h, 5, 4*hotShardMin)
+
+	// Every writer owns a slice of the keys, checking its own writes while the shard gets split and the hashtable resized.
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(own []string) {
+			defer wg.Done()
+			for round := 0; round < 2; round++ {
+				for _, k := range own {
+					v := k + strconv.Itoa(round)
+					h.Put(k, v)
+					if got, ok := h.Get(k); !ok || got != v {
+						errs <- fmt.Errorf("Get(%q) = %q, %v, want %q", k, got, ok, v)
+						return
+					}
+				}
+			}
+		}(keys[w*len(keys)/writers : (w+1)*len(keys)/writers])
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		h.Resize(64)
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if h.Len() != len(keys) {
+		t.Fatalf("Len = %d, want %d", h.Len(), len(keys))
+	}
+	for _, k := range keys {
+		if v, ok := h.Get(k); !ok || v != k+"1" {
+			t.Fatalf("Get(%q) = %q, %v, want %q", k, v, ok, k+"1")
+		}
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotShardSplittingOff(t *testing.T) {
+	var logger testLogger
+	h := New(WithLogger(logger.logf))
+	keys := skewedKeys(h, 5, 2*hotShardMin)
+	for _, k := range keys {
+		h.Put(k, "v")
+	}
+	if got := h.HotShards(); !reflect.DeepEqual(got, []int{5}) {
+		t.Fatalf("HotShards = %v without WithHotShardSplitting, want [5]", got)
+	}
+	if i := h.ShardIndex(keys[0]); i != 5 {
+		t.Fatalf("ShardIndex = %d without WithHotShardSplitting, want 5", i)
+	}
+	if msgs := logger.messages(); len(msgs) != 0 {
+		t.Fatalf("logged %q without WithHotShardSplitting", msgs)
+	}
+}
+
+func TestPutWithTTI(t *testing.T) {
+	const idle = 50 * time.Millisecond
+
+	h := New()
+	h.PutWithTTI("busy", "v", idle)
+	h.PutWithTTI("idle", "v", idle)
+	h.PutWithTTI("peeked", "v", idle)
+
+	// busy gets read every 10ms for 4 idle windows, the others are left alone, apart from reads that don't count as accesses.
+	deadline := time.Now().Add(4 * idle)
+	for time.Now().Before(deadline) {
+		if _, ok := h.Get("busy"); !ok {
+			t.Fatal("a continually read record expired")
+		}
+		h.Has("peeked")
+		h.MGet([]string{"peeked"})
+		time.Sleep(idle / 5)
+	}
+
+	if _, ok := h.Get("idle"); ok {
+		t.Fatal("an idle record didn't expire after its window")
+	}
+	if _, ok := h.Get("peeked"); ok {
+		t.Fatal("Has and MGet kept a record alive")
+	}
+	if v, err := h.MustGet("busy"); err != nil || v != "v" {
+		t.Fatalf("MustGet of the busy record = %q, %v", v, err)
+	}
+
+	if n := h.DeleteExpired(); n != 2 {
+		t.Fatalf("DeleteExpired removed %d records, want the 2 idle ones", n)
+	}
+
+	time.Sleep(2 * idle)
+	if _, ok := h.Get("busy"); ok {
+		t.Fatal("the busy record didn't expire once it stopped being read")
+	}
+}
+
+func TestPutWithTTIDroppedByWrite(t *testing.T) {
+	h := New()
+	h.PutWithTTI("k", "v", 10*time.Millisecond)
+	h.Put("k", "plain")
+	time.Sleep(20 * time.Millisecond)
+	if v, ok := h.Get("k"); !ok || v != "plain" {
+		t.Fatalf("a plain write didn't drop the idle timeout: %q, %v", v, ok)
+	}
+	if ttl, ok := h.TTL("k"); !ok || ttl != NoTTL {
+		t.Fatalf("TTL = %v, %v after the plain write", ttl, ok)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	keys := testKeys(1000)
+	a, b := New(), New()
+	for _, k := range keys {
+		a.Put(k, "v"+k)
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		b.Put(keys[i], "old")
+		b.Put(keys[i], "v"+keys[i])
+	}
+
+	da := a.Digest()
+	if len(da) != SHARD_COUNT {
+		t.Fatalf("Digest returned %d shards, want %d", len(da), SHARD_COUNT)
+	}
+	if !reflect.DeepEqual(da, b.Digest()) {
+		t.Fatal("the digests depend on the order of the writes")
+	}
+	if !reflect.DeepEqual(da, a.Digest()) {
+		t.Fatal("two digests of the same hashtable differ")
+	}
+
+	b.Put("key42", "changed")
+	db := b.Digest()
+	changed := digestDiff(da, db)
+	if !reflect.DeepEqual(changed, []int{b.ShardIndex("key42")}) {
+		t.Fatalf("changing one value changed the digests of shards %v, want only %d", changed, b.ShardIndex("key42"))
+	}
+
+	// Syncing the shards that differ makes the digests equal again.
+	for _, i := range changed {
+		data, _ := b.ShardData(i)
+		for k, v := range data {
+			a.Put(k, v)
+		}
+	}
+	if !reflect.DeepEqual(a.Digest(), db) {
+		t.Fatal("the digests still differ after copying the differing shards")
+	}
+
+	// Moving bytes between the key and the value changes the digest.
+	c, d := New(WithShardCount(1)), New(WithShardCount(1))
+	c.Put("ab", "c")
+	d.Put("a", "bc")
+	if c.Digest()[0] == d.Digest()[0] {
+		t.Fatal("records differing in where the key ends have the same digest")
+	}
+	if New().Digest()[0] != 0 {
+		t.Fatal("the digest of an empty shard isn't 0")
+	}
+}
+
+// digestDiff returns the shards whose digests differ, in ascending order.
+func digestDiff(a, b map[int]uint64) []int {
+	var diff []int
+	for i := range a {
+		if a[i] != b[i] {
+			diff = append(diff, i)
+		}
+	}
+	sort.Ints(diff)
+	return diff
+}
+
+func TestGetByBytes(t *testing.T) {
+	h := New()
+	h.Put("k", "v")
+	h.Put("", "empty")
+	h.Put("世界", "multibyte")
+
+	for _, k := range []string{"k", "", "世界", "missing"} {
+		wantV, wantOK := h.Get(k)
+		if v, ok := h.GetByBytes([]byte(k)); v != wantV || ok != wantOK {
+			t.Fatalf("GetByBytes(%q) = %q, %v, Get gives %q, %v", k, v, ok, wantV, wantOK)
+		}
+	}
+
+	// Reusing the buffer after the call doesn't change the result.
+	buf := []byte("k")
+	v, _ := h.GetByBytes(buf)
+	buf[0] = 'x'
+	if v != "v" {
+		t.Fatalf("the value changed to %q with the key buffer", v)
+	}
+
+	// The fallbacks store a copy of the key, never the buffer.
+	loaded := New(WithLoader(func(key string) (string, bool, error) { return "loaded", true, nil }))
+	buf = []byte("lazy")
+	if v, ok := loaded.GetByBytes(buf); !ok || v != "loaded" {
+		t.Fatalf("GetByBytes with a loader = %q, %v", v, ok)
+	}
+	copy(buf, "zzzz")
+	if !loaded.Has("lazy") || loaded.Has("zzzz") {
+		t.Fatal("the loaded record was stored under the caller's buffer")
+	}
+}
+
+func TestGetByBytesAllocs(t *testing.T) {
+	h := New()
+	h.Put("key", "value")
+	key := []byte("key")
+	if n := testing.AllocsPerRun(100, func() { h.GetByBytes(key) }); n != 0 {
+		t.Fatalf("GetByBytes allocates %v times per hit", n)
+	}
+	miss := []byte("missing")
+	if n := testing.AllocsPerRun(100, func() { h.GetByBytes(miss) }); n != 0 {
+		t.Fatalf("GetByBytes allocates %v times per miss", n)
+	}
+}
+
+func BenchmarkGetByBytes(b *testing.B) {
+	h := New()
+	keys := testKeys(1000)
+	raw := make([][]byte, len(keys))
+	for i, k := range keys {
+		h.Put(k, "v")
+		raw[i] = []byte(k)
+	}
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.GetByBytes(raw[i%len(raw)])
+		}
+	})
+	b.Run("string", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.Get(string(raw[i%len(raw)]))
+		}
+	})
+}
+
+func TestPutWithWeightEviction(t *testing.T) {
+	var evicted []string
+	h := New(WithShardCount(1), WithMaxSize(100), WithOnEvict(func(k, _ string, reason EvictReason) {
+		if reason == EvictCapacity {
+			evicted = append(evicted, k)
+		}
+	}))
+	for i := 0; i < 50; i++ {
+		h.PutWithWeight("heavy"+strconv.Itoa(i), "v", 10)
+		h.PutWithWeight("light"+strconv.Itoa(i), "v", 1)
+	}
+	for i := 0; i < 40; i++ {
+		h.PutWithWeight("new"+strconv.Itoa(i), "v", 5)
+		if !h.Has("new" + strconv.Itoa(i)) {
+			t.Fatal("a new record was rejected instead of evicting another one")
+		}
+	}
+
+	if h.Len() != 100 || len(evicted) != 40 {
+		t.Fatalf("the hashtable holds %d records after %d evictions, want 100 and 40", h.Len(), len(evicted))
+	}
+	var heavy, light int
+	for i := 0; i < 50; i++ {
+		if h.Has("heavy" + strconv.Itoa(i)) {
+			heavy++
+		}
+		if h.Has("light" + strconv.Itoa(i)) {
+			light++
+		}
+	}
+	if heavy < 45 || light > 25 {
+		t.Fatalf("%d heavy and %d light records survived, the light ones should go first", heavy, light)
+	}
+}
+
+func TestPutWithWeightEqual(t *testing.T) {
+	h := New(WithShardCount(1), WithMaxSize(100))
+	for i := 0; i < 300; i++ {
+		k := "k" + strconv.Itoa(i)
+		h.PutWithWeight(k, "v", 3)
+		if !h.Has(k) {
+			t.Fatalf("%s was rejected with equal weights", k)
+		}
+		if h.Len() > 100 {
+			t.Fatalf("the hashtable grew to %d records past its size of 100", h.Len())
+		}
+	}
+	if h.Len() != 100 {
+		t.Fatalf("the hashtable holds %d records, want 100", h.Len())
+	}
+}
+
+func TestPutWithWeightEvictionSliceStore(t *testing.T) {
+	// The store visits the records in descending order of keys and the heavy ones sort last, so sampling the first records visited would only ever compare heavy ones.
+	h := New(WithShardCount(1), WithMaxSize(100), WithShardStore(NewSliceStore))
+	for i := 0; i < 50; i++ {
+		h.PutWithWeight(fmt.Sprintf("z-heavy%02d", i), "v", 10)
+		h.PutWithWeight(fmt.Sprintf("a-light%02d", i), "v", 1)
+	}
+	for i := 0; i < 40; i++ {
+		h.PutWithWeight(fmt.Sprintf("m-new%02d", i), "v", 5)
+	}
+
+	var heavy, light int
+	for i := 0; i < 50; i++ {
+		if h.Has(fmt.Sprintf("z-heavy%02d", i)) {
+			heavy++
+		}
+		if h.Has(fmt.Sprintf("a-light%02d", i)) {
+			light++
+		}
+	}
+	if h.Len() != 100 || heavy < 45 || light > 25 {
+		t.Fatalf("%d records, %d heavy and %d light survived, the light ones should go first", h.Len(), heavy, light)
+	}
+}
+
+func TestEvictionSliceStoreNotInOrder(t *testing.T) {
+	// The store visits the records in descending order of keys and every new key sorts before the old ones, so evicting the first record visited would evict every old one.
+	h := New(WithShardCount(1), WithMaxSize(100), WithShardStore(NewSliceStore))
+	for i := 0; i < 100; i++ {
+		h.PutWithWeight(fmt.Sprintf("z-old%03d", i), "v", 3)
+	}
+	for i := 0; i < 100; i++ {
+		h.PutWithWeight(fmt.Sprintf("a-new%03d", i), "v", 3)
+	}
+
+	var old int
+	for i := 0; i < 100; i++ {
+		if h.Has(fmt.Sprintf("z-old%03d", i)) {
+			old++
+		}
+	}
+	if h.Len() != 100 || old < 10 {
+		t.Fatalf("%d records, %d of the 100 old ones survived 100 evictions, the victims aren't sampled at random", h.Len(), old)
+	}
+}
+
+func TestPutWithWeightEvictionDefaultShards(t *testing.T) {
+	// With the default store and shard count, every shard fills up and evicts on its own.
+	const size = 32 * 40
+	h := New(WithMaxSize(size))
+	for i := 0; i < size/2; i++ {
+		h.PutWithWeight("heavy"+strconv.Itoa(i), "v", 10)
+		h.PutWithWeight("light"+strconv.Itoa(i), "v", 1)
+	}
+	for i := 0; i < size/4; i++ {
+		h.PutWithWeight("new"+strconv.Itoa(i), "v", 5)
+	}
+
+	var heavy, light int
+	for i := 0; i < size/2; i++ {
+		if h.Has("heavy" + strconv.Itoa(i)) {
+			heavy++
+		}
+		if h.Has("light" + strconv.Itoa(i)) {
+			light++
+		}
+	}
+	if heavy < size/2*9/10 || light > size/2*6/10 {
+		t.Fatalf("%d heavy and %d light records out of %d survived, the light ones should go first", heavy, light, size/2)
+	}
+	if err := h.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRandomPositions(t *testing.T) {
+	for _, c := range []struct{ n, k int }{{1, 1}, {8, 8}, {100, 8}, {1000, 1}} {
+		for round := 0; round < 100; round++ {
+			positions := randomPositions(c.n, c.k)
+			if len(positions) != c.k {
+				t.Fatalf("randomPositions(%d, %d) = %v", c.n, c.k, positions)
+			}
+			for i, p := range positions {
+				if p < 0 || p >= c.n || (i > 0 && p <= positions[i-1]) {
+					t.Fatalf("randomPositions(%d, %d) = %v, not distinct ascending positions", c.n, c.k, positions)
+				}
+			}
+		}
+	}
+}
+
+func TestPutReturningSkipped(t *testing.T) {
+	h := New(WithMaxValueLen(3))
+	h.Put("k", "old")
+	if prev, existed := h.PutReturning("k", "too long"); !existed || prev != "old" {
+		t.Fatalf("PutReturning of a pair over the limits = %q, %v", prev, existed)
+	}
+	if v, _ := h.Get("k"); v != "old" {
+		t.Fatalf("PutReturning stored a pair over the limits: %q", v)
+	}
+
+	full := New(WithMaxSize(1))
+	low, high := keysInShards(full)
+	full.Put(low, "v")
+	if _, existed := full.PutReturning(high, "v"); existed || full.Has(high) {
+		t.Fatal("PutReturning stored a record WithMaxSize had no room for")
+	}
+
+	closed := New()
+	closed.Put("k", "v")
+	closed.Close()
+	if prev, existed := closed.PutReturning("k", "new"); !existed || prev != "v" {
+		t.Fatalf("PutReturning after Close = %q, %v", prev, existed)
+	}
+	if v, _ := closed.Get("k"); v != "v" {
+		t.Fatalf("PutReturning after Close stored %q", v)
+	}
+}
+
+func TestRangeErr(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+
+	boom := errors.New("boom")
+	var visited int
+	err := h.RangeErr(func(k, _ string) error {
+		visited++
+		if k == "key42" {
+			return fmt.Errorf("processing %s: %w", k, boom)
+		}
+		return nil
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("RangeErr returned %v, want the error of f", err)
+	}
+	if visited > 100 {
+		t.Fatalf("RangeErr visited %d records", visited)
+	}
+
+	// f runs with no lock held, and none is left held after the error, so f may write.
+	err = h.RangeErr(func(k, _ string) error {
+		h.Put(k, "seen")
+		return boom
+	})
+	if err != boom {
+		t.Fatalf("RangeErr returned %v", err)
+	}
+	checkUnlocked(t, h)
+
+	visited = 0
+	if err := h.RangeErr(func(string, string) error { visited++; return nil }); err != nil || visited != h.Len() {
+		t.Fatalf("RangeErr returned %v after visiting %d of %d records", err, visited, h.Len())
+	}
+}
+
+func TestRangeErrStops(t *testing.T) {
+	h := New()
+	for _, k := range testKeys(100) {
+		h.Put(k, "v")
+	}
+	var visited int
+	h.RangeErr(func(string, string) error {
+		visited++
+		if visited == 10 {
+			return io.EOF
+		}
+		return nil
+	})
+	if visited != 10 {
+		t.Fatalf("RangeErr went on for %d records after the error", visited-10)
+	}
+}
@@ -0,0 +1,45 @@
+package cmap
+
+// codecStore wraps the store of a shard to pass values through the codec of WithValueCodec: they are encoded on the way in and decoded on the way out, so the rest of the hashtable only ever sees plain values.
+type codecStore struct {
+	store  ShardStore
+	encode func(string) string
+	decode func(string) string
+}
+
+func (c *codecStore) Get(key string) (string, bool) {
+	v, ok := c.store.Get(key)
+	if !ok {
+		return "", false
+	}
+	return c.decode(v), true
+}
+
+func (c *codecStore) Set(key string, value string) {
+	c.store.Set(key, c.encode(value))
+}
+
+func (c *codecStore) Delete(key string) {
+	c.store.Delete(key)
+}
+
+func (c *codecStore) Len() int {
+	return c.store.Len()
+}
+
+func (c *codecStore) Range(f func(key string, value string) bool) {
+	c.store.Range(func(k, v string) bool {
+		return f(k, c.decode(v))
+	})
+}
+
+// GetRaw returns the value of the key as it is stored, without decoding it, for inspecting what WithValueCodec actually keeps in memory. Without a codec it is the same as Get, minus the loader and the access counting.
+func (h HashTable) GetRaw(key string) (string, bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	if _, ok := shard.get(key); !ok {
+		return "", false
+	}
+	return shard.raw().Get(key)
+}
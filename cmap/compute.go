@@ -0,0 +1,56 @@
+package cmap
+
+// GetOrComputeUnlocked returns the value of the key, computing it with f and storing it if the key doesn't exist. f runs without holding any lock, so the other keys of the shard stay readable and writable while it runs, and f may use the hashtable. Concurrent calls for the same missing key share a single call of f. It returns true if the value was computed, by this call or by the one it waited for, and false if the key already existed. If the key gets stored by someone else while f runs, that value wins and is returned with false. If f panics, the panic goes on in the caller that ran it, while the callers that waited for it start over, so one of them calls its own f.
+func (h HashTable) GetOrComputeUnlocked(key string, f func() string) (string, bool) {
+	for {
+		v, computed, err := h.compute(key, func() (string, error) {
+			return f(), nil
+		})
+		// f never fails, so an error means the call waited for panicked.
+		if err == nil {
+			return v, computed
+		}
+	}
+}
+
+// GetOrComputeBytes is like GetOrComputeUnlocked for binary values: a missing key is computed by f, outside of any lock and once for all the concurrent callers, and every caller gets its own copy of the value. If f fails, nothing is stored and its error is returned to all the callers that waited for it. If f panics, the panic goes on in the caller that ran it, and the callers that waited for it get an error wrapping ErrComputePanicked.
+func (h HashTable) GetOrComputeBytes(key string, f func() ([]byte, error)) ([]byte, error) {
+	v, _, err := h.compute(key, func() (string, error) {
+		b, err := f()
+		return string(b), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+// compute returns the value of the key, computing it with f and storing it if the key doesn't exist, sharing the call of f with concurrent calls for the same key. It reports whether the value was computed. If f fails, nothing is stored.
+func (h HashTable) compute(key string, f func() (string, error)) (string, bool, error) {
+	if v, ok, _ := h.peek(key); ok {
+		return v, false, nil
+	}
+
+	v, computed, err, _ := h.computes.do(key, func() (string, bool, error) {
+		if v, ok, _ := h.peek(key); ok {
+			return v, false, nil
+		}
+
+		v, err := f()
+		if err != nil {
+			return "", false, err
+		}
+
+		shard := h.lockShard(key)
+		defer shard.unlock()
+
+		if current, exists := h.live(shard, key); exists {
+			return current, false, nil
+		}
+		if h.checkLimits(key, v) == nil {
+			h.set(shard, key, v)
+		}
+		return v, true, nil
+	})
+	return v, computed, err
+}
@@ -0,0 +1,42 @@
+package cmap
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+)
+
+// Digest returns a 64-bit digest of the records of every shard, keyed by shard index, for finding which shards of two hashtables differ without comparing their records: only the shards whose digests differ need to be fetched, e.g. with ShardData. A shard's digest is the XOR of the FNV-1a hashes of its records, so it doesn't depend on the order the records were written in, and an empty shard has a digest of 0. Hashtables to compare must place keys alike, with the same number of shards and the same hashing, or their digests can't match. Expired records are left out. Each shard is read under its read lock. The digests are meant for detecting accidental differences, not tampering.
+func (h HashTable) Digest() map[int]uint64 {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	digests := make(map[int]uint64, len(shards))
+	hasher := fnv.New64a()
+	for i, shard := range shards {
+		var digest uint64
+
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				digest ^= recordHash(hasher, k, v)
+				return true
+			})
+		})
+
+		digests[i] = digest
+	}
+	return digests
+}
+
+// recordHash returns the hash of the record, computed with hasher. The key is prefixed by its length, so that moving bytes between key and value changes the hash.
+func recordHash(hasher hash.Hash64, key string, value string) uint64 {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(key)))
+
+	hasher.Reset()
+	hasher.Write(n[:])
+	hasher.Write([]byte(key))
+	hasher.Write([]byte(value))
+	return hasher.Sum64()
+}
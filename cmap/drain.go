@@ -0,0 +1,61 @@
+package cmap
+
+import "context"
+
+// DrainTo moves every record of the hashtable to out, one shard at a time, for streaming it somewhere else. Each record is sent while no lock is held, blocking until out takes it, and is deleted only once sent, so a slow receiver slows down the drain instead of losing records. A record written again while being sent keeps its new value in the hashtable. The removals are reported to the eviction callback with EvictMoved. If ctx is done before the drain finishes, it returns ctx.Err() and the records not sent yet stay in the hashtable, so the drain can be resumed by calling it again. Records added while it runs may or may not be drained.
+func (h HashTable) DrainTo(ctx context.Context, out chan<- Pair) error {
+	for i := 0; ; i++ {
+		keys, ok := h.shardKeys(i)
+		if !ok {
+			return nil
+		}
+
+		for _, k := range keys {
+			v, version, ok := h.GetVersioned(k)
+			if !ok {
+				continue
+			}
+
+			select {
+			case out <- Pair{Key: k, Value: v}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			h.delVersion(k, version, EvictMoved)
+		}
+	}
+}
+
+// delVersion deletes the record of the key if it still has the given version, reporting the removal with reason.
+func (h HashTable) delVersion(key string, version uint64, reason EvictReason) {
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if _, ok := h.live(shard, key); ok && shard.versions[key] == version {
+		h.del(shard, key, reason)
+	}
+}
+
+// shardKeys returns the keys of the records held by the shard with the given index, or false if the index is out of range.
+func (h HashTable) shardKeys(i int) ([]string, bool) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	if i >= len(shards) {
+		return nil, false
+	}
+
+	shard := shards[i]
+
+	shard.Lock.RLock()
+	defer shard.Lock.RUnlock()
+
+	keys := make([]string, 0, shard.Data.Len())
+	shard.each(func(k, _ string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys, true
+}
@@ -0,0 +1,133 @@
+package cmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The dump format starts with the number of shards as a uvarint. Each shard follows as a block: the length of the block in bytes as a uvarint, then its records, each being a uvarint length and the bytes of the key followed by the same for the value. Blocks appear in ascending order of shard index. The sub-shards of a shard split by WithHotShardSplitting are written as the block of that shard, so the dump has the layout of the hashtable before any split.
+
+var errDumpTruncated = fmt.Errorf("%w: truncated dump", ErrInvalidEncoding)
+
+// DumpTo writes the records of the hashtable to w, keeping the shard layout so that RestoreFrom can place them without rehashing. Each shard is encoded under its read lock and written after the lock is released. TTLs and versions are not kept. Records are written in ascending order of shard index and, within each shard, of keys, the order of StableRange before any split, so equal contents always give the same bytes.
+func (h HashTable) DumpTo(w io.Writer) error {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	l := h.layout()
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(l.primaries))
+	if _, err := w.Write(header[:n]); err != nil {
+		return err
+	}
+
+	var block []byte
+	var pairs []Pair
+	for i, shard := range shards[:l.primaries] {
+		block = block[:0]
+
+		sub, ok := l.split[i]
+		if !ok {
+			shard.read(func() {
+				shard.eachSorted(func(k, v string) bool {
+					block = appendDumpRecord(block, k, v)
+					return true
+				})
+			})
+		} else {
+			pairs = pairs[:0]
+			for _, j := range sub {
+				shards[j].read(func() {
+					shards[j].each(func(k, v string) bool {
+						pairs = append(pairs, Pair{Key: k, Value: v})
+						return true
+					})
+				})
+			}
+			sort.Slice(pairs, func(a, b int) bool { return pairs[a].Key < pairs[b].Key })
+			for _, p := range pairs {
+				block = appendDumpRecord(block, p.Key, p.Value)
+			}
+		}
+
+		n := binary.PutUvarint(header[:], uint64(len(block)))
+		if _, err := w.Write(header[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendDumpRecord appends a record to a block of the dump.
+func appendDumpRecord(block []byte, key string, value string) []byte {
+	block = appendProtoVarint(block, uint64(len(key)))
+	block = append(block, key...)
+	block = appendProtoVarint(block, uint64(len(value)))
+	return append(block, value...)
+}
+
+// RestoreFrom reads a dump written by DumpTo and returns a new hashtable holding its records. The hashtable gets the shard count of the dump, and the given options are applied after it. As long as the records still belong to the shard they were dumped from, they are placed there directly. Otherwise, e.g. if the options change the shard count or the hashing, they are rehashed.
+func RestoreFrom(r io.Reader, opts ...Option) (*HashTable, error) {
+	br := bufio.NewReader(r)
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errDumpTruncated
+	}
+	if count == 0 || count > MaxShardCount {
+		return nil, fmt.Errorf("%w: dump has %d shards", ErrInvalidEncoding, count)
+	}
+
+	ht := New(append([]Option{WithShardCount(int(count))}, opts...)...)
+	shards := ht.shards()
+
+	// The block is read into a buffer that only grows as its bytes arrive, so a corrupted size can't make it allocate more than the dump holds.
+	var buf bytes.Buffer
+	for i := 0; i < int(count); i++ {
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size > math.MaxInt64 {
+			return nil, errDumpTruncated
+		}
+		buf.Reset()
+		if _, err := io.CopyN(&buf, br, int64(size)); err != nil {
+			return nil, errDumpTruncated
+		}
+		block := buf.Bytes()
+
+		for len(block) > 0 {
+			k, n := consumeProtoBytes(block)
+			if n < 0 {
+				return nil, errDumpTruncated
+			}
+			block = block[n:]
+
+			v, n := consumeProtoBytes(block)
+			if n < 0 {
+				return nil, errDumpTruncated
+			}
+			block = block[n:]
+
+			key := string(k)
+			if len(shards) != int(count) || ht.ShardIndex(key) != i {
+				ht.Put(key, string(v))
+				continue
+			}
+
+			shard := shards[i]
+			shard.runHooks(shard.write(func() {
+				ht.set(shard, key, string(v))
+			}))
+		}
+	}
+	return ht, nil
+}
@@ -0,0 +1,31 @@
+package cmap
+
+import "errors"
+
+// Errors returned by the hashtable. They are wrapped with context, so check for them with errors.Is.
+var (
+	// ErrKeyNotFound is returned when a required key doesn't exist.
+	ErrKeyNotFound = errors.New("cmap: key not found")
+	// ErrLockTimeout is returned by LockKeyTimeout when the lock of the key couldn't be taken in time.
+	ErrLockTimeout = errors.New("cmap: lock timeout")
+	// ErrOverwriteDenied is returned by Insert when the key already exists.
+	ErrOverwriteDenied = errors.New("cmap: key already exists")
+	// ErrComputePanicked is returned to the callers waiting for a computation shared with them, like the one of GetOrComputeBytes or of the loader of WithLoader, when it panicked.
+	ErrComputePanicked = errors.New("cmap: computation panicked")
+	// ErrNotInteger is returned when a value that should be an integer can't be parsed as one.
+	ErrNotInteger = errors.New("cmap: value is not an integer")
+	// ErrKeyTooLong is returned when a key is longer than the limit set by WithMaxKeyLen.
+	ErrKeyTooLong = errors.New("cmap: key too long")
+	// ErrValueTooLong is returned when a value is longer than the limit set by WithMaxValueLen.
+	ErrValueTooLong = errors.New("cmap: value too long")
+	// ErrCapacity is returned when a new record can't be added because the hashtable is at the size set by WithMaxSize and nothing could be evicted to make room.
+	ErrCapacity = errors.New("cmap: at capacity")
+	// ErrLockLeak is returned by CheckNoLeaks when some key locks haven't been released.
+	ErrLockLeak = errors.New("cmap: key lock leaked")
+	// ErrCorrupted is returned by SelfCheck when the internal state of the hashtable is inconsistent.
+	ErrCorrupted = errors.New("cmap: inconsistent state")
+	// ErrClosed is returned by writes to a hashtable that has been closed.
+	ErrClosed = errors.New("cmap: hashtable closed")
+	// ErrInvalidEncoding is returned when decoding a protobuf message or a dump fails.
+	ErrInvalidEncoding = errors.New("cmap: invalid encoding")
+)
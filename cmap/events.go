@@ -0,0 +1,208 @@
+package cmap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is the kind of a mutation reported by an Event.
+type Op int
+
+const (
+	// OpPut means a record was added or overwritten.
+	OpPut Op = iota + 1
+	// OpDel means a record was removed, for whatever reason.
+	OpDel
+)
+
+// String returns the name of the operation.
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpDel:
+		return "del"
+	}
+	return "unknown"
+}
+
+// Event describes a single mutation of the hashtable. OldValue is empty for a new record and NewValue is empty for a removal.
+type Event struct {
+	Op       Op
+	Key      string
+	OldValue string
+	NewValue string
+}
+
+// subscribers keeps the channels that receive the events of a hashtable.
+type subscribers struct {
+	count   int32  // accessed atomically, lets emit skip the lock when nobody listens.
+	dropped uint64 // accessed atomically, the total of every subscription.
+
+	mu   sync.RWMutex
+	subs map[chan Event]*subscription
+}
+
+// subscription is the state kept for each channel of SubscribeAll.
+type subscription struct {
+	dropped uint64 // accessed atomically, the events dropped because this channel was full.
+}
+
+// SubscribeAll returns a channel receiving an event for every mutation of the hashtable, along with a function that unsubscribes and closes the channel. Events are sent without blocking while the shard lock is held, so events of the same key arrive in order. If the channel's buffer is full the event is dropped and counted by DroppedEvents, so a slow subscriber never stalls writers. Closing the hashtable closes the channel too, right away if it is already closed.
+func (h HashTable) SubscribeAll(buffer int) (<-chan Event, func()) {
+	ch, cancel, _ := h.subscribe(buffer)
+	return ch, cancel
+}
+
+// subscribe is SubscribeAll, also returning the subscription counting the events dropped for this channel alone.
+func (h HashTable) subscribe(buffer int) (<-chan Event, func(), *subscription) {
+	ch := make(chan Event, buffer)
+	sub := &subscription{}
+
+	h.subs.mu.Lock()
+	if h.isClosed() {
+		h.subs.mu.Unlock()
+		close(ch)
+		return ch, func() {}, sub
+	}
+	if h.subs.subs == nil {
+		h.subs.subs = make(map[chan Event]*subscription)
+	}
+	h.subs.subs[ch] = sub
+	atomic.AddInt32(&h.subs.count, 1)
+	h.subs.mu.Unlock()
+
+	cancel := func() {
+		h.subs.mu.Lock()
+		defer h.subs.mu.Unlock()
+
+		if _, ok := h.subs.subs[ch]; ok {
+			delete(h.subs.subs, ch)
+			atomic.AddInt32(&h.subs.count, -1)
+			close(ch)
+		}
+	}
+	return ch, cancel, sub
+}
+
+// closeAll unsubscribes every subscriber and closes its channel.
+func (s *subscribers) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		atomic.AddInt32(&s.count, -1)
+		close(ch)
+	}
+}
+
+// SubscribeBatches is like SubscribeAll, but delivers the events in batches as configured by WithBatchedEvents. Up to buffer batches are kept waiting for the subscriber, and events that don't fit behind them are dropped and counted by DroppedEvents. Closing the hashtable flushes the pending batch and closes the channel, so the subscriber should keep reading until then. The returned function unsubscribes, drops any pending events, and closes the channel.
+func (h HashTable) SubscribeBatches(buffer int) (<-chan []Event, func()) {
+	maxBatch, maxDelay := h.opts.maxBatch, h.opts.maxBatchDelay
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+
+	in, unsubscribe := h.SubscribeAll(buffer * maxBatch)
+	out := make(chan []Event, buffer)
+	stop := make(chan struct{})
+
+	if !h.startWorker() {
+		unsubscribe()
+		close(out)
+		return out, func() {}
+	}
+	go func() {
+		defer h.workers.Done()
+		defer close(out)
+
+		var batch []Event
+		var timer *time.Timer
+		var deadline <-chan time.Time
+
+		flush := func() bool {
+			if timer != nil {
+				timer.Stop()
+				timer, deadline = nil, nil
+			}
+			if len(batch) == 0 {
+				return true
+			}
+			select {
+			case out <- batch:
+				batch = nil
+				return true
+			case <-stop:
+				return false
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-in:
+				if !ok {
+					return
+				}
+				batch = append(batch, e)
+				if len(batch) == 1 && maxBatch > 1 && maxDelay > 0 {
+					timer = time.NewTimer(maxDelay)
+					deadline = timer.C
+				}
+				if len(batch) >= maxBatch && !flush() {
+					return
+				}
+			case <-deadline:
+				if !flush() {
+					return
+				}
+			case <-h.closed:
+				unsubscribe()
+				for e := range in {
+					batch = append(batch, e)
+					if len(batch) >= maxBatch && !flush() {
+						return
+					}
+				}
+				flush()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(stop)
+			unsubscribe()
+		})
+	}
+	return out, cancel
+}
+
+// DroppedEvents returns the number of events dropped because a subscriber's channel was full, summed over every subscriber, including the ones of SubscribeBatches and Replicate.
+func (h HashTable) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&h.subs.dropped)
+}
+
+// emit sends the event to every subscriber without blocking. The caller must hold the write lock of the shard holding the key.
+func (h HashTable) emit(e Event) {
+	if atomic.LoadInt32(&h.subs.count) == 0 {
+		return
+	}
+
+	h.subs.mu.RLock()
+	defer h.subs.mu.RUnlock()
+
+	for ch, sub := range h.subs.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&h.subs.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package cmap
+
+// EvictReason tells why a record was removed from the hashtable.
+type EvictReason int
+
+const (
+	// EvictDeleted means the record was removed explicitly, e.g. by Del.
+	EvictDeleted EvictReason = iota + 1
+	// EvictCleared means the record was removed by Clear.
+	EvictCleared
+	// EvictExpired means the record was removed because its TTL ran out.
+	EvictExpired
+	// EvictMoved means the record was moved out of the hashtable, by Move or DrainTo, so its value is still in use.
+	EvictMoved
+	// EvictCapacity means the record was evicted to make room for a new one, because the hashtable was at the size set by WithMaxSize.
+	EvictCapacity
+)
+
+// String returns the name of the reason.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictDeleted:
+		return "deleted"
+	case EvictCleared:
+		return "cleared"
+	case EvictExpired:
+		return "expired"
+	case EvictMoved:
+		return "moved"
+	case EvictCapacity:
+		return "capacity"
+	}
+	return "unknown"
+}
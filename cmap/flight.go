@@ -0,0 +1,54 @@
+package cmap
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flight is a computation in progress for a key, which the goroutines asking for the same key wait for instead of repeating it.
+type flight struct {
+	done  chan struct{}
+	value string
+	ok    bool
+	err   error
+}
+
+// flights de-duplicates concurrent computations per key.
+type flights struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// do runs f for the key unless a call for the same key is already in progress, in which case it waits for that call and returns its result. It reports whether f was run by this call. If f panics, the panic goes on in the goroutine that ran it, while the goroutines waiting for it get ErrComputePanicked.
+func (g *flights) do(key string, f func() (string, bool, error)) (value string, ok bool, err error, leader bool) {
+	g.mu.Lock()
+	if c, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		<-c.done
+		return c.value, c.ok, c.err, false
+	}
+
+	c := &flight{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// The call is released even if f panics, so the waiters don't block forever, and they are told it failed.
+	var returned bool
+	defer func() {
+		if !returned {
+			c.value, c.ok, c.err = "", false, fmt.Errorf("%w: key %q", ErrComputePanicked, key)
+		}
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.ok, c.err = f()
+	returned = true
+	return c.value, c.ok, c.err, true
+}
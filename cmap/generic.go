@@ -0,0 +1,133 @@
+package cmap
+
+import (
+	"fmt"
+	"sync"
+)
+
+type shardV[V any] struct {
+	Lock sync.RWMutex
+	Data map[string]V
+}
+
+// HashTableV is a thread-safe concurrent hashtable from string keys to values of any type. It shards the keys using FNV32 exactly like HashTable, over SHARD_COUNT shards.
+type HashTableV[V any] []*shardV[V]
+
+// NewV initializes and returns a hashtable with values of type V.
+func NewV[V any]() *HashTableV[V] {
+	ht := make(HashTableV[V], SHARD_COUNT)
+	for i := 0; i < SHARD_COUNT; i++ {
+		ht[i] = &shardV[V]{Data: make(map[string]V)}
+	}
+	return &ht
+}
+
+// FromV gets a normal map, constructs, and returns a thread-safe concurrent hashtable out of its records.
+func FromV[V any](data map[string]V) *HashTableV[V] {
+	ht := NewV[V]()
+	for k, v := range data {
+		ht.Put(k, v)
+	}
+	return ht
+}
+
+// Get returns true and the value associated with the key. If it doesn't exist, it will return the zero value and false.
+func (h HashTableV[V]) Get(key string) (V, bool) {
+	shard := h.getShard(key)
+
+	shard.Lock.RLock()
+	defer shard.Lock.RUnlock()
+
+	v, ok := shard.Data[key]
+
+	return v, ok
+}
+
+// GetOrZero returns the value associated with the key, or the zero value of V if it doesn't exist.
+func (h HashTableV[V]) GetOrZero(key string) V {
+	v, _ := h.Get(key)
+	return v
+}
+
+// MustGet returns the value associated with the key. If it doesn't exist, it will return an error mentioning the key.
+func (h HashTableV[V]) MustGet(key string) (V, error) {
+	v, ok := h.Get(key)
+	if !ok {
+		return v, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	return v, nil
+}
+
+// Put adds a new key-value pair to the hashtable. If there is already a record with a key same as the given key, the value will be overridden.
+func (h HashTableV[V]) Put(key string, value V) {
+	shard := h.getShard(key)
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	shard.Data[key] = value
+}
+
+// PutIfNotExist will add a new key-value pair only if no record with the same key exists. It returns true if the new record added successfully.
+func (h HashTableV[V]) PutIfNotExist(key string, value V) bool {
+	shard := h.getShard(key)
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	_, ok := shard.Data[key]
+	if !ok {
+		shard.Data[key] = value
+	}
+
+	return !ok
+}
+
+// Del deletes the record associated with the given key. If the deletion was successful it will return the removed value and true. If the record didn't exist, it will return false.
+func (h HashTableV[V]) Del(key string) (V, bool) {
+	shard := h.getShard(key)
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	v, ok := shard.Data[key]
+	delete(shard.Data, key)
+
+	return v, ok
+}
+
+// Has returns true if the hashtable contains a record with a key same as the given key.
+func (h HashTableV[V]) Has(key string) bool {
+	_, ok := h.Get(key)
+	return ok
+}
+
+// Len returns the number of key-value pairs stored in the hashtable.
+func (h HashTableV[V]) Len() int {
+	var count int
+	for _, shard := range h {
+		shard.Lock.RLock()
+		count += len(shard.Data)
+		shard.Lock.RUnlock()
+	}
+	return count
+}
+
+// Clear removes all the records from the hashtable. The shards get cleared one at a time.
+func (h HashTableV[V]) Clear() {
+	for _, shard := range h {
+		shard.Lock.Lock()
+		shard.Data = make(map[string]V)
+		shard.Lock.Unlock()
+	}
+}
+
+// ShardIndex returns the index of the shard that holds the given key. It doesn't lock anything.
+func (h HashTableV[V]) ShardIndex(key string) int {
+	return modIndex(fnv32(key), len(h))
+}
+
+// getShard returns the shard that holds the given key.
+func (h HashTableV[V]) getShard(key string) *shardV[V] {
+	return h[h.ShardIndex(key)]
+}
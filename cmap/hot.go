@@ -0,0 +1,139 @@
+package cmap
+
+import "sync/atomic"
+
+const (
+	// hotShardFactor is how many times the average number of records per shard a shard must hold to count as hot.
+	hotShardFactor = 8
+	// hotShardMin is the number of records a shard must hold to count as hot, so that small hashtables don't get flagged.
+	hotShardMin = 1024
+	// hotShardFanout is the number of sub-shards WithHotShardSplitting splits a hot shard into.
+	hotShardFanout = 8
+)
+
+// isHot reports whether a shard of the given size is hot in a hashtable of the given size and number of shards.
+func isHot(shardSize, size, shards int) bool {
+	return shardSize >= hotShardMin && float64(shardSize) > hotShardFactor*float64(size)/float64(shards)
+}
+
+// checkHot updates the hot flag of the shard after its size changed, and reports the shard to the logger when it becomes hot. While a hot shard isn't part of a split yet, it queues its split on the shard. The caller must hold the shard's write lock.
+func (h HashTable) checkHot(s *shard, size int) {
+	shards := h.layout().shards
+	hot := isHot(s.Data.Len(), size, len(shards))
+	if hot && atomic.LoadUint32(&s.grouped) == 0 {
+		s.hooks = append(s.hooks, func() { h.split(s) })
+	}
+	if hot == s.hot {
+		return
+	}
+	s.hot = hot
+	if !hot {
+		return
+	}
+
+	for i, other := range shards {
+		if other == s {
+			h.logf(s, "cmap: shard %d is hot, holding %d of %d records", i, s.Data.Len(), size)
+			return
+		}
+	}
+}
+
+// split splits the hot shard s into hotShardFanout sub-shards for WithHotShardSplitting: s stays the first one and the others are appended to the shards of a new layout, while the primary shards keep their indexes. It does nothing if s isn't a primary shard of the current layout anymore, was split already, or cooled down meanwhile. It changes the ShardIndex of the keys it moves, so it gives up if a lock of LockKey is held, leaving the split to a later write adding or removing a key of s. The records are moved under the write locks of layoutMu and of s, into sub-shards nobody can reach before the new layout is stored, so no lock is held while waiting for another.
+func (h HashTable) split(s *shard) {
+	if atomic.LoadUint32(&s.grouped) == 1 || h.isClosed() {
+		return
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	if !h.keyLocks.idle() {
+		return
+	}
+	defer h.keyLocks.mu.Unlock()
+
+	h.layoutMu.Lock()
+	defer h.layoutMu.Unlock()
+
+	shards := h.shards()
+	l := h.layout()
+	p := -1
+	for i, other := range shards[:l.primaries] {
+		if other == s {
+			p = i
+			break
+		}
+	}
+	if _, ok := l.split[p]; p < 0 || ok {
+		return
+	}
+
+	hooks.add(s.write(func() {
+		if !isHot(s.Data.Len(), h.ApproxLen(), len(shards)) {
+			return
+		}
+
+		next := make([]*shard, len(shards), len(shards)+hotShardFanout-1)
+		copy(next, shards)
+		sub := make([]int, hotShardFanout)
+		sub[0] = p
+		for j := 1; j < hotShardFanout; j++ {
+			sub[j] = len(next)
+			next = append(next, newShard(&h.opts))
+		}
+		split := make(map[int][]int, len(l.split)+1)
+		for i, g := range l.split {
+			split[i] = g
+		}
+		split[p] = sub
+		nl := &layout{shards: next, primaries: l.primaries, split: split}
+
+		var keys []string
+		s.raw().Range(func(k, _ string) bool {
+			if h.locate(nl, k) != p {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		for _, k := range keys {
+			next[h.locate(nl, k)].put(s.take(k))
+		}
+		for k, t := range s.tombstones {
+			if j := h.locate(nl, k); j != p {
+				next[j].bury(t.record, t.purgeAt)
+				delete(s.tombstones, k)
+			}
+		}
+
+		for _, j := range sub {
+			atomic.StoreUint32(&next[j].grouped, 1)
+		}
+		h.current.Store(nl)
+		h.logf(s, "cmap: split hot shard %d into %d sub-shards (%d records moved)", p, hotShardFanout, len(keys))
+	}))
+}
+
+// HotShards returns the indexes of the shards holding more than 8 times the average number of records per shard, and at least 1024 records, in ascending order. Such a skew means the keys don't spread over the shards, e.g. because they were crafted to collide, and the writers of a hot shard keep fighting over its lock. With WithHotShardSplitting, the indexes include the sub-shards of split shards, and a hot shard normally shows up only until it gets split. Each shard is read under its read lock.
+func (h HashTable) HotShards() []int {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	sizes := make([]int, len(shards))
+	var size int
+	for i, shard := range shards {
+		shard.read(func() {
+			sizes[i] = shard.Data.Len()
+		})
+		size += sizes[i]
+	}
+
+	var hot []int
+	for i, n := range sizes {
+		if isHot(n, size, len(shards)) {
+			hot = append(hot, i)
+		}
+	}
+	return hot
+}
@@ -0,0 +1,31 @@
+package cmap
+
+import "sync"
+
+// internPool holds one copy of every distinct value stored with WithValueInterning.
+type internPool struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// intern returns the copy of the value held by the pool, adding it if it isn't there yet.
+func (p *internPool) intern(value string) string {
+	p.mu.RLock()
+	v, ok := p.values[value]
+	p.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if v, ok := p.values[value]; ok {
+		return v
+	}
+	if p.values == nil {
+		p.values = make(map[string]string)
+	}
+	p.values[value] = value
+	return value
+}
@@ -0,0 +1,50 @@
+package cmap
+
+// Iterator walks through the records of a hashtable, as returned by HashTable.Iterator. It is not safe for concurrent use by several goroutines.
+type Iterator struct {
+	h       HashTable
+	shard   int
+	records []record
+	pos     int
+	done    bool
+}
+
+// Iterator returns an iterator over the records of the hashtable, in no particular order. Call Next before reading the first record. Like Range, it copies the records of one shard at a time under the shard's read lock and holds no lock between the calls, so the caller may use the hashtable while iterating. It is not a snapshot: each shard is seen as it was when the iterator reached it, and records moved by a Resize, or by a split of WithHotShardSplitting, running meanwhile may be missed or visited twice.
+func (h HashTable) Iterator() *Iterator {
+	return &Iterator{h: h, pos: -1}
+}
+
+// Next advances to the next record and returns true, or returns false once there are no more records or the iterator is closed.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	it.pos++
+	for it.pos >= len(it.records) {
+		var ok bool
+		if it.records, ok = it.h.shardRecords(it.shard, false, it.records[:0]); !ok {
+			it.Close()
+			return false
+		}
+		it.shard++
+		it.pos = 0
+	}
+	return true
+}
+
+// Key returns the key of the current record.
+func (it *Iterator) Key() string {
+	return it.records[it.pos].key
+}
+
+// Value returns the value of the current record.
+func (it *Iterator) Value() string {
+	return it.records[it.pos].value
+}
+
+// Close stops the iteration and drops the copied records, after which Next returns false. Calling it more than once is harmless.
+func (it *Iterator) Close() {
+	it.done = true
+	it.records = nil
+}
@@ -0,0 +1,62 @@
+package cmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// EncodeJSON writes the records of the hashtable to w as a single JSON object, one shard at a time. Each shard is encoded under its read lock and written after the lock is released, so memory use stays proportional to a single shard. Records are written in the order of StableRange, so equal contents always give the same bytes.
+func (h HashTable) EncodeJSON(w io.Writer) error {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	first := true
+	for _, shard := range h.shards() {
+		var err error
+
+		shard.read(func() {
+			shard.eachSorted(func(k, v string) bool {
+				if !first {
+					buf.WriteByte(',')
+				}
+				first = false
+
+				err = encodeJSONPair(&buf, k, v)
+				return err == nil
+			})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+
+	_, err := w.Write([]byte{'}'})
+	return err
+}
+
+// encodeJSONPair writes "key":"value" to buf, escaping both strings.
+func encodeJSONPair(buf *bytes.Buffer, key string, value string) error {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+	return nil
+}
@@ -0,0 +1,172 @@
+package cmap
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyLock is the lock of the keys of one shard, kept in keyLocks as long as someone holds or waits for it. It is held while sem holds a token, so that waiting for it can time out.
+type keyLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+// keyLocks holds the locks handed out by LockKey, keyed by shard index.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[int]*keyLock
+
+	// released is signaled whenever the last lock of locks goes away, for Resize to wait until no shard index is relied on. It uses mu and is nil until the first wait.
+	released *sync.Cond
+
+	// held tracks the locks not released yet, along with where they were taken. It is only kept with WithLockLeakDetection.
+	held   map[uint64]heldLock
+	nextID uint64
+}
+
+// heldLock is a lock taken by LockKey and not released yet.
+type heldLock struct {
+	key   string
+	stack string
+}
+
+// LockKey locks the given key, independently of the shard locks, and returns the function that unlocks it. The lock is shared by every key with the same ShardIndex: callers locking keys of the same shard wait for each other, so the holder can update all the keys sharing the ShardIndex of the locked one, e.g. a Get followed by Puts of several related keys, without another LockKey user interleaving. Only users of LockKey are excluded, the other operations of the hashtable go on as usual. Resize waits until every lock taken by LockKey is released, so the ShardIndex of the keys can't change while one is held, and it must not be called while holding one. Calling the returned function more than once is harmless.
+func (h HashTable) LockKey(key string) func() {
+	unlock, _ := h.lockKey(key, nil)
+	return unlock
+}
+
+// LockKeyTimeout is like LockKey, but gives up once the lock couldn't be taken within timeout, returning an error wrapping ErrLockTimeout. The lock is then left untouched and the returned function is nil.
+func (h HashTable) LockKeyTimeout(key string, timeout time.Duration) (func(), error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	unlock, ok := h.lockKey(key, timer.C)
+	if !ok {
+		return nil, fmt.Errorf("%w: key %q not locked within %v", ErrLockTimeout, key, timeout)
+	}
+	return unlock, nil
+}
+
+// lockKey takes the lock of the key for LockKey and returns the function that unlocks it. If timeout fires first, it gives up and returns false. A nil timeout waits as long as needed.
+func (h HashTable) lockKey(key string, timeout <-chan time.Time) (func(), bool) {
+	k := &h.keyLocks
+
+	k.mu.Lock()
+	i := h.ShardIndex(key)
+	l, ok := k.locks[i]
+	if !ok {
+		if k.locks == nil {
+			k.locks = make(map[int]*keyLock)
+		}
+		l = &keyLock{sem: make(chan struct{}, 1)}
+		k.locks[i] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-timeout:
+		k.drop(i, l)
+		return nil, false
+	}
+
+	id, tracked := k.track(key, h.opts.lockLeakDetection)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.sem
+
+			if tracked {
+				k.mu.Lock()
+				delete(k.held, id)
+				k.mu.Unlock()
+			}
+			k.drop(i, l)
+		})
+	}, true
+}
+
+// drop gives up a reference to the lock of the i-th shard, removing it once nobody holds or waits for it.
+func (k *keyLocks) drop(i int, l *keyLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if l.refs--; l.refs == 0 {
+		delete(k.locks, i)
+		if len(k.locks) == 0 && k.released != nil {
+			k.released.Broadcast()
+		}
+	}
+}
+
+// quiesce waits until no lock taken by LockKey is held or waited for, and returns with k.mu held, so that no new one is taken until the caller unlocks it.
+func (k *keyLocks) quiesce() {
+	k.mu.Lock()
+	for len(k.locks) > 0 {
+		if k.released == nil {
+			k.released = sync.NewCond(&k.mu)
+		}
+		k.released.Wait()
+	}
+}
+
+// idle returns true with k.mu held if no lock taken by LockKey is held or waited for, so that no new one is taken until the caller unlocks it. Unlike quiesce, it doesn't wait: otherwise, it returns false with k.mu released.
+func (k *keyLocks) idle() bool {
+	k.mu.Lock()
+	if len(k.locks) > 0 {
+		k.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// track records the lock of the key as held, along with the stack that took it, if enabled is true.
+func (k *keyLocks) track(key string, enabled bool) (uint64, bool) {
+	if !enabled {
+		return 0, false
+	}
+
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.nextID++
+	if k.held == nil {
+		k.held = make(map[uint64]heldLock)
+	}
+	k.held[k.nextID] = heldLock{key: key, stack: string(buf)}
+	return k.nextID, true
+}
+
+// CheckNoLeaks returns an error wrapping ErrLockLeak if any lock taken by LockKey hasn't been released yet, listing the keys and the stacks that locked them. It is meant to be called at the end of tests, when every lock should have been released. It needs WithLockLeakDetection, otherwise it always returns nil.
+func (h HashTable) CheckNoLeaks() error {
+	k := &h.keyLocks
+
+	k.mu.Lock()
+	leaks := make([]heldLock, 0, len(k.held))
+	for _, l := range k.held {
+		leaks = append(leaks, l)
+	}
+	k.mu.Unlock()
+
+	if len(leaks) == 0 {
+		return nil
+	}
+
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].key < leaks[j].key })
+
+	var b strings.Builder
+	for _, l := range leaks {
+		fmt.Fprintf(&b, "\nkey %q locked at:\n%s", l.key, l.stack)
+	}
+	return fmt.Errorf("%w: %d key locks held%s", ErrLockLeak, len(leaks), b.String())
+}
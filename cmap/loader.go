@@ -0,0 +1,89 @@
+package cmap
+
+// load calls the loader for the missing key, sharing the call with concurrent misses of the same key, and stores what it finds. If the key got stored by someone else in the meantime, that value wins.
+func (h HashTable) load(key string) (string, bool, error) {
+	v, ok, err, _ := h.loads.do(key, func() (string, bool, error) {
+		v, ok, err := h.opts.loader(key)
+		if err != nil || !ok {
+			return "", false, err
+		}
+
+		shard := h.lockShard(key)
+		defer shard.unlock()
+
+		if current, exists := h.live(shard, key); exists {
+			return current, true, nil
+		}
+		if h.checkLimits(key, v) == nil {
+			h.set(shard, key, v)
+		}
+		return v, true, nil
+	})
+	return v, ok, err
+}
+
+// MGetOrLoad is MGet with a batched read-through: the keys missing from the hashtable are passed to loader in a single call, and the records it returns for them are stored and added to the result. Keys the loader leaves out are missing from the result too, and anything it returns for keys that weren't asked for is ignored. If none of the keys is missing, loader isn't called. If loader fails, its error is returned and nothing is stored. As in Get, a record stored by someone else while loader ran wins over the loaded one. Unlike the loader of WithLoader, concurrent calls are not merged, so two batches missing the same key both load it.
+func (h HashTable) MGetOrLoad(keys []string, loader func(missing []string) (map[string]string, error)) (map[string]string, error) {
+	result := h.MGet(keys)
+
+	var missing []string
+	asked := make(map[string]struct{})
+	for _, k := range keys {
+		if _, ok := result[k]; ok {
+			continue
+		}
+		if _, ok := asked[k]; !ok {
+			asked[k] = struct{}{}
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	loaded, err := loader(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	// The loader may keep missing, so it isn't filtered in place.
+	found := make([]string, 0, len(missing))
+	for _, k := range missing {
+		if _, ok := loaded[k]; ok {
+			found = append(found, k)
+		}
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(found)
+	defer releaseGroups(groups)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		hooks.add(shard.write(func() {
+			for _, k := range group {
+				if current, exists := h.live(shard, k); exists {
+					result[k] = current
+					continue
+				}
+				v := loaded[k]
+				if h.checkLimits(k, v) == nil {
+					h.set(shard, k, v)
+				}
+				result[k] = v
+			}
+		}))
+	}
+	return result, nil
+}
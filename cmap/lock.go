@@ -0,0 +1,225 @@
+package cmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// spinTries is the number of attempts a spinLock makes before blocking.
+const spinTries = 16
+
+// LockPolicy chooses how shard locks arbitrate between readers and writers.
+type LockPolicy int
+
+const (
+	// WritePreferring is the behavior of sync.RWMutex and the default. Once a writer is waiting, new readers wait behind it, so writers can't starve.
+	WritePreferring LockPolicy = iota
+	// ReadPreferring lets new readers in as long as no writer holds the lock, even if writers are waiting. It maximizes read throughput, but a steady stream of readers can starve writers.
+	ReadPreferring
+)
+
+// rwLocker is the lock guarding a shard.
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+	TryLock() bool
+	TryRLock() bool
+}
+
+// newLock returns a lock for a new shard according to the options.
+func (o *options) newLock() rwLocker {
+	var l rwLocker
+	switch {
+	case o.lockPolicy == ReadPreferring:
+		l = newReadPreferringLock()
+	case o.spinLock:
+		l = &spinLock{}
+	default:
+		l = &sync.RWMutex{}
+	}
+
+	if o.contentionMetrics {
+		return &countingLock{rwLocker: l}
+	}
+	return l
+}
+
+// ShardContention counts the lock acquisitions of a shard, as reported by ContentionStats.
+type ShardContention struct {
+	// Acquisitions is the number of times the shard's lock was taken, for reading or writing.
+	Acquisitions uint64
+	// Contended is the number of those acquisitions that found the lock unavailable and had to wait.
+	Contended uint64
+}
+
+// countingLock wraps a shard lock to count its acquisitions and how many of them had to wait, for WithContentionMetrics.
+type countingLock struct {
+	acquisitions uint64 // accessed atomically, kept first for 64-bit alignment.
+	contended    uint64 // accessed atomically.
+	rwLocker
+}
+
+func (l *countingLock) Lock() {
+	atomic.AddUint64(&l.acquisitions, 1)
+	if !l.rwLocker.TryLock() {
+		atomic.AddUint64(&l.contended, 1)
+		l.rwLocker.Lock()
+	}
+}
+
+func (l *countingLock) RLock() {
+	atomic.AddUint64(&l.acquisitions, 1)
+	if !l.rwLocker.TryRLock() {
+		atomic.AddUint64(&l.contended, 1)
+		l.rwLocker.RLock()
+	}
+}
+
+// stats returns the counts of the lock.
+func (l *countingLock) stats() ShardContention {
+	return ShardContention{
+		Acquisitions: atomic.LoadUint64(&l.acquisitions),
+		Contended:    atomic.LoadUint64(&l.contended),
+	}
+}
+
+// reset sets the counts of the lock back to zero.
+func (l *countingLock) reset() {
+	atomic.StoreUint64(&l.acquisitions, 0)
+	atomic.StoreUint64(&l.contended, 0)
+}
+
+// ContentionStats returns the lock counts of every shard, indexed by shard index, revealing the shards whose locks are fought over, e.g. because of hot keys. The counts start when the shard is created and restart at every Resize, so they always describe the current layout. It needs WithContentionMetrics, otherwise it returns nil.
+func (h HashTable) ContentionStats() []ShardContention {
+	if !h.opts.contentionMetrics {
+		return nil
+	}
+
+	shards := h.layout().shards
+	stats := make([]ShardContention, len(shards))
+	for i, s := range shards {
+		stats[i] = s.Lock.(*countingLock).stats()
+	}
+	return stats
+}
+
+// contended returns true if the shard locks of the current layout were taken at least minAcquisitions times and more than one in maxContendedRatio of those acquisitions had to wait. It needs WithContentionMetrics, otherwise it returns false.
+func (h HashTable) contended() bool {
+	var total ShardContention
+	for _, s := range h.ContentionStats() {
+		total.Acquisitions += s.Acquisitions
+		total.Contended += s.Contended
+	}
+	return total.Acquisitions >= minAcquisitions && total.Contended*maxContendedRatio > total.Acquisitions
+}
+
+// spinLock is a read-write lock that tries to acquire the lock a few times without parking the goroutine, then falls back to blocking like a sync.RWMutex.
+type spinLock struct {
+	mu sync.RWMutex
+}
+
+func (l *spinLock) Lock() {
+	for i := 0; i < spinTries; i++ {
+		if l.mu.TryLock() {
+			return
+		}
+	}
+	l.mu.Lock()
+}
+
+func (l *spinLock) Unlock() {
+	l.mu.Unlock()
+}
+
+func (l *spinLock) RLock() {
+	for i := 0; i < spinTries; i++ {
+		if l.mu.TryRLock() {
+			return
+		}
+	}
+	l.mu.RLock()
+}
+
+func (l *spinLock) RUnlock() {
+	l.mu.RUnlock()
+}
+
+func (l *spinLock) TryLock() bool {
+	return l.mu.TryLock()
+}
+
+func (l *spinLock) TryRLock() bool {
+	return l.mu.TryRLock()
+}
+
+// readPreferringLock is a read-write lock where readers only wait for a writer holding the lock, never for a waiting one.
+type readPreferringLock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	readers int
+	writer  bool
+}
+
+func newReadPreferringLock() *readPreferringLock {
+	l := &readPreferringLock{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *readPreferringLock) Lock() {
+	l.mu.Lock()
+	for l.writer || l.readers > 0 {
+		l.cond.Wait()
+	}
+	l.writer = true
+	l.mu.Unlock()
+}
+
+func (l *readPreferringLock) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *readPreferringLock) RLock() {
+	l.mu.Lock()
+	for l.writer {
+		l.cond.Wait()
+	}
+	l.readers++
+	l.mu.Unlock()
+}
+
+func (l *readPreferringLock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.cond.Broadcast()
+	}
+	l.mu.Unlock()
+}
+
+func (l *readPreferringLock) TryLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.writer || l.readers > 0 {
+		return false
+	}
+	l.writer = true
+	return true
+}
+
+func (l *readPreferringLock) TryRLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.writer {
+		return false
+	}
+	l.readers++
+	return true
+}
@@ -0,0 +1,175 @@
+package cmap
+
+import "math/rand"
+
+// Map is the read side of a string to string map, letting read-only code accept a HashTable or any other implementation alike.
+type Map interface {
+	Get(key string) (string, bool)
+	Has(key string) bool
+	Len() int
+	Range(f func(key string, value string) bool)
+}
+
+var _ Map = HashTable{}
+
+// Range calls f for every record of the hashtable, in no particular order, until f returns false. The records of each shard are copied under its read lock and f is called once the lock is released, so f may use the hashtable, but the records of different shards are not read at the same moment. Records moved by a Resize, or by a split of WithHotShardSplitting, running meanwhile may be missed or visited twice.
+func (h HashTable) Range(f func(key string, value string) bool) {
+	h.rangeRecords(false, func(r record) bool {
+		return f(r.key, r.value)
+	})
+}
+
+// RangeErr is like Range, but f returns an error instead of a boolean: it stops at the first error f returns and returns it, or returns nil once every record has been visited. Like Range, f is called with no lock held.
+func (h HashTable) RangeErr(f func(key string, value string) error) error {
+	var err error
+	h.Range(func(k, v string) bool {
+		err = f(k, v)
+		return err == nil
+	})
+	return err
+}
+
+// rangeRecords is Range handing out whole records, along with their metadata if withMeta is true.
+func (h HashTable) rangeRecords(withMeta bool, f func(r record) bool) {
+	var records []record
+	for i := 0; ; i++ {
+		var ok bool
+		if records, ok = h.shardRecords(i, withMeta, records[:0]); !ok {
+			return
+		}
+
+		for _, r := range records {
+			if !f(r) {
+				return
+			}
+		}
+	}
+}
+
+// shardRecords appends copies of the records of the shard with the given index to buf, along with their metadata if withMeta is true, or returns false if the index is out of range.
+func (h HashTable) shardRecords(i int, withMeta bool, buf []record) ([]record, bool) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	if i >= len(shards) {
+		return buf, false
+	}
+
+	shard := shards[i]
+
+	shard.Lock.RLock()
+	defer shard.Lock.RUnlock()
+
+	shard.each(func(k, v string) bool {
+		r := record{key: k, value: v}
+		if withMeta {
+			r.version, r.modified = shard.versions[k], shard.modified[k]
+			r.expires, r.hasExpiry = shard.expires[k]
+		}
+		buf = append(buf, r)
+		return true
+	})
+	return buf, true
+}
+
+// StableRange is like Range, but visits the records in a deterministic order: shards in ascending order of index and, within each shard, keys in ascending order. Equal contents in hashtables with the same number of shards and hashing are always visited in the same order, unaffected by the randomized order of Go maps.
+func (h HashTable) StableRange(f func(key string, value string) bool) {
+	var records []record
+	for i := 0; ; i++ {
+		var ok bool
+		if records, ok = h.shardRecords(i, false, records[:0]); !ok {
+			return
+		}
+		sortRecords(records)
+
+		for _, r := range records {
+			if !f(r.key, r.value) {
+				return
+			}
+		}
+	}
+}
+
+// Partition copies the records of the hashtable into n independent maps, for handing to separate workers. Records are dealt out in turn, so the sizes of the maps differ by at most one. Like Range, it reads one shard at a time. Values of n below 1 are treated as 1.
+func (h HashTable) Partition(n int) []map[string]string {
+	if n < 1 {
+		n = 1
+	}
+
+	chunks := make([]map[string]string, n)
+	for i := range chunks {
+		chunks[i] = make(map[string]string, h.ApproxLen()/n+1)
+	}
+
+	var i int
+	h.Range(func(k, v string) bool {
+		chunks[i%n][k] = v
+		i++
+		return true
+	})
+	return chunks
+}
+
+// ReservoirSample returns k records picked uniformly at random, or every record if there are fewer than k. It walks through all the shards, one at a time under its read lock, using reservoir sampling, so only k records are kept whatever the size of the hashtable. Every record has the same chance of being picked, k out of Len.
+func (h HashTable) ReservoirSample(k int) []Pair {
+	return h.ReservoirSampleRand(k, nil)
+}
+
+// ReservoirSampleRand is like ReservoirSample, but draws its random numbers from r, so a seeded source gives reproducible draws. A nil r uses the default source of math/rand. r is not safe for concurrent use, so it must not be shared with concurrent calls. The records within a shard are still visited in the order of its ShardStore, which is random for the default one, so the same draws only pick the same records with an ordered store like NewSliceStore.
+func (h HashTable) ReservoirSampleRand(k int, r *rand.Rand) []Pair {
+	if k <= 0 {
+		return nil
+	}
+
+	int63n := rand.Int63n
+	if r != nil {
+		int63n = r.Int63n
+	}
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	// k may be far more than there are records, e.g. to sample everything, so the sample is only pre-sized for the records there are.
+	size := h.ApproxLen()
+	if k < size {
+		size = k
+	}
+
+	sample := make([]Pair, 0, size)
+	var seen int64
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(key, value string) bool {
+				seen++
+				if len(sample) < k {
+					sample = append(sample, Pair{Key: key, Value: value})
+				} else if j := int63n(seen); j < int64(k) {
+					sample[j] = Pair{Key: key, Value: value}
+				}
+				return true
+			})
+		})
+	}
+	return sample
+}
+
+// UnsafeRange is like Range, but calls f while holding the read lock of the shard being visited, without copying anything, for hot loops where the copies of Range cost too much. f must not call any method of the hashtable, not even a read, since that can deadlock once a writer or a Resize is waiting. Writers of the visited shard wait until f is done with it, so f should be quick. If f panics, the lock is released before the panic goes on.
+func (h HashTable) UnsafeRange(f func(key string, value string) bool) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	more := true
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				more = f(k, v)
+				return more
+			})
+		})
+
+		if !more {
+			return
+		}
+	}
+}
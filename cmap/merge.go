@@ -0,0 +1,33 @@
+package cmap
+
+// MergeLWW merges the records of other into the hashtable, resolving each key present in both by last write wins: the record written last, as told by the modification time every write records, is kept along with its TTL. Records merged in keep their modification time, and equal times are resolved in favor of the greater value, so merging a into b leaves b with the same records as merging b into a. The records of other are read one shard at a time and no lock of both hashtables is ever held together. Expired records of other are left out.
+func (h HashTable) MergeLWW(other *HashTable) {
+	if h.table == other.table {
+		return
+	}
+
+	other.rangeRecords(true, func(r record) bool {
+		h.mergeRecord(r)
+		return true
+	})
+}
+
+// mergeRecord stores the record unless the hashtable holds a newer one of the same key.
+func (h HashTable) mergeRecord(r record) {
+	shard := h.lockShard(r.key)
+	defer shard.unlock()
+
+	if v, ok := h.live(shard, r.key); ok {
+		m := shard.modified[r.key]
+		if m > r.modified || m == r.modified && v >= r.value {
+			return
+		}
+	}
+	if h.checkLimits(r.key, r.value) != nil || h.set(shard, r.key, r.value) == 0 {
+		return
+	}
+	shard.modified[r.key] = r.modified
+	if r.hasExpiry {
+		shard.expires[r.key] = r.expires
+	}
+}
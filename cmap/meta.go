@@ -0,0 +1,52 @@
+package cmap
+
+import "time"
+
+// EntryMeta is the metadata of a record, as returned by GetWithMeta.
+type EntryMeta struct {
+	// Version is the version of the record, as returned by GetVersioned.
+	Version uint64
+	// TTL is the remaining lifetime of the record, or NoTTL if it never expires, as returned by TTL.
+	TTL time.Duration
+	// Modified is the time of the last write of the record.
+	Modified time.Time
+	// InsertSeq is the insertion sequence of the record: a record inserted later than another one, in any shard, has a greater sequence. Overwrites keep it, while a record deleted and inserted again gets a new one.
+	InsertSeq uint64
+	// Accesses is the number of reads of the record by Get and MustGet over the last 64 seconds, the current one included, as tracked for AccessRate. It needs WithAccessRate, otherwise, or for a key that isn't tracked, it is 0.
+	Accesses uint64
+}
+
+// GetWithMeta returns the value associated with the key along with its metadata, all read under a single lock acquisition. If the key doesn't exist, it will return empty string, zero metadata, and false.
+func (h HashTable) GetWithMeta(key string) (value string, meta EntryMeta, ok bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	value, ok = shard.get(key)
+	if !ok {
+		return "", EntryMeta{}, false
+	}
+
+	meta = EntryMeta{Version: shard.versions[key], TTL: NoTTL, Modified: time.Unix(0, shard.modified[key]), InsertSeq: shard.inserted[key]}
+	if exp, ok := shard.expires[key]; ok {
+		meta.TTL = time.Duration(exp - now())
+	}
+	if h.access != nil {
+		meta.Accesses = h.access.total(key, now())
+	}
+	return value, meta, true
+}
+
+// GetIfModifiedSince returns the value associated with the key along with true, only if the record was written after t, for polling a key cheaply. If the record hasn't changed since t, the value is left empty and modified is false. If the key doesn't exist, ok will be false.
+func (h HashTable) GetIfModifiedSince(key string, t time.Time) (value string, modified bool, ok bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	value, ok = shard.get(key)
+	if !ok {
+		return "", false, false
+	}
+	if shard.modified[key] <= t.UnixNano() {
+		return "", false, true
+	}
+	return value, true, true
+}
@@ -0,0 +1,53 @@
+package cmap
+
+// MutableMap is a Map that can also be written, like HashTable.
+type MutableMap interface {
+	Map
+	Put(key string, value string)
+	Del(key string) (string, bool)
+}
+
+var _ MutableMap = HashTable{}
+
+// Middleware wraps the Get, Put, and Del operations of a MutableMap, for adding cross-cutting behavior like metrics, logging, or tracing around them. Each function gets the arguments of the operation along with next, which runs the rest of the chain and the operation itself, so it can act before and after it, change its arguments or results, or skip it. A nil function passes the operation through unchanged. The other operations of the map are never wrapped.
+type Middleware struct {
+	Get func(key string, next func(key string) (string, bool)) (string, bool)
+	Put func(key string, value string, next func(key string, value string))
+	Del func(key string, next func(key string) (string, bool)) (string, bool)
+}
+
+// WithMiddleware returns m wrapped by the given middlewares. The first middleware is the outermost one: it sees every operation first and its results last.
+func WithMiddleware(m MutableMap, mw ...Middleware) MutableMap {
+	for i := len(mw) - 1; i >= 0; i-- {
+		m = wrappedMap{MutableMap: m, mw: mw[i]}
+	}
+	return m
+}
+
+// wrappedMap is a MutableMap wrapped by a single middleware.
+type wrappedMap struct {
+	MutableMap
+	mw Middleware
+}
+
+func (w wrappedMap) Get(key string) (string, bool) {
+	if w.mw.Get == nil {
+		return w.MutableMap.Get(key)
+	}
+	return w.mw.Get(key, w.MutableMap.Get)
+}
+
+func (w wrappedMap) Put(key string, value string) {
+	if w.mw.Put == nil {
+		w.MutableMap.Put(key, value)
+		return
+	}
+	w.mw.Put(key, value, w.MutableMap.Put)
+}
+
+func (w wrappedMap) Del(key string) (string, bool) {
+	if w.mw.Del == nil {
+		return w.MutableMap.Del(key)
+	}
+	return w.mw.Del(key, w.MutableMap.Del)
+}
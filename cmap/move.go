@@ -0,0 +1,39 @@
+package cmap
+
+// Move moves the record of the key from src to dst, along with its TTL, and returns true if the key was present in src. An existing record of the key in dst is overridden. If the record exceeds the limits of dst, or WithMaxSize leaves no room for it, nothing changes and it returns false. The shards of both hashtables are locked together, always in the order the hashtables were created, so concurrent moves in opposite directions can't deadlock. The removal from src is reported to its eviction callback with EvictMoved. Nothing moves once either hashtable is closed.
+func Move(src *HashTable, dst *HashTable, key string) bool {
+	if src.table == dst.table {
+		return src.Has(key)
+	}
+	if src.isClosed() || dst.isClosed() {
+		return false
+	}
+
+	var s, d *shard
+	if src.id < dst.id {
+		s = src.lockShard(key)
+		d = dst.lockShard(key)
+	} else {
+		d = dst.lockShard(key)
+		s = src.lockShard(key)
+	}
+	defer func() {
+		hooks := append(s.release(), d.release()...)
+		s.runHooks(hooks)
+	}()
+
+	v, ok := src.live(s, key)
+	if !ok || dst.checkLimits(key, v) != nil {
+		return false
+	}
+	exp, hasExpiry := s.expires[key]
+
+	if dst.set(d, key, v) == 0 {
+		return false
+	}
+	src.del(s, key, EvictMoved)
+	if hasExpiry {
+		d.expires[key] = exp
+	}
+	return true
+}
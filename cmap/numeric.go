@@ -0,0 +1,221 @@
+package cmap
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// GetInt returns the value associated with the key parsed as an int64. If the key doesn't exist, it will return 0 and false. If the stored value isn't a valid int64, it will return an error.
+func (h HashTable) GetInt(key string) (int64, bool, error) {
+	v, ok := h.Get(key)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("%w: key %q: %v", ErrNotInteger, key, err)
+	}
+
+	return n, true, nil
+}
+
+// GetOrDefaultInt returns the value associated with the key parsed as an int64, or def if the key doesn't exist. If the stored value isn't a valid int64, it will return an error.
+func (h HashTable) GetOrDefaultInt(key string, def int64) (int64, error) {
+	n, ok, err := h.GetInt(key)
+	if !ok {
+		return def, nil
+	}
+	return n, err
+}
+
+// PutInt stores the given int64 as the value of the key, formatted in base 10.
+func (h HashTable) PutInt(key string, v int64) {
+	h.Put(key, strconv.FormatInt(v, 10))
+}
+
+// IncrementAll adds each delta to the value of its key, parsed as an int64, and returns the resulting values. Absent keys count as 0, so they end up holding their delta. Keys are grouped by shard and each shard's lock is taken once, so a whole batch of counters costs one lock acquisition per shard. If the value of a key isn't a valid int64, it returns an error naming the key and the increments of that shard are not applied, while the shards done before it keep theirs. If a counter can't be stored, it returns ErrClosed if the hashtable is closed, otherwise an error wrapping ErrCapacity naming the key, and the increments stored before it are kept.
+func (h HashTable) IncrementAll(deltas map[string]int64) (map[string]int64, error) {
+	keys := make([]string, 0, len(deltas))
+	for k := range deltas {
+		keys = append(keys, k)
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	groups := h.groupByShard(keys)
+	defer releaseGroups(groups)
+
+	results := make(map[string]int64, len(deltas))
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		shard := shards[i]
+
+		var err error
+		hooks.add(shard.write(func() {
+			sums := make([]int64, len(group))
+			for j, k := range group {
+				var n int64
+				if v, ok := h.live(shard, k); ok {
+					var perr error
+					if n, perr = strconv.ParseInt(v, 10, 64); perr != nil {
+						err = fmt.Errorf("%w: key %q: %v", ErrNotInteger, k, perr)
+						return
+					}
+				}
+				sums[j] = n + deltas[k]
+			}
+			for j, k := range group {
+				if h.set(shard, k, strconv.FormatInt(sums[j], 10)) == 0 {
+					err = h.refused(k)
+					return
+				}
+				results[k] = sums[j]
+			}
+		}))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// SumInt returns the sum of all the values parsed as int64. It stops at the first value that isn't a valid int64 and returns an error naming its key. Each shard is read under its read lock.
+func (h HashTable) SumInt() (int64, error) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var sum int64
+	for _, shard := range h.shards() {
+		var err error
+
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				n, perr := strconv.ParseInt(v, 10, 64)
+				if perr != nil {
+					err = fmt.Errorf("%w: key %q: %v", ErrNotInteger, k, perr)
+					return false
+				}
+				sum += n
+				return true
+			})
+		})
+
+		if err != nil {
+			return 0, err
+		}
+	}
+	return sum, nil
+}
+
+// MaxInt returns the key with the greatest value parsed as int64, along with that value. Values that aren't valid int64s are skipped. If there is no such value, ok will be false. Each shard is read under its read lock.
+func (h HashTable) MaxInt() (key string, value int64, ok bool) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err == nil && (!ok || n > value) {
+					key, value, ok = k, n, true
+				}
+				return true
+			})
+		})
+	}
+	return key, value, ok
+}
+
+// TopNByIntValue returns the n records with the greatest values parsed as int64, in descending order of value, ties broken by ascending key. Only the best n records seen so far are kept, in a min-heap, so the memory used is O(n) however large the hashtable is. It stops at the first value that isn't a valid int64 and returns an error naming its key. Each shard is read under its read lock.
+func (h HashTable) TopNByIntValue(n int) ([]Pair, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	// n may be far more than there are records, so the heap is only pre-sized for the records there are.
+	size := h.ApproxLen()
+	if n < size {
+		size = n
+	}
+
+	top := make(intHeap, 0, size)
+	for _, shard := range h.shards() {
+		var err error
+
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				x, perr := strconv.ParseInt(v, 10, 64)
+				if perr != nil {
+					err = fmt.Errorf("%w: key %q: %v", ErrNotInteger, k, perr)
+					return false
+				}
+
+				e := intEntry{key: k, value: v, n: x}
+				switch {
+				case len(top) < n:
+					heap.Push(&top, e)
+				case top[0].less(e):
+					top[0] = e
+					heap.Fix(&top, 0)
+				}
+				return true
+			})
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool { return top[j].less(top[i]) })
+
+	pairs := make([]Pair, len(top))
+	for i, e := range top {
+		pairs[i] = Pair{Key: e.key, Value: e.value}
+	}
+	return pairs, nil
+}
+
+// intEntry is a record along with its value parsed as an integer, as kept by TopNByIntValue.
+type intEntry struct {
+	key   string
+	value string
+	n     int64
+}
+
+// less reports whether e ranks below other: a smaller value, or an equal value with a greater key.
+func (e intEntry) less(other intEntry) bool {
+	if e.n != other.n {
+		return e.n < other.n
+	}
+	return e.key > other.key
+}
+
+// intHeap is a min-heap of entries, implementing heap.Interface, with the lowest ranked entry on top.
+type intHeap []intEntry
+
+func (x intHeap) Len() int            { return len(x) }
+func (x intHeap) Less(i, j int) bool  { return x[i].less(x[j]) }
+func (x intHeap) Swap(i, j int)       { x[i], x[j] = x[j], x[i] }
+func (x *intHeap) Push(e interface{}) { *x = append(*x, e.(intEntry)) }
+func (x *intHeap) Pop() interface{} {
+	old := *x
+	e := old[len(old)-1]
+	*x = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,258 @@
+package cmap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// Option configures a hashtable constructed by New.
+type Option func(*options)
+
+type options struct {
+	shardCount        int
+	consistentHashing bool
+	sizeThreshold     int
+	onThreshold       func(size int)
+	logger            func(format string, args ...interface{})
+	onEvict           func(key string, value string, reason EvictReason)
+	spinLock          bool
+	lockPolicy        LockPolicy
+	shrinkRatio       float64
+	newStore          func() ShardStore
+	maxBatch          int
+	maxBatchDelay     time.Duration
+	onPanic           func(recovered interface{})
+	byteAccounting    bool
+	maxKeyLen         int
+	maxValueLen       int
+	loader            func(key string) (string, bool, error)
+	writer            func(batch []Pair) error
+	flushInterval     time.Duration
+	maxSize           int
+	lockLeakDetection bool
+	evictionSampling  int
+	orderedIndex      bool
+	valueInterning    bool
+	accessRateKeys    int
+	softDelete        time.Duration
+	valueEquals       func(a, b string) bool
+	contentionMetrics bool
+	hashSeed          uint32
+	encode            func(string) string
+	decode            func(string) string
+	hotShardSplitting bool
+}
+
+// WithSizeThreshold registers f to be called whenever the number of records crosses n, in either direction. Growing from below n to n or more is one crossing and shrinking from n or more to below n is another. f is called once per crossing with the size right after the crossing, outside of any lock, so it may use the hashtable, even Resize it.
+func WithSizeThreshold(n int, f func(size int)) Option {
+	return func(o *options) {
+		o.sizeThreshold = n
+		o.onThreshold = f
+	}
+}
+
+// WithLogger makes the hashtable report significant events, like draining a shard or crossing the size threshold, to the given logger. Individual reads and writes are not logged. The logger is always called outside of any lock. By default nothing gets logged.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(o *options) {
+		o.logger = logf
+	}
+}
+
+// WithOnEvict registers f to be called for every record removed from the hashtable, along with the reason of the removal. f is called after the record is removed, outside of any lock, so it may use the hashtable. Records handed back to the caller, like the ones returned by DrainShard, are not reported.
+func WithOnEvict(f func(key string, value string, reason EvictReason)) Option {
+	return func(o *options) {
+		o.onEvict = f
+	}
+}
+
+// WithSpinLock makes every shard use a lock that spins a few times before blocking, instead of a plain sync.RWMutex. It may help when the critical sections are tiny and contention is high, so measure before adopting it.
+func WithSpinLock() Option {
+	return func(o *options) {
+		o.spinLock = true
+	}
+}
+
+// WithShardCount sets the number of shards the hashtable starts with, normalized by NormalizeShardCount. The default is SHARD_COUNT. Values below 1 are ignored.
+func WithShardCount(n int) Option {
+	return func(o *options) {
+		if n >= 1 {
+			o.shardCount = NormalizeShardCount(n)
+		}
+	}
+}
+
+// WithConsistentHashing makes the hashtable assign keys to shards by jump consistent hashing instead of modulo. When the number of shards changes from n to m, only about |m-n|/max(m, n) of the keys move, while modulo moves nearly all of them unless m is a multiple of n. Doubling moves half of the keys either way, since that is the minimum. The tradeoff is a slightly slower shard selection, which takes O(log n) steps instead of a single modulo.
+func WithConsistentHashing() Option {
+	return func(o *options) {
+		o.consistentHashing = true
+	}
+}
+
+// WithLockPolicy chooses how the shard locks arbitrate between readers and writers. The default is WritePreferring. ReadPreferring uses a custom lock and takes precedence over WithSpinLock.
+func WithLockPolicy(p LockPolicy) Option {
+	return func(o *options) {
+		o.lockPolicy = p
+	}
+}
+
+// WithAutoShrink makes a shard compact itself, like Shrink does, once the records deleted from it since its last compaction outnumber ratio times its live records. The compaction happens under the shard's write lock, right at the end of the operation that made it due. A ratio of 0 disables it, which is the default.
+func WithAutoShrink(ratio float64) Option {
+	return func(o *options) {
+		o.shrinkRatio = ratio
+	}
+}
+
+// WithShardStore makes every shard keep its records in a store created by the given factory, instead of a plain Go map.
+func WithShardStore(factory func() ShardStore) Option {
+	return func(o *options) {
+		o.newStore = factory
+	}
+}
+
+// WithBatchedEvents configures the batches delivered by SubscribeBatches. A batch is sent once it holds maxBatch events, or once maxDelay has passed since its first event. A maxDelay of 0 only sends full batches, until the hashtable is closed. Without this option every event makes its own batch.
+func WithBatchedEvents(maxBatch int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.maxBatch = maxBatch
+		o.maxBatchDelay = maxDelay
+	}
+}
+
+// WithCallbackPanicHandler passes the panics of user callbacks, like the ones given to WithSizeThreshold, WithLogger, and WithOnEvict, to f instead of letting them propagate. Callbacks never run under any lock of the hashtable, so a panicking callback can't leave the hashtable locked either way. Without a handler the panic propagates to the caller of the operation that triggered the callback.
+func WithCallbackPanicHandler(f func(recovered interface{})) Option {
+	return func(o *options) {
+		o.onPanic = f
+	}
+}
+
+// WithByteAccounting makes the hashtable keep a running total of the length of its keys and values, reported by Bytes. Every write adjusts it by the size difference it makes.
+func WithByteAccounting() Option {
+	return func(o *options) {
+		o.byteAccounting = true
+	}
+}
+
+// WithMaxKeyLen rejects writes of keys longer than n bytes. The error-returning variants, like TryPut and PutAll, report the rejection, the others just leave the hashtable unchanged. Zero means unlimited, which is the default.
+func WithMaxKeyLen(n int) Option {
+	return func(o *options) {
+		o.maxKeyLen = n
+	}
+}
+
+// WithMaxValueLen rejects writes of values longer than n bytes, the same way WithMaxKeyLen rejects keys. Zero means unlimited, which is the default.
+func WithMaxValueLen(n int) Option {
+	return func(o *options) {
+		o.maxValueLen = n
+	}
+}
+
+// WithLoader makes Get and MustGet load missing keys with the given loader, and store what it finds, making the hashtable a read-through cache. Concurrent misses of the same key share a single loader call, and if it panics, the misses that waited for it get an error wrapping ErrComputePanicked. The loader is called without holding any lock and reports whether it found the key.
+func WithLoader(loader func(key string) (string, bool, error)) Option {
+	return func(o *options) {
+		o.loader = loader
+	}
+}
+
+// WithWriter makes the hashtable a write-behind cache. Writes and explicit deletions update the hashtable right away and get queued for the writer, which receives them in batches every flushInterval, outside of any lock. Only the latest change of each key is kept in the queue. A batch the writer fails is retried with the next one, and the failure is reported to the logger. Flush writes the queue immediately and Close writes whatever is left. A flushInterval of 0 leaves flushing to Flush and Close. Records removed for other reasons, like expiry or Clear, are not written.
+func WithWriter(writer func(batch []Pair) error, flushInterval time.Duration) Option {
+	return func(o *options) {
+		o.writer = writer
+		o.flushInterval = flushInterval
+	}
+}
+
+// WithMaxSize bounds the number of records to n. Adding a record to a full hashtable evicts another record of the same shard, reported with EvictCapacity. Records stored with PutWithWeight are evicted lightest first, approximately. If that shard holds no other record, the new record is rejected instead: the error-returning variants, like TryPut, report ErrCapacity, and the others leave the hashtable unchanged. Writes to different shards check the size concurrently, so it may overshoot n by a few records under contention. Since eviction stays within a shard, n should be well above the number of shards. Zero means unlimited, which is the default.
+func WithMaxSize(n int) Option {
+	return func(o *options) {
+		o.maxSize = n
+	}
+}
+
+// WithLockLeakDetection makes the hashtable remember every lock taken by LockKey until it is released, along with the stack that took it, so that CheckNoLeaks can report the forgotten ones. Capturing the stacks is costly, so it is a debugging aid for tests. Without it, LockKey keeps no such record.
+func WithLockLeakDetection() Option {
+	return func(o *options) {
+		o.lockLeakDetection = true
+	}
+}
+
+// WithEvictionSampling makes the hashtable count the records it removes, reported by Evictions, and log every rate-th one with its key and reason to the logger set by WithLogger. It shows how much churn there is without logging every removal. A rate of 0 disables it, which is the default.
+func WithEvictionSampling(rate int) Option {
+	return func(o *options) {
+		o.evictionSampling = rate
+	}
+}
+
+// WithOrderedIndex makes the hashtable keep its keys in a sorted index, for FirstPage and PageByKey. The index is a sorted slice shared by all the shards, so every insert and deletion of a key takes its lock and shifts O(n) keys on top of the usual work, which makes writes noticeably costlier on large hashtables. Overwrites of existing keys don't touch it.
+func WithOrderedIndex() Option {
+	return func(o *options) {
+		o.orderedIndex = true
+	}
+}
+
+// WithValueInterning makes the hashtable keep a single copy of every distinct value it stores, so that records with equal values share the same memory and Get returns that copy. The pool of values only grows: a value stays in it even once no record holds it anymore, for the lifetime of the hashtable. It only pays off when values are drawn from a small set, like status codes or enum names, otherwise the pool just adds an entry and a lookup to every write.
+func WithValueInterning() Option {
+	return func(o *options) {
+		o.valueInterning = true
+	}
+}
+
+// WithAccessRate makes the hashtable count the successful reads of Get and MustGet per key and second, for AccessRate. At most about maxKeys keys are tracked at once, so memory stays bounded: once that many are tracked, a new key takes the place of one that hasn't been read for the last 64 seconds, or isn't tracked if there is none, which keeps the busy keys tracked. Counting takes a lock shared by a fraction of the keys on every read.
+func WithAccessRate(maxKeys int) Option {
+	return func(o *options) {
+		o.accessRateKeys = maxKeys
+	}
+}
+
+// WithSoftDelete keeps the records deleted by Del and DeleteIf as tombstones for the given retention, during which Undelete can bring them back. A tombstone is invisible to every other operation: the record counts as deleted for reads, Len, iteration, events, and the eviction callback. Tombstones whose retention ran out are purged by DeleteExpired, so call it periodically to bound their memory. Records removed for other reasons, like expiry or Clear, leave no tombstone. A retention of 0 disables it, which is the default.
+func WithSoftDelete(retention time.Duration) Option {
+	return func(o *options) {
+		o.softDelete = retention
+	}
+}
+
+// WithValueEquals makes the hashtable compare values with eq instead of ==, wherever it checks a value against an expected one: CompareAndSwap and the other compare-and-swap methods, CompareAndDelete, HasValue, KeysWithValue, and the unchanged detection of Apply. It lets values differing only in representation, like JSON with different whitespace, count as equal. eq is called under the shard locks, so it must not use the hashtable.
+func WithValueEquals(eq func(a, b string) bool) Option {
+	return func(o *options) {
+		o.valueEquals = eq
+	}
+}
+
+// WithContentionMetrics makes every shard count its lock acquisitions and how many of them had to wait, reported by ContentionStats. Each acquisition first tries to take the lock without waiting to tell the two apart, and the counts are kept with atomics, so measuring adds no lock of its own.
+func WithContentionMetrics() Option {
+	return func(o *options) {
+		o.contentionMetrics = true
+	}
+}
+
+// WithHashSeed mixes seed into the initial state of the FNV hash that picks the shard of a key, and scrambles the resulting hash, so that keys an attacker crafted to land in a single shard of an unseeded hashtable spread out again. Placement stays deterministic for a given seed, and a seed of 0 leaves the hashing unseeded, which is the default. The seed doesn't affect the package level Hash, which always reports the unseeded hash. It is no cryptographic defense: anyone who learns the seed, or can observe placements, can still craft colliding keys.
+func WithHashSeed(seed uint32) Option {
+	return func(o *options) {
+		o.hashSeed = seed
+	}
+}
+
+// WithRandomSeed is WithHashSeed with a seed drawn from crypto/rand, so shard placement can't be predicted from outside the process. Each hashtable gets its own seed, so the same keys land in different shards in different hashtables and processes: dumps written by DumpTo lose their portability, as RestoreFrom has to rehash every record of a dump coming from another hashtable instead of placing it directly.
+func WithRandomSeed() Option {
+	return func(o *options) {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			binary.LittleEndian.PutUint32(b[:], uint32(time.Now().UnixNano()))
+		}
+		o.hashSeed = binary.LittleEndian.Uint32(b[:])
+	}
+}
+
+// WithValueCodec makes the hashtable store every value as encode returns it and hand it out as decode returns it, e.g. to keep values encrypted or compressed in memory without changing any call site. Every read, iteration, export, dump, event, and callback sees decoded values, and only GetRaw shows the stored ones. Values are decoded whenever they are read, also by operations that read many of them like Range or EncodeJSON, while a Resize moves them as they are stored, without decoding them. Sizes, limits, and WithValueEquals apply to the decoded values. decode(encode(v)) must give back v, and both are called under the shard locks, so they must not use the hashtable. It applies on top of WithShardStore.
+func WithValueCodec(encode func(string) string, decode func(string) string) Option {
+	return func(o *options) {
+		o.encode = encode
+		o.decode = decode
+	}
+}
+
+// WithHotShardSplitting makes the hashtable watch for shards growing disproportionately, as reported by HotShards, and split every shard that becomes hot into 8 sub-shards, each with its own lock, picked by a second hash of the keys independent of the first one. The writers of the keys crowding the shard, e.g. because its hasher or crafted keys made them collide, then spread over several locks without a full Resize. It is an adaptive mitigation, not a guarantee: keys colliding under both hashes still share a sub-shard, a shard is split only once, and a split waits for the next write adding or removing a key of the shard if a lock of LockKey is held, since it changes the ShardIndex of the keys moved. Every shard that becomes hot is also reported to the logger of WithLogger, along with every split. Resize merges the sub-shards back into the shards it lays out. Checking costs a few comparisons on every write that changes the size of a shard, and a split moves the records of the hot shard under the write locks of layoutMu and of that shard.
+func WithHotShardSplitting() Option {
+	return func(o *options) {
+		o.hotShardSplitting = true
+	}
+}
@@ -0,0 +1,153 @@
+package cmap
+
+import (
+	"sort"
+	"sync"
+)
+
+// orderedIndex keeps the keys of the hashtable sorted, for PageByKey. It is only kept with WithOrderedIndex. Its lock is taken under the shard locks, never the other way around.
+type orderedIndex struct {
+	mu   sync.RWMutex
+	keys []string
+}
+
+// add inserts the key, which must not be in the index yet.
+func (x *orderedIndex) add(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	i := sort.SearchStrings(x.keys, key)
+	x.keys = append(x.keys, "")
+	copy(x.keys[i+1:], x.keys[i:])
+	x.keys[i] = key
+}
+
+// remove deletes the key, if it is in the index.
+func (x *orderedIndex) remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		copy(x.keys[i:], x.keys[i+1:])
+		x.keys[len(x.keys)-1] = ""
+		x.keys = x.keys[:len(x.keys)-1]
+	}
+}
+
+// removeAll deletes the keys of the given store from the index, in a single pass over it.
+func (x *orderedIndex) removeAll(data ShardStore) {
+	if data.Len() == 0 {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	keys := x.keys[:0]
+	for _, k := range x.keys {
+		if _, ok := data.Get(k); !ok {
+			keys = append(keys, k)
+		}
+	}
+	for i := len(keys); i < len(x.keys); i++ {
+		x.keys[i] = ""
+	}
+	x.keys = keys
+}
+
+// after returns up to limit keys greater than the given one, or equal to it too if inclusive is true, in ascending order.
+func (x *orderedIndex) after(key string, inclusive bool, limit int) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	i := sort.Search(len(x.keys), func(i int) bool { return x.keys[i] > key || inclusive && x.keys[i] == key })
+	j := len(x.keys)
+	if limit < j-i {
+		j = i + limit
+	}
+	return append([]string(nil), x.keys[i:j]...)
+}
+
+// FirstPage returns up to limit records with the smallest keys, in ascending order of keys, starting the pagination continued by PageByKey. Unlike PageByKey(""), it includes the record with the empty key, if there is one. It needs WithOrderedIndex, otherwise it returns nil.
+func (h HashTable) FirstPage(limit int) []Pair {
+	return h.page("", true, limit)
+}
+
+// PageByKey returns up to limit records whose keys come after the given key, in ascending order of keys, for paginating through the hashtable. Get the first page with FirstPage, then pass the key of the last record of a page to get the next one. Pages stay consistent while records are added or deleted between the calls: a record is never returned twice, and records added after the page they would have been on are not returned. It needs WithOrderedIndex, otherwise it returns nil.
+func (h HashTable) PageByKey(after string, limit int) []Pair {
+	return h.page(after, false, limit)
+}
+
+// page returns up to limit records whose keys come after the given key, or are equal to it too if inclusive is true, skipping the keys deleted since they were read from the index.
+func (h HashTable) page(after string, inclusive bool, limit int) []Pair {
+	if !h.opts.orderedIndex || limit <= 0 {
+		return nil
+	}
+
+	// A limit asking for the rest of the records may be huge, so the page is pre-sized for the keys there are at most.
+	size := h.ordered.len()
+	if limit < size {
+		size = limit
+	}
+
+	page := make([]Pair, 0, size)
+	for len(page) < limit {
+		keys := h.ordered.after(after, inclusive, limit-len(page))
+		if len(keys) == 0 {
+			break
+		}
+
+		page = h.appendPairs(page, keys)
+		after, inclusive = keys[len(keys)-1], false
+	}
+	return page
+}
+
+// len returns the number of keys in the index.
+func (x *orderedIndex) len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return len(x.keys)
+}
+
+// between returns the keys in [start, end), in ascending order.
+func (x *orderedIndex) between(start string, end string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	i := sort.SearchStrings(x.keys, start)
+	j := sort.SearchStrings(x.keys, end)
+	if j < i {
+		j = i
+	}
+	return append([]string(nil), x.keys[i:j]...)
+}
+
+// GetRange returns the records whose keys fall in [start, end), in ascending order of keys. With WithOrderedIndex only the keys in the interval get looked at. Without it, every shard is scanned and the matching records get sorted, which costs as much as a full iteration of the hashtable.
+func (h HashTable) GetRange(start string, end string) []Pair {
+	if !h.opts.orderedIndex {
+		var pairs []Pair
+		h.Range(func(k, v string) bool {
+			if k >= start && k < end {
+				pairs = append(pairs, Pair{Key: k, Value: v})
+			}
+			return true
+		})
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		return pairs
+	}
+
+	return h.appendPairs(nil, h.ordered.between(start, end))
+}
+
+// appendPairs appends the records of the given keys to pairs, in the order of the keys, skipping the ones that no longer exist.
+func (h HashTable) appendPairs(pairs []Pair, keys []string) []Pair {
+	for _, k := range keys {
+		if v, ok, _ := h.peek(k); ok {
+			pairs = append(pairs, Pair{Key: k, Value: v})
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,184 @@
+package cmap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The protobuf encoding is hand-rolled to avoid a dependency. It is wire compatible with the following message:
+//
+//	message HashTable {
+//	  map<string, string> data = 1;
+//	}
+//
+// A map field is encoded as a repeated entry message whose key is field 1 and whose value is field 2.
+const (
+	protoWireVarint = 0
+	protoWireI64    = 1
+	protoWireLen    = 2
+	protoWireI32    = 5
+)
+
+var errProtoTruncated = fmt.Errorf("%w: truncated protobuf message", ErrInvalidEncoding)
+
+// MarshalProto encodes the records of the hashtable as a protobuf message with a single map<string, string> field numbered 1. Each shard is snapshotted under its read lock.
+func (h HashTable) MarshalProto() ([]byte, error) {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var b []byte
+	for _, shard := range h.shards() {
+		shard.read(func() {
+			shard.each(func(k, v string) bool {
+				entry := protoEntrySize(k, v)
+				b = appendProtoTag(b, 1, protoWireLen)
+				b = appendProtoVarint(b, uint64(entry))
+				b = appendProtoString(b, 1, k)
+				b = appendProtoString(b, 2, v)
+				return true
+			})
+		})
+	}
+	return b, nil
+}
+
+// UnmarshalProto decodes a protobuf message produced by MarshalProto, or any message with a map<string, string> field numbered 1, into a new hashtable. Unknown fields are skipped.
+func UnmarshalProto(b []byte) (*HashTable, error) {
+	ht := New()
+	for len(b) > 0 {
+		field, wire, n := consumeProtoTag(b)
+		if n < 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+
+		if field != 1 || wire != protoWireLen {
+			n = skipProtoField(b, wire)
+			if n < 0 {
+				return nil, fmt.Errorf("%w: invalid protobuf field %d", ErrInvalidEncoding, field)
+			}
+			b = b[n:]
+			continue
+		}
+
+		entry, n := consumeProtoBytes(b)
+		if n < 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+
+		k, v, err := decodeProtoEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		ht.Put(k, v)
+	}
+	return ht, nil
+}
+
+// decodeProtoEntry decodes a single map entry message.
+func decodeProtoEntry(b []byte) (key string, value string, err error) {
+	for len(b) > 0 {
+		field, wire, n := consumeProtoTag(b)
+		if n < 0 {
+			return "", "", errProtoTruncated
+		}
+		b = b[n:]
+
+		if (field != 1 && field != 2) || wire != protoWireLen {
+			n = skipProtoField(b, wire)
+			if n < 0 {
+				return "", "", fmt.Errorf("%w: invalid protobuf field %d in map entry", ErrInvalidEncoding, field)
+			}
+			b = b[n:]
+			continue
+		}
+
+		s, n := consumeProtoBytes(b)
+		if n < 0 {
+			return "", "", errProtoTruncated
+		}
+		b = b[n:]
+
+		if field == 1 {
+			key = string(s)
+		} else {
+			value = string(s)
+		}
+	}
+	return key, value, nil
+}
+
+// protoEntrySize returns the encoded length of a map entry message holding the given key and value.
+func protoEntrySize(key string, value string) int {
+	return 1 + protoVarintSize(uint64(len(key))) + len(key) + 1 + protoVarintSize(uint64(len(value))) + len(value)
+}
+
+func protoVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendProtoTag(b []byte, field int, wire int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	b = appendProtoTag(b, field, protoWireLen)
+	b = appendProtoVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// consumeProtoTag parses a field tag. It returns a negative length if the tag is malformed.
+func consumeProtoTag(b []byte) (field int, wire int, n int) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 || v>>3 == 0 {
+		return 0, 0, -1
+	}
+	return int(v >> 3), int(v & 7), n
+}
+
+// consumeProtoBytes parses a length-delimited value. It returns a negative length if the value is malformed.
+func consumeProtoBytes(b []byte) ([]byte, int) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, -1
+	}
+	return b[n : n+int(l)], n + int(l)
+}
+
+// skipProtoField returns the length of a field value of the given wire type, or a negative length if it is malformed.
+func skipProtoField(b []byte, wire int) int {
+	switch wire {
+	case protoWireVarint:
+		_, n := binary.Uvarint(b)
+		if n <= 0 {
+			return -1
+		}
+		return n
+	case protoWireI64:
+		if len(b) < 8 {
+			return -1
+		}
+		return 8
+	case protoWireLen:
+		_, n := consumeProtoBytes(b)
+		return n
+	case protoWireI32:
+		if len(b) < 4 {
+			return -1
+		}
+		return 4
+	}
+	return -1
+}
@@ -0,0 +1,38 @@
+package cmap
+
+import "sync"
+
+// Reduce aggregates the records of the hashtable, using the shards as parallel partitions. Every record is turned into an R by mapFn and the results of each shard are folded with reduce, starting from identity, by one goroutine per shard. The results of the shards are then folded together in shard order. Each shard is read-locked while it is scanned, and mapFn and reduce run under that lock, so they must not call any method of the hashtable, not even a read like Len, Get, or Range, since that can deadlock once a writer or a Resize is waiting. reduce must be associative and identity must be its neutral element, since the order in which records get folded is unspecified. It is a function rather than a method because methods can't have type parameters.
+func Reduce[R any](h *HashTable, mapFn func(key string, value string) R, reduce func(a R, b R) R, identity R) R {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	results := make([]R, len(shards))
+
+	var wg sync.WaitGroup
+	for i, s := range shards {
+		wg.Add(1)
+		go func(i int, s *shard) {
+			defer wg.Done()
+
+			acc := identity
+
+			s.Lock.RLock()
+			defer s.Lock.RUnlock()
+
+			s.each(func(k, v string) bool {
+				acc = reduce(acc, mapFn(k, v))
+				return true
+			})
+			results[i] = acc
+		}(i, s)
+	}
+	wg.Wait()
+
+	acc := identity
+	for _, r := range results {
+		acc = reduce(acc, r)
+	}
+	return acc
+}
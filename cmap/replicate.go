@@ -0,0 +1,117 @@
+package cmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// replicaBuffer is the number of events a replica may fall behind before events get dropped and it has to resynchronize.
+const replicaBuffer = 4096
+
+// Replicate makes to a read replica of the hashtable: it copies the current records to it, then applies every write and deletion of the hashtable to it, in the background, through an event subscription. The replica is eventually consistent: it lags behind by the events in flight. If it falls so far behind that events of its subscription get dropped, the events still waiting are discarded and it is resynchronized by copying every record again and deleting the keys the hashtable no longer has, so to should be dedicated to the replica. Drops of other subscribers don't affect it. TTLs are not replicated. The returned function stops the replication and waits for it to finish, after which to is no longer changed. Closing the hashtable stops it too, once the pending events are applied.
+func (h HashTable) Replicate(to *HashTable) (stop func()) {
+	if h.table == to.table {
+		return func() {}
+	}
+
+	in, unsubscribe, sub := h.subscribe(replicaBuffer)
+	halt := make(chan struct{})
+	done := make(chan struct{})
+
+	// Once closed, the hashtable doesn't change anymore, so a single copy is all there is to replicate.
+	if !h.startWorker() {
+		unsubscribe()
+		h.copyTo(to)
+		return func() {}
+	}
+	go func() {
+		defer h.workers.Done()
+		defer close(done)
+
+		var dropped uint64
+		h.copyTo(to)
+
+		for {
+			select {
+			case e, ok := <-in:
+				if !ok {
+					return
+				}
+				// The events waiting behind a drop are older than the records resync copies, so applying them afterwards could bring back stale values.
+				if d := atomic.LoadUint64(&sub.dropped); d != dropped {
+					dropped = d
+					open := discard(in)
+					h.resync(to)
+					if !open {
+						return
+					}
+					continue
+				}
+				applyEvent(to, e)
+			case <-h.closed:
+				unsubscribe()
+				for e := range in {
+					applyEvent(to, e)
+				}
+				if atomic.LoadUint64(&sub.dropped) != dropped {
+					h.resync(to)
+				}
+				return
+			case <-halt:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(halt)
+			unsubscribe()
+			<-done
+		})
+	}
+}
+
+// discard drops the events waiting in the channel without blocking, returning false if the channel got closed.
+func discard(in <-chan Event) bool {
+	for {
+		select {
+		case _, ok := <-in:
+			if !ok {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// applyEvent applies the write or deletion described by the event to the hashtable.
+func applyEvent(to *HashTable, e Event) {
+	switch e.Op {
+	case OpPut:
+		to.Put(e.Key, e.NewValue)
+	case OpDel:
+		to.Del(e.Key)
+	}
+}
+
+// copyTo puts every record of the hashtable into to.
+func (h HashTable) copyTo(to *HashTable) {
+	h.Range(func(k, v string) bool {
+		to.Put(k, v)
+		return true
+	})
+}
+
+// resync makes to hold the records of the hashtable again, after events got lost, by copying them all and deleting the keys of to the hashtable doesn't have.
+func (h HashTable) resync(to *HashTable) {
+	h.copyTo(to)
+	to.Range(func(k, _ string) bool {
+		if !h.Has(k) {
+			to.Del(k)
+		}
+		return true
+	})
+}
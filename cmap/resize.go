@@ -0,0 +1,202 @@
+package cmap
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// migration tracks the records still to be moved out of the shards of a previous layout. Every shard of the previous layout is migrated once, either lazily by the first operation that needs one of its keys or by the background goroutine started by Resize.
+type migration struct {
+	prev  *layout
+	from  []*shard
+	done  []uint32 // accessed atomically.
+	mu    []sync.Mutex
+	moved int64 // accessed atomically.
+}
+
+// recordsPerShard is the number of records per shard RecommendShardCount aims for.
+const recordsPerShard = 1024
+
+// RecommendShardCount suggests more shards once more than one in maxContendedRatio lock acquisitions had to wait, out of at least minAcquisitions.
+const (
+	maxContendedRatio = 20
+	minAcquisitions   = 1000
+)
+
+// MaxShardCount is the largest number of shards a hashtable can have.
+const MaxShardCount = 1 << 16
+
+// NormalizeShardCount returns the number of shards actually used when n are asked for: n rounded up to the next power of two, between 1 and MaxShardCount. Powers of two keep the modulo of the shard selection cheap and spread the keys evenly. WithShardCount and Resize apply it to their argument.
+func NormalizeShardCount(n int) int {
+	if n > MaxShardCount {
+		n = MaxShardCount
+	}
+
+	count := 1
+	for count < n {
+		count <<= 1
+	}
+	return count
+}
+
+// RecommendShardCount suggests a number of shards for the current size of the hashtable, always a power of two. It aims for about 1024 records per shard, but never fewer than 4 shards per available CPU, so that concurrent operations rarely meet on the same lock. With WithContentionMetrics, it also suggests at least twice the current number of shards once more than one in 20 lock acquisitions had to wait, out of at least 1000 since the last Resize. It is only advisory, pass the result to Resize to act on it.
+func (h HashTable) RecommendShardCount() int {
+	n := h.ApproxLen() / recordsPerShard
+	if min := 4 * runtime.GOMAXPROCS(0); n < min {
+		n = min
+	}
+	if h.contended() {
+		if more := 2 * h.layout().primaries; n < more {
+			n = more
+		}
+	}
+	return NormalizeShardCount(n)
+}
+
+// Resize changes the number of shards to n, normalized by NormalizeShardCount. The new layout takes effect right away, but records are moved to their new shards incrementally: each shard of the previous layout is migrated by the first operation needing one of its keys, and a background goroutine migrates the rest. Shards that keep their index are reused, so only the records whose shard changed get moved. While the migration runs, an operation on a single key may first have to wait for the migration of the old shard of its key, and operations spanning several shards finish the whole migration before they start. If a previous resize is still migrating, it gets finished first. The sub-shards of a split by WithHotShardSplitting are merged back: the keys are spread over the n shards again, and every shard may be split anew. It waits until every lock taken by LockKey is released, so it must not be called while holding one.
+func (h HashTable) Resize(n int) {
+	if h.isClosed() {
+		return
+	}
+	n = NormalizeShardCount(n)
+
+	h.keyLocks.quiesce()
+	defer h.keyLocks.mu.Unlock()
+
+	h.layoutMu.Lock()
+
+	// The migration goroutine is counted before the layout changes, so a Close running meanwhile either waits for it or leaves the layout as it is.
+	if !h.startWorker() {
+		h.layoutMu.Unlock()
+		return
+	}
+
+	old := h.shards()
+	shards := make([]*shard, n)
+	copy(shards, old)
+	if h.opts.contentionMetrics {
+		for _, s := range old {
+			s.Lock.(*countingLock).reset()
+		}
+	}
+	for i := len(old); i < n; i++ {
+		shards[i] = newShard(&h.opts)
+	}
+	for _, s := range shards {
+		atomic.StoreUint32(&s.grouped, 0)
+	}
+
+	l := &layout{
+		shards:    shards,
+		primaries: n,
+		migration: &migration{
+			prev: h.layout(),
+			from: old,
+			done: make([]uint32, len(old)),
+			mu:   make([]sync.Mutex, len(old)),
+		},
+	}
+	h.current.Store(l)
+	h.layoutMu.Unlock()
+
+	go func() {
+		defer h.workers.Done()
+
+		h.migrateAll(l)
+		h.current.CompareAndSwap(l, &layout{shards: shards, primaries: n})
+
+		if logger := h.opts.logger; logger != nil {
+			moved := atomic.LoadInt64(&l.migration.moved)
+			runCallback(h.opts.onPanic, func() {
+				logger("cmap: resized from %d to %d shards (%d records moved)", len(old), n, moved)
+			})
+		}
+	}()
+}
+
+// route returns the shard of the layout that holds the key. If the layout is migrating and the key may still be in a shard of the previous layout, that shard gets migrated first.
+func (h HashTable) route(l *layout, key string) *shard {
+	s := l.shards[h.locate(l, key)]
+
+	if m := l.migration; m != nil {
+		i := h.locate(m.prev, key)
+		if m.from[i] != s {
+			h.migrateShard(l, i)
+		}
+	}
+	return s
+}
+
+// migrateAll migrates every shard of the previous layout that hasn't been migrated yet.
+func (h HashTable) migrateAll(l *layout) {
+	for i := range l.migration.from {
+		h.migrateShard(l, i)
+	}
+}
+
+// migrateShard moves the records of the i-th shard of the previous layout that belong to another shard in the new layout. The records are taken out under the old shard's lock and then put into their new shards one lock at a time, so no lock is held while waiting for another. Operations depending on the shard wait for its migration to finish, so they never see a record in flight. Moving records queues no hooks, so write returns none here.
+func (h HashTable) migrateShard(l *layout, i int) {
+	m := l.migration
+	if atomic.LoadUint32(&m.done[i]) == 1 {
+		return
+	}
+
+	m.mu[i].Lock()
+	defer m.mu[i].Unlock()
+
+	if atomic.LoadUint32(&m.done[i]) == 1 {
+		return
+	}
+
+	src := m.from[i]
+
+	var records []record
+	var tombstones []tombstone
+	src.write(func() {
+		var keys []string
+		src.raw().Range(func(k, _ string) bool {
+			if l.shards[h.locate(l, k)] != src {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		records = make([]record, len(keys))
+		for j, k := range keys {
+			records[j] = src.take(k)
+		}
+		for k, t := range src.tombstones {
+			if l.shards[h.locate(l, k)] != src {
+				tombstones = append(tombstones, t)
+				delete(src.tombstones, k)
+			}
+		}
+	})
+
+	for _, r := range records {
+		dst := l.shards[h.locate(l, r.key)]
+		dst.write(func() {
+			dst.put(r)
+		})
+	}
+	for _, t := range tombstones {
+		dst := l.shards[h.locate(l, t.key)]
+		dst.write(func() {
+			dst.bury(t.record, t.purgeAt)
+		})
+	}
+
+	atomic.AddInt64(&m.moved, int64(len(records)))
+	atomic.StoreUint32(&m.done[i], 1)
+}
+
+// jumpHash maps the key to one of n buckets using the jump consistent hash of Lamping and Veach.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
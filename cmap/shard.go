@@ -0,0 +1,378 @@
+package cmap
+
+import (
+	"sort"
+	"time"
+)
+
+type shard struct {
+	Lock     rwLocker
+	Data     ShardStore
+	versions map[string]uint64
+	expires  map[string]int64  // unix nanoseconds, only for records with a TTL.
+	modified map[string]int64  // unix nanoseconds of the last write of each record.
+	inserted map[string]uint64 // insertion sequence of each record, see EntryMeta.InsertSeq.
+	seq      uint64
+	hooks    []func()
+
+	// idle keeps the idle timeouts, in nanoseconds, of the records stored with PutWithTTI. It is nil until the first one.
+	idle map[string]int64
+	// weights keeps the weights of the records stored with PutWithWeight. It is nil until the first one.
+	weights map[string]int
+
+	// tombstones keeps the records deleted with WithSoftDelete until they are undeleted or purged. It is nil until the first one.
+	tombstones map[string]tombstone
+
+	newStore func() ShardStore
+	onPanic  func(recovered interface{})
+
+	// deleted counts the deletions since the maps were last rebuilt. The maps get rebuilt by unlock once compactDue is set.
+	deleted    int
+	compactDue bool
+
+	// hot is set while the shard is hot, for WithHotShardSplitting to report it only once.
+	hot bool
+
+	// grouped is 1 while the shard is one of the sub-shards of a split, which WithHotShardSplitting doesn't split again. It is accessed atomically, since Resize resets it without the shard's lock.
+	grouped uint32
+}
+
+func newShard(o *options) *shard {
+	s := &shard{Lock: o.newLock(), newStore: o.newStore, onPanic: o.onPanic}
+	if s.newStore == nil {
+		s.newStore = newMapStore
+	}
+	if o.encode != nil && o.decode != nil {
+		newStore := s.newStore
+		s.newStore = func() ShardStore {
+			return &codecStore{store: newStore(), encode: o.encode, decode: o.decode}
+		}
+	}
+	s.reset()
+	return s
+}
+
+// reset empties the shard and returns its previous records. The caller must hold the write lock.
+func (s *shard) reset() ShardStore {
+	data := s.Data
+	s.Data = s.newStore()
+	s.versions = make(map[string]uint64)
+	s.expires = make(map[string]int64)
+	s.modified = make(map[string]int64)
+	s.inserted = make(map[string]uint64)
+	s.idle = nil
+	s.weights = nil
+	s.tombstones = nil
+	s.deleted = 0
+	s.compactDue = false
+	return data
+}
+
+// compact rebuilds the store and the maps of the shard with their current contents. Go maps never give back the memory of deleted entries, so this reclaims it after many deletions. The caller must hold the write lock.
+func (s *shard) compact() {
+	data := s.newStore()
+	raw := rawStore(data)
+	s.raw().Range(func(k, v string) bool {
+		raw.Set(k, v)
+		return true
+	})
+	versions := make(map[string]uint64, len(s.versions))
+	for k, v := range s.versions {
+		versions[k] = v
+	}
+	expires := make(map[string]int64, len(s.expires))
+	for k, v := range s.expires {
+		expires[k] = v
+	}
+	modified := make(map[string]int64, len(s.modified))
+	for k, v := range s.modified {
+		modified[k] = v
+	}
+	inserted := make(map[string]uint64, len(s.inserted))
+	for k, v := range s.inserted {
+		inserted[k] = v
+	}
+	if s.idle != nil {
+		idle := make(map[string]int64, len(s.idle))
+		for k, d := range s.idle {
+			idle[k] = d
+		}
+		s.idle = idle
+	}
+	if s.weights != nil {
+		weights := make(map[string]int, len(s.weights))
+		for k, w := range s.weights {
+			weights[k] = w
+		}
+		s.weights = weights
+	}
+	if s.tombstones != nil {
+		tombstones := make(map[string]tombstone, len(s.tombstones))
+		for k, t := range s.tombstones {
+			tombstones[k] = t
+		}
+		s.tombstones = tombstones
+	}
+
+	s.Data, s.versions, s.expires, s.modified, s.inserted = data, versions, expires, modified, inserted
+	s.deleted = 0
+	s.compactDue = false
+}
+
+// unlock compacts the shard if it is due, releases the write lock, and then runs the hooks queued while it was held, so user callbacks never run under the lock.
+func (s *shard) unlock() {
+	s.runHooks(s.release())
+}
+
+// release compacts the shard if it is due and releases the write lock, returning the hooks queued while it was held for the caller to run with runHooks.
+func (s *shard) release() []func() {
+	defer s.Lock.Unlock()
+
+	if s.compactDue {
+		s.compact()
+	}
+
+	hooks := s.hooks
+	s.hooks = nil
+	return hooks
+}
+
+// read calls f holding the read lock, which is released even if f panics, for loops visiting several shards one after the other.
+func (s *shard) read(f func()) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+
+	f()
+}
+
+// write calls f holding the write lock, which is released by release even if f panics, for loops visiting several shards one after the other. It returns the hooks queued while the lock was held, which the loop collects in a hookQueue to run once it holds no lock.
+func (s *shard) write(f func()) (hooks []func()) {
+	s.Lock.Lock()
+	defer func() { hooks = s.release() }()
+
+	f()
+	return nil
+}
+
+// runHooks runs the given hooks. The shard lock must not be held.
+func (s *shard) runHooks(hooks []func()) {
+	for _, f := range hooks {
+		runCallback(s.onPanic, f)
+	}
+}
+
+// hookQueue collects the hooks queued on the shards written by an operation spanning several shards. Such an operation holds layoutMu for reading, so the hooks only run once it is released: a hook calling Resize, or calling any method taking layoutMu while a Resize waits for it, would deadlock otherwise.
+type hookQueue []func()
+
+// add appends the hooks returned by write or release to the queue.
+func (q *hookQueue) add(hooks []func()) {
+	*q = append(*q, hooks...)
+}
+
+// run runs the collected hooks, passing their panics to handler when there is one. No lock may be held, layoutMu included.
+func (q *hookQueue) run(handler func(recovered interface{})) {
+	for _, f := range *q {
+		runCallback(handler, f)
+	}
+}
+
+// get returns the value of the key, treating an expired record as absent. The caller must hold the read lock.
+func (s *shard) get(key string) (string, bool) {
+	v, ok := s.Data.Get(key)
+	if ok && len(s.expires) > 0 && s.expired(key, now()) {
+		return "", false
+	}
+	return v, ok
+}
+
+// each calls f for every record that hasn't expired until f returns false. The caller must hold the read lock.
+func (s *shard) each(f func(key string, value string) bool) {
+	now := now()
+	s.Data.Range(func(k, v string) bool {
+		if s.expired(k, now) {
+			return true
+		}
+		return f(k, v)
+	})
+}
+
+// eachSorted is like each, but visits the records in ascending order of keys, so the order doesn't depend on the map. The caller must hold the read lock.
+func (s *shard) eachSorted(f func(key string, value string) bool) {
+	records := make([]record, 0, s.Data.Len())
+	s.each(func(k, v string) bool {
+		records = append(records, record{key: k, value: v})
+		return true
+	})
+	sortRecords(records)
+
+	for _, r := range records {
+		if !f(r.key, r.value) {
+			return
+		}
+	}
+}
+
+// sortRecords sorts the records in ascending order of keys.
+func sortRecords(records []record) {
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+}
+
+// expired returns true if the record of the key has a TTL that has run out at the given time. The caller must hold the read lock.
+func (s *shard) expired(key string, now int64) bool {
+	if len(s.expires) == 0 {
+		return false
+	}
+	exp, ok := s.expires[key]
+	return ok && exp <= now
+}
+
+// set stores the key-value pair and gives the key a new version taken from the shard's sequence, so versions never get reused, even after a deletion. The key's modification time is set to now and any TTL, idle timeout, or weight of the key is dropped. The caller must hold the write lock.
+func (s *shard) set(key string, value string) uint64 {
+	s.seq++
+	s.Data.Set(key, value)
+	s.versions[key] = s.seq
+	s.modified[key] = now()
+	delete(s.expires, key)
+	delete(s.idle, key)
+	delete(s.weights, key)
+	return s.seq
+}
+
+// del removes the record along with its metadata. The caller must hold the write lock.
+func (s *shard) del(key string) (string, bool) {
+	v, ok := s.Data.Get(key)
+	if ok {
+		s.deleted++
+	}
+	s.Data.Delete(key)
+	delete(s.versions, key)
+	delete(s.expires, key)
+	delete(s.modified, key)
+	delete(s.inserted, key)
+	delete(s.idle, key)
+	delete(s.weights, key)
+	return v, ok
+}
+
+// record is a record taken out of a shard along with its metadata, so that it can be put into another one.
+type record struct {
+	key       string
+	value     string
+	version   uint64
+	modified  int64
+	inserted  uint64
+	expires   int64
+	hasExpiry bool
+	idle      int64 // nanoseconds, only for records stored with PutWithTTI.
+	weight    int
+}
+
+// take removes the record of the key, along with its metadata, and returns it with its value as stored, still encoded by the codec of WithValueCodec if there is one. Unlike del, it doesn't count as a deletion. The caller must hold the write lock.
+func (s *shard) take(key string) record {
+	r := record{key: key, version: s.versions[key], modified: s.modified[key], inserted: s.inserted[key]}
+	r.value, _ = s.raw().Get(key)
+	r.expires, r.hasExpiry = s.expires[key]
+	r.idle = s.idle[key]
+	r.weight = s.weights[key]
+
+	s.Data.Delete(key)
+	delete(s.versions, key)
+	delete(s.expires, key)
+	delete(s.modified, key)
+	delete(s.inserted, key)
+	delete(s.idle, key)
+	delete(s.weights, key)
+	return r
+}
+
+// put stores a record taken from another shard of the same hashtable, whose value is stored as it is. The shard's sequence is advanced past the record's version so its versions stay monotonic. The caller must hold the write lock.
+func (s *shard) put(r record) {
+	s.raw().Set(r.key, r.value)
+	s.versions[r.key] = r.version
+	s.modified[r.key] = r.modified
+	s.inserted[r.key] = r.inserted
+	if s.seq < r.version {
+		s.seq = r.version
+	}
+	if r.hasExpiry {
+		s.expires[r.key] = r.expires
+	}
+	if r.idle > 0 {
+		s.setIdle(r.key, r.idle)
+	}
+	if r.weight != 0 {
+		s.setWeight(r.key, r.weight)
+	}
+}
+
+// raw returns the store of the shard without the codec of WithValueCodec, so values can be moved between stores without decoding them.
+func (s *shard) raw() ShardStore {
+	return rawStore(s.Data)
+}
+
+// rawStore returns the store wrapped by the codec of WithValueCodec, or store itself if it has no codec.
+func rawStore(store ShardStore) ShardStore {
+	if c, ok := store.(*codecStore); ok {
+		return c.store
+	}
+	return store
+}
+
+// setWeight records the weight of the key. The caller must hold the write lock.
+func (s *shard) setWeight(key string, weight int) {
+	if s.weights == nil {
+		s.weights = make(map[string]int)
+	}
+	s.weights[key] = weight
+}
+
+// setIdle records the idle timeout of the key, in nanoseconds. The caller must hold the write lock.
+func (s *shard) setIdle(key string, idle int64) {
+	if s.idle == nil {
+		s.idle = make(map[string]int64)
+	}
+	s.idle[key] = idle
+}
+
+// tombstone is a record deleted with WithSoftDelete, kept to be undeleted until purgeAt, in unix nanoseconds.
+type tombstone struct {
+	record
+	purgeAt int64
+}
+
+// bury keeps the record as a tombstone until purgeAt. The caller must hold the write lock.
+func (s *shard) bury(r record, purgeAt int64) {
+	if s.tombstones == nil {
+		s.tombstones = make(map[string]tombstone)
+	}
+	s.tombstones[r.key] = tombstone{record: r, purgeAt: purgeAt}
+}
+
+// purge removes the tombstones whose retention has run out at the given time and returns how many it removed. The caller must hold the write lock.
+func (s *shard) purge(now int64) int {
+	var n int
+	for k, t := range s.tombstones {
+		if t.purgeAt <= now {
+			delete(s.tombstones, k)
+			n++
+		}
+	}
+	return n
+}
+
+// runCallback calls the user callback f. If f panics, the panic is passed to handler when there is one, otherwise it propagates.
+func runCallback(handler func(recovered interface{}), f func()) {
+	if handler != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				handler(r)
+			}
+		}()
+	}
+	f()
+}
+
+// now returns the current time in unix nanoseconds.
+func now() int64 {
+	return time.Now().UnixNano()
+}
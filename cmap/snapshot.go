@@ -0,0 +1,146 @@
+package cmap
+
+import "sort"
+
+var (
+	_ Map = Snapshot{}
+	_ Map = FrozenMap{}
+	_ Map = ReadOnlyView{}
+)
+
+// Snapshot is a copy of the records of a hashtable at a single moment, as taken by Snapshot. It never changes, so it is safe for concurrent use without any lock.
+type Snapshot struct {
+	data map[string]string
+}
+
+// Snapshot copies the records of the hashtable into a Snapshot. All the shards are read-locked together, in ascending order, so the copy shows a single moment of the hashtable, never a multi-key write half-applied, at the cost of stalling writers while it runs. Expired records are left out.
+func (h HashTable) Snapshot() Snapshot {
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	shards := h.shards()
+	for _, s := range shards {
+		s.Lock.RLock()
+		defer s.Lock.RUnlock()
+	}
+
+	data := make(map[string]string, h.ApproxLen())
+	for _, s := range shards {
+		s.each(func(k, v string) bool {
+			data[k] = v
+			return true
+		})
+	}
+	return Snapshot{data: data}
+}
+
+// Get returns the value of the key in the snapshot and true, or the empty string and false if it doesn't exist.
+func (s Snapshot) Get(key string) (string, bool) {
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// Has returns true if the snapshot contains the key.
+func (s Snapshot) Has(key string) bool {
+	_, ok := s.data[key]
+	return ok
+}
+
+// Len returns the number of records in the snapshot.
+func (s Snapshot) Len() int {
+	return len(s.data)
+}
+
+// Range calls f for every record of the snapshot, in no particular order, until f returns false.
+func (s Snapshot) Range(f func(key string, value string) bool) {
+	for k, v := range s.data {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// FrozenMap is an immutable map kept as two slices sorted by key, which takes less memory than a Go map and visits its records in ascending order of keys. Lookups are binary searches, so they cost O(log n). It is safe for concurrent use without any lock.
+type FrozenMap struct {
+	keys   []string
+	values []string
+}
+
+// NewFrozenMap returns a FrozenMap holding a copy of the records of data.
+func NewFrozenMap(data map[string]string) FrozenMap {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = data[k]
+	}
+	return FrozenMap{keys: keys, values: values}
+}
+
+// Freeze returns a FrozenMap holding the records of the snapshot.
+func (s Snapshot) Freeze() FrozenMap {
+	return NewFrozenMap(s.data)
+}
+
+// Get returns the value of the key in the map and true, or the empty string and false if it doesn't exist.
+func (m FrozenMap) Get(key string) (string, bool) {
+	i := sort.SearchStrings(m.keys, key)
+	if i == len(m.keys) || m.keys[i] != key {
+		return "", false
+	}
+	return m.values[i], true
+}
+
+// Has returns true if the map contains the key.
+func (m FrozenMap) Has(key string) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+// Len returns the number of records in the map.
+func (m FrozenMap) Len() int {
+	return len(m.keys)
+}
+
+// Range calls f for every record of the map, in ascending order of keys, until f returns false.
+func (m FrozenMap) Range(f func(key string, value string) bool) {
+	for i, k := range m.keys {
+		if !f(k, m.values[i]) {
+			return
+		}
+	}
+}
+
+// ReadOnlyView gives access to the reads of a hashtable without its writes, for handing a live hashtable to code that must not change it. It doesn't copy anything, so it always shows the current records. Its methods behave exactly like the ones of the hashtable, a Get missing a key still calls the loader of WithLoader.
+type ReadOnlyView struct {
+	h HashTable
+}
+
+// ReadOnly returns a ReadOnlyView of the hashtable.
+func (h HashTable) ReadOnly() ReadOnlyView {
+	return ReadOnlyView{h: h}
+}
+
+// Get is HashTable.Get.
+func (v ReadOnlyView) Get(key string) (string, bool) {
+	return v.h.Get(key)
+}
+
+// Has is HashTable.Has.
+func (v ReadOnlyView) Has(key string) bool {
+	return v.h.Has(key)
+}
+
+// Len is HashTable.Len.
+func (v ReadOnlyView) Len() int {
+	return v.h.Len()
+}
+
+// Range is HashTable.Range.
+func (v ReadOnlyView) Range(f func(key string, value string) bool) {
+	v.h.Range(f)
+}
@@ -0,0 +1,121 @@
+package cmap
+
+import "sort"
+
+// ShardStore is the storage of the records of a single shard. The shard lock guards every call, so implementations don't need to be safe for concurrent use. Range must tolerate Delete being called on the key it is visiting.
+type ShardStore interface {
+	// Get returns the value of the key and whether it exists.
+	Get(key string) (string, bool)
+	// Set stores the value of the key, overriding any previous one.
+	Set(key string, value string)
+	// Delete removes the key, if it exists.
+	Delete(key string)
+	// Len returns the number of stored keys.
+	Len() int
+	// Range calls f for every stored record until f returns false.
+	Range(f func(key string, value string) bool)
+}
+
+// mapStore is the default ShardStore, backed by a Go map.
+type mapStore map[string]string
+
+func newMapStore() ShardStore {
+	return make(mapStore)
+}
+
+func (m mapStore) Get(key string) (string, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+func (m mapStore) Set(key string, value string) {
+	m[key] = value
+}
+
+func (m mapStore) Delete(key string) {
+	delete(m, key)
+}
+
+func (m mapStore) Len() int {
+	return len(m)
+}
+
+func (m mapStore) Range(f func(key string, value string) bool) {
+	for k, v := range m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// NewSliceStore returns a ShardStore that keeps the records in a slice sorted by key and finds them by binary search. It takes less memory than a map for small shards, but adding and deleting a record moves the ones after it, so it only suits shards of a few hundred records. Pass it to WithShardStore.
+func NewSliceStore() ShardStore {
+	return &sliceStore{}
+}
+
+// sliceStore is the ShardStore returned by NewSliceStore.
+type sliceStore struct {
+	records []Pair
+}
+
+// find returns the position of the key in the records, or where it would be inserted, and whether it is there.
+func (s *sliceStore) find(key string) (int, bool) {
+	i := sort.Search(len(s.records), func(i int) bool { return s.records[i].Key >= key })
+	return i, i < len(s.records) && s.records[i].Key == key
+}
+
+func (s *sliceStore) Get(key string) (string, bool) {
+	if i, ok := s.find(key); ok {
+		return s.records[i].Value, true
+	}
+	return "", false
+}
+
+func (s *sliceStore) Set(key string, value string) {
+	i, ok := s.find(key)
+	if ok {
+		s.records[i].Value = value
+		return
+	}
+	s.records = append(s.records, Pair{})
+	copy(s.records[i+1:], s.records[i:])
+	s.records[i] = Pair{Key: key, Value: value}
+}
+
+func (s *sliceStore) Delete(key string) {
+	if i, ok := s.find(key); ok {
+		copy(s.records[i:], s.records[i+1:])
+		s.records[len(s.records)-1] = Pair{}
+		s.records = s.records[:len(s.records)-1]
+	}
+}
+
+func (s *sliceStore) Len() int {
+	return len(s.records)
+}
+
+// Range visits the records from the last one backwards, so deleting the visited record only moves records already visited.
+func (s *sliceStore) Range(f func(key string, value string) bool) {
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if i >= len(s.records) {
+			continue
+		}
+		if r := s.records[i]; !f(r.Key, r.Value) {
+			return
+		}
+	}
+}
+
+// storeToMap returns the records of the store as a map. The default store is returned as is, without copying.
+func storeToMap(store ShardStore) map[string]string {
+	if m, ok := store.(mapStore); ok {
+		return m
+	}
+
+	data := make(map[string]string, store.Len())
+	store.Range(func(k, v string) bool {
+		data[k] = v
+		return true
+	})
+	return data
+}
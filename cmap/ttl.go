@@ -0,0 +1,168 @@
+package cmap
+
+import (
+	"math/rand"
+	"time"
+)
+
+// NoTTL is the remaining lifetime reported by TTL for a record that never expires.
+const NoTTL time.Duration = -1
+
+// PutWithTTL adds a new key-value pair that expires after the given duration. Like Put, it ignores a pair exceeding the configured limits. An expired record is treated as absent by every read. It is removed by the next write to its key or by DeleteExpired. If there is already a record with the same key, it will be overridden along with its TTL.
+func (h HashTable) PutWithTTL(key string, value string, ttl time.Duration) {
+	h.putExpiring(key, value, now()+int64(ttl))
+}
+
+// PutWithTTLJitter is like PutWithTTL, but the TTL is moved by a random amount of up to jitter in either direction, so records stored together with the same TTL don't all expire at the same moment. The TTL never ends up below zero, in which case the record is stored already expired.
+func (h HashTable) PutWithTTLJitter(key string, value string, ttl time.Duration, jitter time.Duration) {
+	if jitter > 0 {
+		ttl += time.Duration(rand.Int63n(2*int64(jitter)+1)) - jitter
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	h.putExpiring(key, value, now()+int64(ttl))
+}
+
+// PutWithExpireAt is like PutWithTTL, but the record expires at the given time instead of after a duration. A time in the past stores the record already expired, so it is treated as absent right away.
+func (h HashTable) PutWithExpireAt(key string, value string, at time.Time) {
+	h.putExpiring(key, value, at.UnixNano())
+}
+
+// putExpiring stores the key-value pair with the given expiry in unix nanoseconds, ignoring a pair exceeding the configured limits.
+func (h HashTable) putExpiring(key string, value string, expires int64) {
+	if h.checkLimits(key, value) != nil {
+		return
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if h.set(shard, key, value) != 0 {
+		shard.expires[key] = expires
+	}
+}
+
+// PutWithTTI adds a new key-value pair that expires once it hasn't been read for the given idle duration. Every successful Get or MustGet of the key pushes its expiry back to idle from then, which takes the shard's write lock right after the read. Other reads, like MGet, Has, or Range, don't count as accesses. Like PutWithTTL, it ignores a pair exceeding the configured limits, and once expired, the record is treated as absent and removed by the next write to its key or by DeleteExpired. A later write of the key without an idle duration drops it.
+func (h HashTable) PutWithTTI(key string, value string, idle time.Duration) {
+	if h.checkLimits(key, value) != nil {
+		return
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if h.set(shard, key, value) != 0 {
+		shard.expires[key] = now() + int64(idle)
+		shard.setIdle(key, int64(idle))
+	}
+}
+
+// slide pushes back the expiry of the record stored with PutWithTTI by its idle duration, after a read.
+func (h HashTable) slide(key string) {
+	if h.isClosed() {
+		return
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if _, ok := h.live(shard, key); !ok {
+		return
+	}
+	if idle, ok := shard.idle[key]; ok {
+		shard.expires[key] = now() + idle
+	}
+}
+
+// Touch resets the expiry of the record so that it expires after the given duration from now. It returns false if the record doesn't exist or has already expired, or once the hashtable is closed. A record stored with PutWithTTI loses its idle timeout and keeps the new expiry.
+func (h HashTable) Touch(key string, ttl time.Duration) bool {
+	if h.isClosed() {
+		return false
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	if _, ok := h.live(shard, key); !ok {
+		return false
+	}
+	shard.expires[key] = now() + int64(ttl)
+	delete(shard.idle, key)
+	return true
+}
+
+// GetAndTouch returns the value associated with the key and resets its expiry to the given duration from now, under a single lock acquisition. If the record doesn't exist or has already expired, it will return empty string and false. Like Touch, it drops the idle timeout of PutWithTTI. Once the hashtable is closed, it is a plain read that leaves the expiry as it is.
+func (h HashTable) GetAndTouch(key string, ttl time.Duration) (string, bool) {
+	if h.isClosed() {
+		v, ok, _ := h.peek(key)
+		return v, ok
+	}
+
+	shard := h.lockShard(key)
+	defer shard.unlock()
+
+	v, ok := h.live(shard, key)
+	if !ok {
+		return "", false
+	}
+	shard.expires[key] = now() + int64(ttl)
+	delete(shard.idle, key)
+	return v, true
+}
+
+// TTL returns the remaining lifetime of the record and true, or NoTTL and true if the record never expires. If the record doesn't exist or has already expired, it will return 0 and false.
+func (h HashTable) TTL(key string) (time.Duration, bool) {
+	shard := h.rlockShard(key)
+	defer shard.Lock.RUnlock()
+
+	if _, ok := shard.Data.Get(key); !ok {
+		return 0, false
+	}
+
+	exp, ok := shard.expires[key]
+	if !ok {
+		return NoTTL, true
+	}
+
+	remaining := time.Duration(exp - now())
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// DeleteExpired removes every expired record from the hashtable and returns how many were removed. With WithSoftDelete, it also purges the tombstones whose retention ran out, which are not counted. The shards get swept one at a time. Once the hashtable is closed, it removes nothing and returns 0.
+func (h HashTable) DeleteExpired() int {
+	if h.isClosed() {
+		return 0
+	}
+
+	var hooks hookQueue
+	defer hooks.run(h.opts.onPanic)
+
+	h.layoutMu.RLock()
+	defer h.layoutMu.RUnlock()
+
+	var count int
+	for i, shard := range h.shards() {
+		hooks.add(shard.write(func() {
+			now := now()
+			var swept int
+			for k, exp := range shard.expires {
+				if exp <= now {
+					h.del(shard, k, EvictExpired)
+					swept++
+				}
+			}
+			if swept > 0 {
+				h.logf(shard, "cmap: swept %d expired records from shard %d", swept, i)
+			}
+			if purged := shard.purge(now); purged > 0 {
+				h.logf(shard, "cmap: purged %d tombstones from shard %d", purged, i)
+			}
+			count += swept
+		}))
+	}
+	return count
+}
@@ -0,0 +1,90 @@
+package cmap
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// waiters keeps the goroutines blocked in WaitFor, per key.
+type waiters struct {
+	count int32 // accessed atomically, lets wake skip the lock when nobody waits.
+
+	mu   sync.Mutex
+	keys map[string][]chan string
+}
+
+// WaitFor returns the value associated with the key. If the key doesn't exist, it blocks until another goroutine puts it or the context is done, in which case it returns the context's error.
+func (h HashTable) WaitFor(ctx context.Context, key string) (string, error) {
+	if v, ok := h.Get(key); ok {
+		return v, nil
+	}
+
+	// The waiter is registered before checking the key again, so a put is either seen by the check or wakes the waiter.
+	ch := make(chan string, 1)
+	h.waiters.mu.Lock()
+	if h.waiters.keys == nil {
+		h.waiters.keys = make(map[string][]chan string)
+	}
+	h.waiters.keys[key] = append(h.waiters.keys[key], ch)
+	atomic.AddInt32(&h.waiters.count, 1)
+	h.waiters.mu.Unlock()
+
+	if v, ok := h.Get(key); ok {
+		h.unwait(key, ch)
+		return v, nil
+	}
+
+	select {
+	case v := <-ch:
+		return v, nil
+	case <-ctx.Done():
+	}
+
+	h.unwait(key, ch)
+
+	// The key may have been put while the context was being cancelled.
+	select {
+	case v := <-ch:
+		return v, nil
+	default:
+		return "", ctx.Err()
+	}
+}
+
+// unwait removes the waiter of the key, if it hasn't been woken yet.
+func (h HashTable) unwait(key string, ch chan string) {
+	h.waiters.mu.Lock()
+	defer h.waiters.mu.Unlock()
+
+	list := h.waiters.keys[key]
+	for i, c := range list {
+		if c == ch {
+			list = append(list[:i], list[i+1:]...)
+			atomic.AddInt32(&h.waiters.count, -1)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(h.waiters.keys, key)
+	} else {
+		h.waiters.keys[key] = list
+	}
+}
+
+// wake hands the new value of the key to the goroutines waiting for it. The caller must hold the write lock of the shard holding the key.
+func (h HashTable) wake(key string, value string) {
+	if atomic.LoadInt32(&h.waiters.count) == 0 {
+		return
+	}
+
+	h.waiters.mu.Lock()
+	defer h.waiters.mu.Unlock()
+
+	list := h.waiters.keys[key]
+	for _, ch := range list {
+		ch <- value
+	}
+	delete(h.waiters.keys, key)
+	atomic.AddInt32(&h.waiters.count, -int32(len(list)))
+}
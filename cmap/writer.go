@@ -0,0 +1,122 @@
+package cmap
+
+import (
+	"sync"
+	"time"
+)
+
+// Pair is a record of the hashtable, as handed to the writer of WithWriter. Deleted is true if the record was deleted, in which case Value is empty.
+type Pair struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// writeBuffer keeps the changes waiting to be flushed to the writer. Only the latest change of each key is kept.
+type writeBuffer struct {
+	mu      sync.Mutex
+	pending []Pair
+	index   map[string]int // position of each key in pending.
+
+	// flushMu makes the flushes run one at a time, so the batches reach the writer in order.
+	flushMu sync.Mutex
+}
+
+// add queues the change, replacing any change of the same key still waiting.
+func (b *writeBuffer) add(p Pair) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if i, ok := b.index[p.Key]; ok {
+		b.pending[i] = p
+		return
+	}
+	if b.index == nil {
+		b.index = make(map[string]int)
+	}
+	b.index[p.Key] = len(b.pending)
+	b.pending = append(b.pending, p)
+}
+
+// take empties the buffer and returns what it held.
+func (b *writeBuffer) take() []Pair {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch := b.pending
+	b.pending, b.index = nil, nil
+	return batch
+}
+
+// requeue puts back a batch the writer failed to write, in front of the changes queued since. A key changed again in the meantime keeps its newer change.
+func (b *writeBuffer) requeue(batch []Pair) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := make([]Pair, 0, len(batch)+len(b.pending))
+	index := make(map[string]int, len(batch)+len(b.pending))
+	for _, p := range batch {
+		if _, ok := b.index[p.Key]; !ok {
+			index[p.Key] = len(pending)
+			pending = append(pending, p)
+		}
+	}
+	for _, p := range b.pending {
+		index[p.Key] = len(pending)
+		pending = append(pending, p)
+	}
+	b.pending, b.index = pending, index
+}
+
+// Flush hands every change waiting in the write buffer to the writer configured by WithWriter, and returns once the writer does. If the writer fails, the changes are kept to be retried by the next flush and its error is returned. Without a writer it does nothing.
+func (h HashTable) Flush() error {
+	if h.opts.writer == nil {
+		return nil
+	}
+
+	h.writes.flushMu.Lock()
+	defer h.writes.flushMu.Unlock()
+
+	batch := h.writes.take()
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := h.opts.writer(batch); err != nil {
+		h.writes.requeue(batch)
+		return err
+	}
+	return nil
+}
+
+// queueWrite queues the change for the writer, if there is one.
+func (h HashTable) queueWrite(p Pair) {
+	if h.opts.writer != nil {
+		h.writes.add(p)
+	}
+}
+
+// flushLoop flushes the write buffer every interval until the hashtable is closed. A failed flush is retried on the next tick.
+func (h HashTable) flushLoop(interval time.Duration) {
+	defer h.workers.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				h.logWrite(err)
+			}
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// logWrite reports a failed flush to the logger, if there is one.
+func (h HashTable) logWrite(err error) {
+	if logger := h.opts.logger; logger != nil {
+		runCallback(h.opts.onPanic, func() { logger("cmap: flushing writes failed: %v", err) })
+	}
+}
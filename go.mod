@@ -1,3 +1,5 @@
 module github.com/MehdiEidi/cmap
 
-go 1.17
+go 1.18
+
+require google.golang.org/protobuf v1.33.0